@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -11,6 +12,8 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -28,16 +31,21 @@ func init() {
 
 func main() {
 
+	// only the providers configured are built, misconfigured ones stop the server from starting
+	providers, err := service.NewProviders(env.Settings.Service, Logger)
+	if err != nil {
+		Logger.F("unable to build providers", "err", err)
+	}
+
 	// Start service
-	mailService := service.NewService([]service.IProvider{
-		service.NewSESProvider(env.Settings.Service.SES, Logger.C("provider", "ses")),
-		service.NewSparkpostProvider(env.Settings.Service.Sparkpost, Logger.C("provider", "sparkpost")),
-		service.NewSendgridProvider(env.Settings.Service.Sendgrid, Logger.C("provider", "sendgrid")),
-		service.NewSMTPProvider(env.Settings.Service.SMTP, Logger.C("provider", "smtp")),
-	}, Logger)
+	mailService, err := service.NewService(env.Settings.Service, providers, Logger)
+	if err != nil {
+		Logger.F("unable to start mail service", "err", err)
+	}
 
 	// Handlers
-	mailHandler := handler.NewHandler(mailService, Logger)
+	mailHandler := handler.NewHandler(env.Settings.Handler, mailService, Logger)
+	adminHandler := handler.NewAdminHandler(env.Settings.Handler, mailService, Logger)
 
 	// Start server
 	r := chi.NewRouter()
@@ -46,7 +54,45 @@ func main() {
 		_, _ = w.Write([]byte("pong"))
 	})
 	r.Route(fmt.Sprintf("/%s", env.Settings.Server.Context), func(r chi.Router) {
-		r.Post("/send", mailHandler.HandleSend)
+		r.Group(func(r chi.Router) {
+			// addresses are limited before API keys are checked, apps once they are known
+			r.Use(mailHandler.RateLimitByIP)
+			// with apps configured only their API keys can send mail
+			if env.Settings.Service.Apps.File != "" {
+				r.Use(mailHandler.Authenticate)
+			}
+			r.Use(mailHandler.RateLimit)
+			r.Post("/send", mailHandler.HandleSend)
+			r.Get("/send/{id}", mailHandler.HandleStatus)
+			// usage is counted for apps only
+			if env.Settings.Service.Apps.File != "" {
+				r.Get("/usage", mailHandler.HandleUsage)
+			}
+		})
+
+		// dead letters and provider health show the mail and errors of every app, they are part of the admin API
+		if env.Settings.Handler.AdminKey != "" {
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(adminHandler.Authorize)
+				r.Get("/dead-letters", mailHandler.HandleDeadLetters)
+				r.Get("/dead-letters/{id}", mailHandler.HandleDeadLetter)
+				r.Post("/dead-letters/{id}/requeue", mailHandler.HandleRequeue)
+				r.Get("/providers/health", mailHandler.HandleHealth)
+				r.Get("/apps", adminHandler.HandleListApps)
+				r.Post("/apps", adminHandler.HandleCreateApp)
+				r.Get("/apps/{id}", adminHandler.HandleGetApp)
+				r.Put("/apps/{id}", adminHandler.HandleUpdateApp)
+				r.Delete("/apps/{id}", adminHandler.HandleDeleteApp)
+				r.Post("/apps/{id}/rotate-key", adminHandler.HandleRotateAppKey)
+				r.Get("/providers", adminHandler.HandleListProviders)
+				r.Post("/providers", adminHandler.HandleCreateProvider)
+				r.Post("/providers/test", adminHandler.HandleTestProvider)
+				r.Get("/providers/{id}", adminHandler.HandleGetProvider)
+				r.Put("/providers/{id}", adminHandler.HandleUpdateProvider)
+				r.Delete("/providers/{id}", adminHandler.HandleDeleteProvider)
+				r.Get("/usage", adminHandler.HandleUsageReports)
+			})
+		}
 	})
 
 	http.Handle("/", r)
@@ -59,10 +105,44 @@ func main() {
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	Logger.I("Starting server...", "port", env.Settings.Server.Port)
+	go func() {
+		Logger.I("Starting server...", "port", env.Settings.Server.Port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			mailService.Quit()
+			Logger.F("listen and serve died", "err", err)
+		}
+	}()
+
+	// providers read from a file are rebuilt from it on SIGHUP, without restarting
+	if env.Settings.Service.ProvidersFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := mailService.ReloadProviders(); err != nil {
+					Logger.E("unable to reload providers, keeping the current ones", "err", err)
+				}
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+
+	Logger.I("shutting down", "signal", sig.String(), "timeout", env.Settings.Server.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), env.Settings.Server.ShutdownTimeout)
+	defer cancel()
+
+	// requests in progress finish first, so mail they accept is drained along with the rest
+	if err := server.Shutdown(ctx); err != nil {
+		Logger.E("unable to finish http requests", "err", err)
+	}
 
-	if err := server.ListenAndServe(); err != nil {
-		mailService.Quit()
-		Logger.F("listen and serve died", "err", err)
+	report, err := mailService.Shutdown(ctx)
+	if err != nil {
+		Logger.E("mail service shutdown incomplete", "err", err)
 	}
+	Logger.I("shutdown complete", "pending", len(report.Pending), "durable", report.Durable)
 }
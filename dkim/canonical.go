@@ -0,0 +1,115 @@
+package dkim
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// field is a header field as it appears in the message, folding included
+type field struct {
+	name string
+	raw  string
+}
+
+func (f *field) value() string {
+	value := f.raw[strings.IndexByte(f.raw, ':')+1:]
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(value))
+}
+
+// splitMessage separates the header fields from the body
+func splitMessage(msg []byte) ([]*field, []byte, error) {
+
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, nil, errors.New("unable to sign message without header and body separator")
+	}
+
+	var fields []*field
+	for _, line := range strings.SplitAfter(string(msg[:end+2]), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) == 0 {
+				return nil, nil, errors.New("message starts with a folded header line")
+			}
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return nil, nil, errors.New("malformed message header line")
+		}
+		fields = append(fields, &field{name: strings.TrimSpace(line[:colon]), raw: line})
+	}
+
+	return fields, msg[end+4:], nil
+}
+
+func lastField(fields []*field, name string) *field {
+	return lastUnusedField(fields, name, nil)
+}
+
+func lastUnusedField(fields []*field, name string, used map[*field]bool) *field {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if strings.EqualFold(fields[i].name, name) && !used[fields[i]] {
+			return fields[i]
+		}
+	}
+	return nil
+}
+
+// canonicalHeader applies the relaxed header canonicalization of RFC 6376 section 3.4.2
+func canonicalHeader(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	name := strings.ToLower(strings.TrimSpace(raw[:colon]))
+
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(raw[colon+1:])
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody applies the relaxed body canonicalization of RFC 6376 section 3.4.4
+func canonicalBody(body []byte) []byte {
+
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRightFunc(collapseWSP(line), isWSP)
+	}
+
+	// trailing empty lines are ignored, an empty body stays empty
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func collapseWSP(line string) string {
+	var buf strings.Builder
+	inWSP := false
+	for i := 0; i < len(line); i++ {
+		if isWSP(rune(line[i])) {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			buf.WriteByte(' ')
+			inWSP = false
+		}
+		buf.WriteByte(line[i])
+	}
+	if inWSP {
+		buf.WriteByte(' ')
+	}
+	return buf.String()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
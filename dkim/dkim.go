@@ -0,0 +1,226 @@
+// Package dkim signs raw messages with DKIM (RFC 6376), using relaxed/relaxed canonicalization and either
+// rsa-sha256 or ed25519-sha256 (RFC 8463) depending on the key of the sender domain
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// Keys maps a sender domain to the PEM encoded private key file used to sign its mail
+	Keys map[string]string `json:"keys"`
+	// Selectors maps a sender domain to its selector, domains without one use Selector
+	Selectors map[string]string `json:"selectors"`
+	Selector  string            `json:"selector" default:"default"`
+	Headers   []string          `json:"headers" default:"From,To,Cc,Reply-To,Subject,MIME-Version,Content-Type"`
+}
+
+// DefaultHeaders are signed when the config does not list any. Date and Message-ID are left out, SES replaces
+// them on SendRawEmail and that would break the signature.
+var DefaultHeaders = []string{"From", "To", "Cc", "Reply-To", "Subject", "MIME-Version", "Content-Type"}
+
+type domainKey struct {
+	selector  string
+	algorithm string
+	key       crypto.Signer
+}
+
+// Signer signs messages of the sender domains it has a key for, messages from any other domain are left
+// untouched
+type Signer struct {
+	Now func() time.Time
+
+	keys    map[string]domainKey
+	headers []string
+}
+
+// NewSigner loads the private key of every configured domain
+func NewSigner(cfg Config) (*Signer, error) {
+
+	s := &Signer{
+		Now:     time.Now,
+		keys:    make(map[string]domainKey),
+		headers: cfg.Headers,
+	}
+
+	if len(s.headers) == 0 {
+		s.headers = DefaultHeaders
+	}
+
+	for domain, file := range cfg.Keys {
+		pemData, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read dkim key for %s", domain)
+		}
+
+		selector := cfg.Selectors[domain]
+		if selector == "" {
+			selector = cfg.Selector
+		}
+
+		if err := s.AddKey(domain, selector, pemData); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// AddKey registers the PEM encoded RSA or Ed25519 private key used to sign mail from domain
+func (s *Signer) AddKey(domain, selector string, pemData []byte) error {
+
+	if selector == "" {
+		return errors.New(fmt.Sprintf("missing dkim selector for %s", domain))
+	}
+
+	key, err := parseKey(pemData)
+	if err != nil {
+		return errors.Wrapf(err, "invalid dkim key for %s", domain)
+	}
+
+	algorithm := "rsa-sha256"
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+
+	s.keys[strings.ToLower(domain)] = domainKey{selector: selector, algorithm: algorithm, key: key}
+	return nil
+}
+
+// Sign prepends a DKIM-Signature header to msg when there is a key for the domain of its From address
+func (s *Signer) Sign(msg []byte) ([]byte, error) {
+
+	header, body, err := splitMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	from := lastField(header, "From")
+	if from == nil {
+		return nil, errors.New("unable to sign message without From header")
+	}
+
+	addr, err := mail.ParseAddress(from.value())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse From header")
+	}
+
+	domain := strings.ToLower(addr.Address[strings.LastIndex(addr.Address, "@")+1:])
+	key, ok := s.keys[domain]
+	if !ok {
+		return msg, nil
+	}
+
+	bodyHash := sha256.Sum256(canonicalBody(body))
+
+	// headers are picked bottom up, so a header listed twice signs two instances
+	var signed []string
+	var hashed bytes.Buffer
+	used := make(map[*field]bool)
+	for _, name := range s.headers {
+		f := lastUnusedField(header, name, used)
+		if f == nil {
+			continue
+		}
+		used[f] = true
+		signed = append(signed, strings.ToLower(name))
+		hashed.WriteString(canonicalHeader(f.raw))
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + key.algorithm,
+		"c=relaxed/relaxed",
+		"d=" + domain,
+		"s=" + key.selector,
+		fmt.Sprintf("t=%d", s.now().Unix()),
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+
+	// the signature header is hashed with an empty b= and without its trailing CRLF, folding it later at the
+	// tag separators does not change its relaxed form
+	hashed.WriteString(strings.TrimSuffix(canonicalHeader("DKIM-Signature: "+strings.Join(tags, "; ")), "\r\n"))
+
+	signature, err := sign(key.key, hashed.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to sign message")
+	}
+
+	var signedMsg bytes.Buffer
+	signedMsg.WriteString("DKIM-Signature: " + strings.Join(tags, ";\r\n ") + foldSignature(signature) + "\r\n")
+	signedMsg.Write(msg)
+
+	return signedMsg.Bytes(), nil
+}
+
+func (s *Signer) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func sign(key crypto.Signer, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	if edKey, ok := key.(ed25519.PrivateKey); ok {
+		// RFC 8463 signs the SHA-256 digest with PureEdDSA
+		return ed25519.Sign(edKey, digest[:]), nil
+	}
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func parseKey(pemData []byte) (crypto.Signer, error) {
+
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "unsupported private key")
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported private key type %T", key))
+	}
+}
+
+// foldSignature splits the base64 signature over several lines, whitespace in b= is ignored by verifiers
+func foldSignature(signature []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(signature)
+
+	var folded strings.Builder
+	for len(encoded) > 72 {
+		folded.WriteString(encoded[:72] + "\r\n ")
+		encoded = encoded[72:]
+	}
+	folded.WriteString(encoded)
+
+	return folded.String()
+}
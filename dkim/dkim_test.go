@@ -0,0 +1,251 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func TestCanonicalHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "simple field - should lowercase the name",
+			raw:      "A: X\r\n",
+			expected: "a:X\r\n",
+		},
+		{
+			name:     "folded field - should unfold and collapse whitespace",
+			raw:      "B : Y\t\r\n\tZ  \r\n",
+			expected: "b:Y Z\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, canonicalHeader(tt.raw))
+		})
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "whitespace and trailing lines - should be reduced",
+			body:     " C \r\nD \t E\r\n\r\n\r\n",
+			expected: " C\r\nD E\r\n",
+		},
+		{
+			name:     "missing final line break - should be added",
+			body:     "Hi.",
+			expected: "Hi.\r\n",
+		},
+		{
+			name:     "empty body - should stay empty",
+			body:     "\r\n\r\n",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, string(canonicalBody([]byte(tt.body))))
+		})
+	}
+}
+
+func TestSigner_Sign(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name              string
+		key               crypto.Signer
+		message           string
+		expectedSigned    bool
+		expectedAlgorithm string
+	}{
+		{
+			name:              "rsa key - should sign with rsa-sha256",
+			key:               rsaKey,
+			message:           testMessage,
+			expectedSigned:    true,
+			expectedAlgorithm: "rsa-sha256",
+		},
+		{
+			name:              "ed25519 key - should sign with ed25519-sha256",
+			key:               edKey,
+			message:           testMessage,
+			expectedSigned:    true,
+			expectedAlgorithm: "ed25519-sha256",
+		},
+		{
+			name:    "other sender domain - should leave the message untouched",
+			key:     rsaKey,
+			message: strings.Replace(testMessage, "joe@football.example.com>", "joe@other.example.com>", 1),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewSigner(Config{Keys: map[string]string{"football.example.com": writeKey(t, tt.key)}, Selector: "brisbane"})
+			assert.NoError(t, err)
+			signer.Now = func() time.Time { return time.Unix(1528637909, 0) }
+
+			signed, err := signer.Sign([]byte(tt.message))
+			assert.NoError(t, err)
+
+			if !tt.expectedSigned {
+				assert.Equal(t, tt.message, string(signed))
+				return
+			}
+
+			assert.True(t, strings.HasSuffix(string(signed), tt.message), "message altered by signing")
+
+			header, _, err := splitMessage(signed)
+			assert.NoError(t, err)
+			tags := parseTags(header[0].value())
+
+			assert.Equal(t, "DKIM-Signature", header[0].name)
+			assert.Equal(t, tt.expectedAlgorithm, tags["a"])
+			assert.Equal(t, "football.example.com", tags["d"])
+			assert.Equal(t, "brisbane", tags["s"])
+			assert.Equal(t, "1528637909", tags["t"])
+			// date and message-id are in the message but not signed by default
+			assert.Equal(t, "from:to:subject", tags["h"])
+			// body hash published with the relaxed/relaxed example of RFC 8463
+			assert.Equal(t, "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=", tags["bh"])
+
+			verify(t, tt.key.Public(), header, tags)
+		})
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	invalidKey := filepath.Join(t.TempDir(), "invalid.pem")
+	assert.NoError(t, os.WriteFile(invalidKey, []byte("not a key"), 0600))
+
+	tests := []struct {
+		name          string
+		cfg           Config
+		expectedError bool
+	}{
+		{
+			name: "valid key - should load",
+			cfg:  Config{Keys: map[string]string{"domain.com": writeKey(t, edKey)}, Selector: "default"},
+		},
+		{
+			name:          "missing key file - should fail",
+			cfg:           Config{Keys: map[string]string{"domain.com": "/does/not/exist.pem"}, Selector: "default"},
+			expectedError: true,
+		},
+		{
+			name:          "invalid key file - should fail",
+			cfg:           Config{Keys: map[string]string{"domain.com": invalidKey}, Selector: "default"},
+			expectedError: true,
+		},
+		{
+			name:          "no selector - should fail",
+			cfg:           Config{Keys: map[string]string{"domain.com": writeKey(t, edKey)}},
+			expectedError: true,
+		},
+		{
+			name: "per domain selector - should load without default selector",
+			cfg: Config{
+				Keys:      map[string]string{"domain.com": writeKey(t, edKey)},
+				Selectors: map[string]string{"domain.com": "mail"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSigner(tt.cfg)
+			assert.Equal(t, tt.expectedError, err != nil, "unexpected error: %v", err)
+		})
+	}
+}
+
+func writeKey(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "dkim.pem")
+	assert.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	return file
+}
+
+func parseTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+	}
+	return tags
+}
+
+// verify checks the signature the way a receiving server would
+func verify(t *testing.T, public crypto.PublicKey, header []*field, tags map[string]string) {
+
+	var hashed strings.Builder
+	used := make(map[*field]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		f := lastUnusedField(header[1:], name, used)
+		used[f] = true
+		hashed.WriteString(canonicalHeader(f.raw))
+	}
+
+	// the signature header is hashed with the value of its last tag, b=, removed
+	b := strings.LastIndex(header[0].raw, " b=") + len(" b=")
+	hashed.WriteString(strings.TrimSuffix(canonicalHeader(header[0].raw[:b]), "\r\n"))
+
+	digest := sha256.Sum256([]byte(hashed.String()))
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	assert.NoError(t, err)
+
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		assert.NoError(t, rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature), "invalid signature")
+	case ed25519.PublicKey:
+		assert.True(t, ed25519.Verify(public, digest[:], signature), "invalid signature")
+	}
+}
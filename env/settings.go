@@ -2,8 +2,10 @@ package env
 
 import (
 	"encoding/json"
+	"github.com/gugabfigueiredo/dream-mail-go/handler"
 	"github.com/gugabfigueiredo/dream-mail-go/service"
 	log "github.com/gugabfigueiredo/tiny-go-log"
+	"time"
 )
 
 type settings struct {
@@ -11,8 +13,13 @@ type settings struct {
 	Server struct {
 		Port    string `default:"8080"`
 		Context string `default:"dream-mail-go"`
+		// ShutdownTimeout bounds the whole shutdown, finishing HTTP requests and draining the mail queue
+		ShutdownTimeout time.Duration `default:"30s"`
 	}
 
+	// Handler
+	Handler handler.Config
+
 	// Log
 	Log *log.Config
 
@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/gugabfigueiredo/dream-mail-go/service"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminHandler manages apps and providers, every request needs the admin key as a bearer token
+type AdminHandler struct {
+	Service service.IAdminService
+	Logger  *log.Logger
+
+	key string
+}
+
+// TestProviderRequest is a provider record to try out, along with a mail to send through it if given
+type TestProviderRequest struct {
+	Provider models.Provider `json:"provider"`
+	Mail     *models.Mail    `json:"mail,omitempty"`
+}
+
+func NewAdminHandler(cfg Config, service service.IAdminService, logger *log.Logger) *AdminHandler {
+	return &AdminHandler{
+		Service: service,
+		Logger:  logger.C("admin", true),
+		key:     cfg.AdminKey,
+	}
+}
+
+// Authorize refuses requests without the admin key, every request is refused when no key is configured
+func (h *AdminHandler) Authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if h.key == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.key)) != 1 {
+			h.Logger.I("admin request refused", "remote", r.RemoteAddr)
+			http.Error(w, "invalid admin credentials", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *AdminHandler) HandleListApps(w http.ResponseWriter, r *http.Request) {
+	apps, err := h.Service.ListApps()
+	if err != nil {
+		h.fail(w, err, "unable to list apps")
+		return
+	}
+	writeJSON(w, http.StatusOK, apps, h.Logger)
+}
+
+func (h *AdminHandler) HandleGetApp(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	app, err := h.Service.GetApp(id)
+	if err != nil {
+		h.fail(w, err, "unable to read app")
+		return
+	}
+	writeJSON(w, http.StatusOK, app, h.Logger)
+}
+
+// HandleCreateApp creates an app, an API key is generated for it unless one is given
+func (h *AdminHandler) HandleCreateApp(w http.ResponseWriter, r *http.Request) {
+	var app models.App
+	if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
+		http.Error(w, "invalid app", http.StatusBadRequest)
+		return
+	}
+	app.ID = 0
+
+	if err := h.Service.SaveApp(&app); err != nil {
+		h.fail(w, err, "unable to create app")
+		return
+	}
+	writeJSON(w, http.StatusCreated, app, h.Logger)
+}
+
+// HandleUpdateApp replaces an app, it keeps its API key unless one is given
+func (h *AdminHandler) HandleUpdateApp(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	var app models.App
+	if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
+		http.Error(w, "invalid app", http.StatusBadRequest)
+		return
+	}
+	app.ID = id
+
+	if _, err := h.Service.GetApp(id); err != nil {
+		h.fail(w, err, "unable to read app")
+		return
+	}
+	if err := h.Service.SaveApp(&app); err != nil {
+		h.fail(w, err, "unable to update app")
+		return
+	}
+	writeJSON(w, http.StatusOK, app, h.Logger)
+}
+
+func (h *AdminHandler) HandleDeleteApp(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Service.DeleteApp(id); err != nil {
+		h.fail(w, err, "unable to delete app")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRotateAppKey gives the app a new API key and returns the app with it
+func (h *AdminHandler) HandleRotateAppKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	app, err := h.Service.RotateAppKey(id)
+	if err != nil {
+		h.fail(w, err, "unable to rotate app key")
+		return
+	}
+	writeJSON(w, http.StatusOK, app, h.Logger)
+}
+
+func (h *AdminHandler) HandleListProviders(w http.ResponseWriter, r *http.Request) {
+	records, err := h.Service.ListProviderRecords()
+	if err != nil {
+		h.fail(w, err, "unable to list providers")
+		return
+	}
+	writeJSON(w, http.StatusOK, records, h.Logger)
+}
+
+func (h *AdminHandler) HandleGetProvider(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	record, err := h.Service.GetProviderRecord(id)
+	if err != nil {
+		h.fail(w, err, "unable to read provider")
+		return
+	}
+	writeJSON(w, http.StatusOK, record, h.Logger)
+}
+
+// HandleCreateProvider adds a provider record last in the chain
+func (h *AdminHandler) HandleCreateProvider(w http.ResponseWriter, r *http.Request) {
+	var record models.Provider
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		http.Error(w, "invalid provider", http.StatusBadRequest)
+		return
+	}
+	record.ID = 0
+
+	if err := h.Service.SaveProviderRecord(&record); err != nil {
+		h.fail(w, err, "unable to create provider")
+		return
+	}
+	writeJSON(w, http.StatusCreated, record, h.Logger)
+}
+
+// HandleUpdateProvider replaces a provider record, keeping its place in the chain
+func (h *AdminHandler) HandleUpdateProvider(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	var record models.Provider
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		http.Error(w, "invalid provider", http.StatusBadRequest)
+		return
+	}
+	record.ID = id
+
+	if _, err := h.Service.GetProviderRecord(id); err != nil {
+		h.fail(w, err, "unable to read provider")
+		return
+	}
+	if err := h.Service.SaveProviderRecord(&record); err != nil {
+		h.fail(w, err, "unable to update provider")
+		return
+	}
+	writeJSON(w, http.StatusOK, record, h.Logger)
+}
+
+func (h *AdminHandler) HandleDeleteProvider(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Service.DeleteProviderRecord(id); err != nil {
+		h.fail(w, err, "unable to delete provider")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleTestProvider checks that a provider record builds, and sends the mail given through it. The provider
+// is not added to the chain.
+func (h *AdminHandler) HandleTestProvider(w http.ResponseWriter, r *http.Request) {
+	var test TestProviderRequest
+	if err := json.NewDecoder(r.Body).Decode(&test); err != nil {
+		http.Error(w, "invalid provider test", http.StatusBadRequest)
+		return
+	}
+	if test.Mail != nil {
+		if ok, err := test.Mail.Validate(); !ok {
+			http.Error(w, "invalid test e-mail: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := h.Service.TestProvider(r.Context(), &test.Provider, test.Mail)
+	var invalid *service.InvalidError
+	switch {
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+	case err != nil:
+		h.Logger.I("provider test failed", "provider", test.Provider.Name, "err", err)
+		writeJSON(w, http.StatusBadGateway, Response{Status: string(service.ErrorKindOf(err)), Message: err.Error()}, h.Logger)
+	case test.Mail != nil:
+		writeJSON(w, http.StatusOK, Response{Status: "OK", Message: "test e-mail sent"}, h.Logger)
+	default:
+		writeJSON(w, http.StatusOK, Response{Status: "OK", Message: "provider config is valid"}, h.Logger)
+	}
+}
+
+// fail answers with the status matching the error, unexpected errors are logged
+func (h *AdminHandler) fail(w http.ResponseWriter, err error, message string) {
+	var invalid *service.InvalidError
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+	case errors.Is(err, service.ErrNotManaged), errors.Is(err, service.ErrAppsNotPersisted):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		h.Logger.E(message, "err", err)
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
+
+func pathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
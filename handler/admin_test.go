@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/gugabfigueiredo/dream-mail-go/service"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockAdminService struct {
+	service.IAdminService
+
+	Apps map[int]*models.App
+}
+
+func (m *MockAdminService) GetApp(id int) (*models.App, error) {
+	app, ok := m.Apps[id]
+	if !ok {
+		return nil, service.ErrNotFound
+	}
+	return app, nil
+}
+
+func (m *MockAdminService) SaveApp(app *models.App) error {
+	if app.Name == "" {
+		return &service.InvalidError{Reason: "app without a name"}
+	}
+	if app.ID == 0 {
+		app.ID = len(m.Apps) + 1
+	}
+	m.Apps[app.ID] = app
+	return nil
+}
+
+// DeleteApp acts like apps kept in memory
+func (m *MockAdminService) DeleteApp(id int) error {
+	return service.ErrAppsNotPersisted
+}
+
+func (m *MockAdminService) ListProviderRecords() ([]*models.Provider, error) {
+	return nil, service.ErrNotManaged
+}
+
+func (m *MockAdminService) TestProvider(ctx context.Context, record *models.Provider, mail *models.Mail) error {
+	if record.Name != "smtp" {
+		return &service.InvalidError{Reason: "unknown provider type " + record.Name}
+	}
+	return nil
+}
+
+func TestAdminHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		token        string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "no admin key - should refuse",
+			method:       http.MethodGet,
+			path:         "/admin/apps/1",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "app api key - should refuse",
+			method:       http.MethodGet,
+			path:         "/admin/apps/1",
+			token:        "billing-key",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "existing app - should return it",
+			method:       http.MethodGet,
+			path:         "/admin/apps/1",
+			token:        "admin-key",
+			expectedCode: http.StatusOK,
+			expectedBody: `"name":"billing"`,
+		},
+		{
+			name:         "unknown app - should not be found",
+			method:       http.MethodPut,
+			path:         "/admin/apps/7",
+			body:         `{"name": "marketing"}`,
+			token:        "admin-key",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "new app - should be created",
+			method:       http.MethodPost,
+			path:         "/admin/apps",
+			body:         `{"id": 9, "name": "marketing"}`,
+			token:        "admin-key",
+			expectedCode: http.StatusCreated,
+			expectedBody: `"id":2`,
+		},
+		{
+			name:         "invalid app - should be refused",
+			method:       http.MethodPost,
+			path:         "/admin/apps",
+			body:         `{}`,
+			token:        "admin-key",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "app without a name",
+		},
+		{
+			name:         "apps not persisted - should conflict",
+			method:       http.MethodDelete,
+			path:         "/admin/apps/1",
+			token:        "admin-key",
+			expectedCode: http.StatusConflict,
+			expectedBody: "an apps file is needed",
+		},
+		{
+			name:         "providers not managed - should conflict",
+			method:       http.MethodGet,
+			path:         "/admin/providers",
+			token:        "admin-key",
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "valid provider config - should pass the test",
+			method:       http.MethodPost,
+			path:         "/admin/providers/test",
+			body:         `{"provider": {"name": "smtp"}}`,
+			token:        "admin-key",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "invalid provider config - should fail the test",
+			method:       http.MethodPost,
+			path:         "/admin/providers/test",
+			body:         `{"provider": {"name": "mandrill"}}`,
+			token:        "admin-key",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "unknown provider type mandrill",
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewAdminHandler(Config{AdminKey: "admin-key"}, &MockAdminService{
+				Apps: map[int]*models.App{1: {ID: 1, Name: "billing", APIKey: "billing-key"}},
+			}, logger)
+
+			r := chi.NewRouter()
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(h.Authorize)
+				r.Post("/apps", h.HandleCreateApp)
+				r.Get("/apps/{id}", h.HandleGetApp)
+				r.Put("/apps/{id}", h.HandleUpdateApp)
+				r.Delete("/apps/{id}", h.HandleDeleteApp)
+				r.Get("/providers", h.HandleListProviders)
+				r.Post("/providers/test", h.HandleTestProvider)
+			})
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code, "unexpected status code")
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+		})
+	}
+}
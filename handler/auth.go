@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"context"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/gugabfigueiredo/dream-mail-go/service"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// APIKeyHeader carries the API key of the app calling the service
+const APIKeyHeader = "X-API-Key"
+
+type appContextKey struct{}
+
+// Authenticate resolves the calling app from its API key and hands it to next through the request context,
+// requests without a known key are refused
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.Header.Get(APIKeyHeader)
+		if key == "" {
+			http.Error(w, "missing api key", http.StatusUnauthorized)
+			return
+		}
+
+		app, err := h.Service.Authenticate(key)
+		if errors.Is(err, service.ErrNotFound) {
+			h.Logger.I("unknown api key refused", "remote", r.RemoteAddr)
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			h.Logger.E("unable to authenticate app", "err", err)
+			http.Error(w, "unable to authenticate app", http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), appContextKey{}, app)))
+	})
+}
+
+// AppFromContext returns the app authenticated for the request, nil when authentication is disabled
+func AppFromContext(ctx context.Context) *models.App {
+	app, _ := ctx.Value(appContextKey{}).(*models.App)
+	return app
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/gugabfigueiredo/dream-mail-go/service"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockAuthService knows a single app
+type MockAuthService struct {
+	MockService
+}
+
+func (m *MockAuthService) Authenticate(key string) (*models.App, error) {
+	if key != "billing-key" {
+		return nil, service.ErrNotFound
+	}
+	return &models.App{ID: 1, Name: "billing", APIKey: key}, nil
+}
+
+func TestHandler_Authenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           string
+		app           string
+		expectedCode  int
+		expectedApp   string
+		expectedQueue int
+	}{
+		{
+			name:          "known key - should queue the mail stamped with its app",
+			key:           "billing-key",
+			app:           "marketing",
+			expectedCode:  http.StatusAccepted,
+			expectedApp:   "billing",
+			expectedQueue: 1,
+		},
+		{
+			name:         "unknown key - should refuse",
+			key:          "other-key",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "no key - should refuse",
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockService := &MockAuthService{}
+			h := NewHandler(Config{}, mockService, logger)
+
+			r := sendRequest(`{"app": "`+tt.app+`", "app_id": 2, "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, "")
+			if tt.key != "" {
+				r.Header.Set(APIKeyHeader, tt.key)
+			}
+
+			w := httptest.NewRecorder()
+			h.Authenticate(http.HandlerFunc(h.HandleSend)).ServeHTTP(w, r)
+			assert.Equal(t, tt.expectedCode, w.Code, "unexpected status code")
+
+			if assert.Len(t, mockService.Queued, tt.expectedQueue) && tt.expectedQueue > 0 {
+				assert.Equal(t, tt.expectedApp, mockService.Queued[0].App, "mail not stamped with the app")
+				assert.Equal(t, 1, mockService.Queued[0].AppID, "mail not stamped with the app id")
+			}
+		})
+	}
+}
+
+func TestHandler_HandleStatus_ScopedByApp(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           string
+		expectedCode int
+	}{
+		{
+			name:         "mail of the app - should report its status",
+			id:           "billing-mail",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "mail of another app - should not be found",
+			id:           "marketing-mail",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "mail of a former app of the same name - should not be found",
+			id:           "former-billing-mail",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "unknown mail - should not be found",
+			id:           "unknown",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	mockService := &MockAuthService{MockService{Statuses: map[string]*models.MailStatus{
+		"billing-mail":        {ID: "billing-mail", App: "billing", AppID: 1, State: models.MailSent},
+		"marketing-mail":      {ID: "marketing-mail", App: "marketing", AppID: 2, State: models.MailSent},
+		"former-billing-mail": {ID: "former-billing-mail", App: "billing", AppID: 3, State: models.MailSent},
+	}}}
+	h := NewHandler(Config{}, mockService, logger)
+
+	router := chi.NewRouter()
+	router.With(h.Authenticate).Get("/send/{id}", h.HandleStatus)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/send/"+tt.id, nil)
+			r.Header.Set(APIKeyHeader, "billing-key")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			assert.Equal(t, tt.expectedCode, w.Code, "unexpected status code")
+		})
+	}
+}
+
+func TestIdempotencyKey_ScopedByApp(t *testing.T) {
+	r := sendRequest("", "key-1")
+	assert.NotEqual(t, idempotencyKey(r, &models.Mail{App: "billing", AppID: 1}), idempotencyKey(r, &models.Mail{App: "billing", AppID: 2}))
+	assert.Equal(t, "key:key-1", idempotencyKey(r, &models.Mail{}))
+}
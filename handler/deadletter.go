@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/gugabfigueiredo/dream-mail-go/service"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// HandleDeadLetters lists the mail that exhausted its delivery attempts
+func (h *Handler) HandleDeadLetters(w http.ResponseWriter, r *http.Request) {
+
+	logger := h.Logger.C()
+
+	deadLetters, err := h.Service.DeadLetters()
+	if err != nil {
+		logger.E("unable to list dead letters", "err", err)
+		http.Error(w, "unable to list dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deadLetters, logger)
+}
+
+// HandleDeadLetter returns a single dead lettered mail with its attempts and last error
+func (h *Handler) HandleDeadLetter(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "id")
+	logger := h.Logger.C("mailID", id)
+
+	deadLetter, err := h.Service.DeadLetter(id)
+	if errors.Is(err, service.ErrNotFound) {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.E("unable to read dead letter", "err", err)
+		http.Error(w, "unable to read dead letter", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deadLetter, logger)
+}
+
+// HandleRequeue puts a dead lettered mail back in the mailing queue
+func (h *Handler) HandleRequeue(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "id")
+	logger := h.Logger.C("mailID", id)
+
+	err := h.Service.Requeue(id)
+	if errors.Is(err, service.ErrNotFound) {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, service.ErrMailExists) {
+		http.Error(w, "e-mail already queued", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.E("unable to requeue dead letter", "err", err)
+		http.Error(w, "unable to requeue dead letter", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Status: "OK", Message: "e-mail requeued for delivery"}, logger)
+
+	logger.I("dead letter requeued")
+}
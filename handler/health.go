@@ -0,0 +1,10 @@
+package handler
+
+import (
+	"net/http"
+)
+
+// HandleHealth reports the circuit breaker state of every provider, open providers are skipped on delivery
+func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.Service.Health(), h.Logger.C())
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyCache remembers the response given to recently accepted mail, so a client retrying a request
+// gets the original answer back instead of queuing the same mail twice
+type idempotencyCache struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	swept   time.Time
+}
+
+type idempotencyEntry struct {
+	// response is nil while the first request with the key is still being handled
+	response *SendResponse
+	expires  time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		entries: make(map[string]*idempotencyEntry),
+		swept:   time.Now(),
+	}
+}
+
+// begin claims a key for a new request. When the key was already used it returns the original response,
+// or inFlight when the original request has not finished yet.
+func (c *idempotencyCache) begin(key string) (response *SendResponse, inFlight bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		return entry.response, entry.response == nil
+	}
+
+	c.entries[key] = &idempotencyEntry{expires: now.Add(c.window)}
+	return nil, false
+}
+
+// commit stores the response for a key claimed with begin
+func (c *idempotencyCache) commit(key string, response *SendResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = &idempotencyEntry{response: response, expires: time.Now().Add(c.window)}
+}
+
+// release frees a key claimed with begin when the request was not accepted, so it can be retried
+func (c *idempotencyCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// sweep drops expired keys, at most once per window
+func (c *idempotencyCache) sweep(now time.Time) {
+	if now.Sub(c.swept) < c.window {
+		return
+	}
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.swept = now
+}
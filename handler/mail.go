@@ -2,11 +2,16 @@ package handler
 
 import (
 	"encoding/json"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
 	"github.com/gugabfigueiredo/dream-mail-go/service"
 	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Response struct {
@@ -14,18 +19,60 @@ type Response struct {
 	Message string `json:"message"`
 }
 
+// SendResponse acknowledges a queued mail, its ID can be used to follow the delivery status
+type SendResponse struct {
+	Response
+	ID       string           `json:"id"`
+	State    models.MailState `json:"state"`
+	Position int              `json:"position"`
+}
+
+type Config struct {
+	// IdempotencyWindow is how long accepted mail IDs and Idempotency-Key headers are remembered, 0 disables it
+	IdempotencyWindow time.Duration `json:"idempotency_window" default:"24h"`
+	// AdminKey is the bearer token of the admin API, the admin API is off without one
+	AdminKey string `json:"admin_key"`
+	// RateLimit caps the requests per second of every app, or every IP address without apps, 0 disables it.
+	// RateBurst is how many requests may come at once, a second worth of requests by default.
+	RateLimit float64 `json:"rate_limit" default:"0"`
+	RateBurst int     `json:"rate_burst"`
+	// RateLimitIP and RateBurstIP hold every IP address to its own rate before API keys are checked, they
+	// are kept apart from the app rate as many apps may call from behind the same address
+	RateLimitIP float64 `json:"rate_limit_ip" default:"0"`
+	RateBurstIP int     `json:"rate_burst_ip"`
+	// QueueRetryAfter is the Retry-After given to requests refused while the mailing queue is full
+	QueueRetryAfter time.Duration `json:"queue_retry_after" default:"5s"`
+}
+
 type Handler struct {
-	Service      service.IService
-	Logger       *log.Logger
-	MailingQueue chan models.Mail
-	RetryQueue   chan models.Mail
+	Service service.IService
+	Logger  *log.Logger
+
+	idempotency *idempotencyCache
+	limiter     *rateLimiter
+	ipLimiter   *rateLimiter
+	retryAfter  time.Duration
 }
 
-func NewHandler(service service.IService, logger *log.Logger) *Handler {
-	return &Handler{
-		Service: service,
-		Logger:  logger,
+func NewHandler(cfg Config, service service.IService, logger *log.Logger) *Handler {
+	h := &Handler{
+		Service:    service,
+		Logger:     logger,
+		retryAfter: cfg.QueueRetryAfter,
+	}
+
+	if cfg.IdempotencyWindow > 0 {
+		h.idempotency = newIdempotencyCache(cfg.IdempotencyWindow)
 	}
+
+	if cfg.RateLimit > 0 {
+		h.limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+	if cfg.RateLimitIP > 0 {
+		h.ipLimiter = newRateLimiter(cfg.RateLimitIP, cfg.RateBurstIP)
+	}
+
+	return h
 }
 
 func (h *Handler) HandleSend(w http.ResponseWriter, r *http.Request) {
@@ -38,20 +85,117 @@ func (h *Handler) HandleSend(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid or corrupted e-mail data", http.StatusBadRequest)
 		return
 	}
+
+	// mail is stamped with the app that sent it whatever the request says, without apps it has none
+	mail.App, mail.AppID = "", 0
+	app := AppFromContext(r.Context())
+	if app != nil {
+		mail.App, mail.AppID = app.Name, app.ID
+		logger = logger.C("app", app.Name)
+	}
+
+	// retried requests get the original answer instead of sending the mail twice
+	key := idempotencyKey(r, mail)
+	if h.idempotency != nil && key != "" {
+		original, inFlight := h.idempotency.begin(key)
+		if inFlight {
+			http.Error(w, "a request with the same idempotency key is in progress", http.StatusConflict)
+			return
+		}
+		if original != nil {
+			logger.I("duplicate e-mail ignored", "mailID", original.ID)
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, http.StatusAccepted, original, logger)
+			return
+		}
+	}
+
+	if mail.ID == "" {
+		mail.ID = uuid.New().String()
+	}
+
 	// queue mail for delivery
-	h.Service.QueueMail(mail)
+	if err := h.Service.QueueMail(mail); err != nil {
+		if h.idempotency != nil && key != "" {
+			h.idempotency.release(key)
+		}
+		if errors.Is(err, service.ErrShuttingDown) {
+			logger.I("e-mail refused during shutdown", "mailID", mail.ID)
+			http.Error(w, "service is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		// a full queue would hold the request until a sender frees up, the client is asked to come back instead
+		if errors.Is(err, service.ErrQueueFull) {
+			logger.I("e-mail refused, mailing queue full", "mailID", mail.ID)
+			if h.retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(h.retryAfter.Seconds()))))
+			}
+			http.Error(w, "mailing queue is full, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, service.ErrMailExists) {
+			logger.I("e-mail refused, id taken", "mailID", mail.ID)
+			http.Error(w, "an e-mail with the same id exists", http.StatusConflict)
+			return
+		}
+		var sender *service.SenderError
+		if errors.As(err, &sender) {
+			logger.I("e-mail refused, sender not allowed", "mailID", mail.ID, "from", sender.Sender)
+			http.Error(w, sender.Error(), http.StatusForbidden)
+			return
+		}
+		var quota *service.QuotaError
+		if errors.As(err, &quota) {
+			logger.I("e-mail refused, daily limit reached", "mailID", mail.ID, "limit", quota.Limit)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(quota.Until).Seconds()))))
+			http.Error(w, quota.Error(), http.StatusTooManyRequests)
+			return
+		}
+		logger.E("unable to queue e-mail", "err", err)
+		http.Error(w, "unable to queue e-mail", http.StatusInternalServerError)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode([]byte(`{"status":  "OK", "message": "e-mail queued for delivery"}`)); err != nil {
-		logger.E("error on json encoding", "err", err)
-		http.Error(w, "error writing response", http.StatusInternalServerError)
+	response := &SendResponse{
+		Response: Response{Status: "OK", Message: "e-mail queued for delivery"},
+		ID:       mail.ID,
+		State:    models.MailQueued,
+		Position: h.Service.Pending(),
+	}
+
+	if h.idempotency != nil && key != "" {
+		h.idempotency.commit(key, response)
+	}
+
+	writeJSON(w, http.StatusAccepted, response, logger)
+
+	logger.I("e-mail queued for delivery", "mailID", mail.ID)
+}
+
+// HandleStatus reports what happened to a mail queued through HandleSend, apps only see their own mail
+func (h *Handler) HandleStatus(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "id")
+	logger := h.Logger.C("mailID", id)
+
+	status, err := h.Service.Status(id)
+	if app := AppFromContext(r.Context()); err == nil && app != nil && status.AppID != app.ID {
+		err = service.ErrNotFound
+	}
+	if errors.Is(err, service.ErrNotFound) {
+		http.Error(w, "e-mail not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.E("unable to read e-mail status", "err", err)
+		http.Error(w, "unable to read e-mail status", http.StatusInternalServerError)
 		return
 	}
 
-	logger.I("e-mail queued for delivery")
+	writeJSON(w, http.StatusOK, status, logger)
 }
 
-// readMailFromRequest gets the email to be sent with all specs and unique ID, it returns error if mail is missing info
+// readMailFromRequest gets the email to be sent with all specs, it returns error if mail is missing info
 func readMailFromRequest(r *http.Request) (*models.Mail, error) {
 
 	var mail models.Mail
@@ -63,9 +207,30 @@ func readMailFromRequest(r *http.Request) (*models.Mail, error) {
 		return &models.Mail{}, err
 	}
 
-	if mail.ID == "" {
-		mail.ID = uuid.New().String()
+	return &mail, nil
+}
+
+// idempotencyKey identifies a send request across retries, by the Idempotency-Key header or else by the
+// mail ID chosen by the client. Requests with neither are never deduplicated. Keys are scoped to the app of
+// the mail, so apps cannot replay each other's answers.
+func idempotencyKey(r *http.Request, mail *models.Mail) string {
+	scope := ""
+	if mail.AppID != 0 {
+		scope = "app:" + strconv.Itoa(mail.AppID) + ":"
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return scope + "key:" + key
 	}
+	if mail.ID != "" {
+		return scope + "id:" + mail.ID
+	}
+	return ""
+}
 
-	return &mail, nil
+func writeJSON(w http.ResponseWriter, status int, body interface{}, logger *log.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.E("error on json encoding", "err", err)
+	}
 }
@@ -0,0 +1,283 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/gugabfigueiredo/dream-mail-go/service"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockService struct {
+	service.IService
+
+	QueueError error
+	Queued     []*models.Mail
+	Statuses   map[string]*models.MailStatus
+}
+
+func (m *MockService) QueueMail(mail *models.Mail) error {
+	if m.QueueError != nil {
+		return m.QueueError
+	}
+	m.Queued = append(m.Queued, mail)
+	return nil
+}
+
+func (m *MockService) Pending() int {
+	return len(m.Queued)
+}
+
+func (m *MockService) Status(id string) (*models.MailStatus, error) {
+	status, ok := m.Statuses[id]
+	if !ok {
+		return nil, service.ErrNotFound
+	}
+	return status, nil
+}
+
+func TestHandler_HandleSend(t *testing.T) {
+	tests := []struct {
+		name             string
+		body             string
+		queueError       error
+		expectedStatus   int
+		expectedResponse *SendResponse
+	}{
+		{
+			name:           "valid mail with id - should accept and return the id",
+			body:           `{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject", "text": "Test Text"}`,
+			expectedStatus: http.StatusAccepted,
+			expectedResponse: &SendResponse{
+				Response: Response{Status: "OK", Message: "e-mail queued for delivery"},
+				ID:       "1234",
+				State:    models.MailQueued,
+				Position: 1,
+			},
+		},
+		{
+			name:           "invalid mail - should reject",
+			body:           `{"from": {"addr": "sender@domain.com"}, "subject": "Test Subject"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "header in recipient address - should reject",
+			body:           `{"from": {"addr": "sender@domain.com"}, "to": [{"addr": "t@c.com>\r\nBcc: victim@x.com"}], "subject": "Test Subject"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "malformed bcc address - should reject",
+			body:           `{"from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "bcc": [{"addr": "victim@x.com@domain.com"}], "subject": "Test Subject"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "queue failure - should report internal error",
+			body:           `{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`,
+			queueError:     errors.New("disk full"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "service shutting down - should ask to retry later",
+			body:           `{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`,
+			queueError:     service.ErrShuttingDown,
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:           "daily limit reached - should ask to retry once it resets",
+			body:           `{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`,
+			queueError:     &service.QuotaError{App: "billing", Limit: 100, Until: time.Now().Add(time.Hour)},
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:           "id taken by another mail - should report a conflict",
+			body:           `{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`,
+			queueError:     service.ErrMailExists,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "sender not allowed - should forbid",
+			body:           `{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`,
+			queueError:     &service.SenderError{Sender: "sender@domain.com"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "queue full - should refuse at once",
+			body:           `{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`,
+			queueError:     service.ErrQueueFull,
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(Config{}, &MockService{QueueError: tt.queueError}, logger)
+
+			w := httptest.NewRecorder()
+			h.HandleSend(w, httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.expectedStatus, w.Code, "unexpected status code")
+			if tt.expectedStatus == http.StatusTooManyRequests {
+				assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+			}
+			if tt.expectedResponse == nil {
+				return
+			}
+
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var response SendResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+			assert.Equal(t, *tt.expectedResponse, response, "unexpected response")
+		})
+	}
+}
+
+func TestHandler_HandleSend_GeneratesID(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	mockService := &MockService{}
+	h := NewHandler(Config{}, mockService, logger)
+
+	w := httptest.NewRecorder()
+	body := `{"from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`
+	h.HandleSend(w, httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body)))
+
+	var response SendResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.NotEmpty(t, response.ID, "generated id not returned")
+	assert.Equal(t, mockService.Queued[0].ID, response.ID, "returned id does not match queued mail")
+}
+
+func TestHandler_HandleSend_IgnoresGivenApp(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	mockService := &MockService{}
+	h := NewHandler(Config{}, mockService, logger)
+
+	w := httptest.NewRecorder()
+	body := `{"app": "billing", "app_id": 1, "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`
+	h.HandleSend(w, httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Empty(t, mockService.Queued[0].App, "app taken from the request")
+	assert.Zero(t, mockService.Queued[0].AppID, "app id taken from the request")
+}
+
+func TestHandler_HandleSend_Idempotency(t *testing.T) {
+	tests := []struct {
+		name           string
+		requests       []*http.Request
+		queueErrors    []error
+		expectedQueued int
+		expectedCodes  []int
+	}{
+		{
+			name: "same idempotency key - should queue once",
+			requests: []*http.Request{
+				sendRequest(`{"from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, "key-1"),
+				sendRequest(`{"from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, "key-1"),
+			},
+			expectedQueued: 1,
+			expectedCodes:  []int{http.StatusAccepted, http.StatusAccepted},
+		},
+		{
+			name: "same mail id - should queue once",
+			requests: []*http.Request{
+				sendRequest(`{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, ""),
+				sendRequest(`{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, ""),
+			},
+			expectedQueued: 1,
+			expectedCodes:  []int{http.StatusAccepted, http.StatusAccepted},
+		},
+		{
+			name: "no key and no id - should queue every request",
+			requests: []*http.Request{
+				sendRequest(`{"from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, ""),
+				sendRequest(`{"from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, ""),
+			},
+			expectedQueued: 2,
+			expectedCodes:  []int{http.StatusAccepted, http.StatusAccepted},
+		},
+		{
+			name: "first attempt failed - should queue the retry",
+			requests: []*http.Request{
+				sendRequest(`{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, ""),
+				sendRequest(`{"id": "1234", "from": {"addr": "sender@domain.com"}, "to": [{"addr": "recipient@domain.com"}], "subject": "Test Subject"}`, ""),
+			},
+			queueErrors:    []error{errors.New("disk full"), nil},
+			expectedQueued: 1,
+			expectedCodes:  []int{http.StatusInternalServerError, http.StatusAccepted},
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockService := &MockService{}
+			h := NewHandler(Config{IdempotencyWindow: time.Hour}, mockService, logger)
+
+			var responses []SendResponse
+			for i, r := range tt.requests {
+				mockService.QueueError = nil
+				if i < len(tt.queueErrors) {
+					mockService.QueueError = tt.queueErrors[i]
+				}
+
+				w := httptest.NewRecorder()
+				h.HandleSend(w, r)
+				assert.Equal(t, tt.expectedCodes[i], w.Code, "unexpected status code")
+
+				if w.Code == http.StatusAccepted {
+					var response SendResponse
+					assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+					responses = append(responses, response)
+				}
+			}
+
+			assert.Len(t, mockService.Queued, tt.expectedQueued, "unexpected number of queued mail")
+
+			// duplicates get the id of the mail that was actually queued
+			if tt.expectedQueued == 1 {
+				for _, response := range responses {
+					assert.Equal(t, mockService.Queued[0].ID, response.ID, "unexpected id for duplicate")
+				}
+			}
+		})
+	}
+}
+
+func sendRequest(body, idempotencyKey string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body))
+	if idempotencyKey != "" {
+		r.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	return r
+}
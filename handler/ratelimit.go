@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter holds every client to a request rate with a token bucket, clients being apps once authenticated
+// and IP addresses otherwise
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   b,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// take spends a token of the client, when none is left it returns how long until the next one
+func (l *rateLimiter) take(client string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
+
+// sweep drops the buckets refilled by now, they are no different from new ones. It runs at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.swept = now
+}
+
+// RateLimitByIP refuses requests over the IP rate limit of their address with 429, it does nothing when no IP
+// rate is configured. It goes before Authenticate, so API keys cannot be guessed any faster than the rate.
+func (h *Handler) RateLimitByIP(next http.Handler) http.Handler {
+	if h.ipLimiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.limit(w, h.ipLimiter, "ip:"+clientIP(r)) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// RateLimit refuses requests over the rate limit of their client with 429, it does nothing when no rate is
+// configured. Behind Authenticate clients are told apart by app, otherwise by IP address.
+func (h *Handler) RateLimit(next http.Handler) http.Handler {
+	if h.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		client := "ip:" + clientIP(r)
+		if app := AppFromContext(r.Context()); app != nil {
+			client = "app:" + strconv.Itoa(app.ID)
+		}
+
+		if h.limit(w, h.limiter, client) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// limit spends a token of the client, refusing the request when none is left
+func (h *Handler) limit(w http.ResponseWriter, limiter *rateLimiter, client string) bool {
+	wait, ok := limiter.take(client)
+	if !ok {
+		h.Logger.I("request refused, rate limit reached", "client", client)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "rate limit reached", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// clientIP is the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_Take(t *testing.T) {
+
+	now := time.Now()
+	l := newRateLimiter(2, 0)
+	l.now = func() time.Time { return now }
+
+	// a second worth of requests goes through at once, then one every half second
+	_, ok := l.take("ip:10.0.0.1")
+	assert.True(t, ok)
+	_, ok = l.take("ip:10.0.0.1")
+	assert.True(t, ok)
+
+	wait, ok := l.take("ip:10.0.0.1")
+	assert.False(t, ok, "rate not enforced")
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	_, ok = l.take("ip:10.0.0.2")
+	assert.True(t, ok, "clients share a bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	_, ok = l.take("ip:10.0.0.1")
+	assert.True(t, ok, "bucket not refilled")
+
+	// idle clients are forgotten
+	now = now.Add(time.Minute)
+	l.take("ip:10.0.0.3")
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	h := NewHandler(Config{RateLimit: 1, RateLimitIP: 2}, &MockService{}, logger)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	byIP, limited := h.RateLimitByIP(ok), h.RateLimit(ok)
+
+	request := func(handler http.Handler, remote string, app *models.App) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/send/1234", nil)
+		r.RemoteAddr = remote
+		if app != nil {
+			r = r.WithContext(context.WithValue(r.Context(), appContextKey{}, app))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// addresses have a rate of their own, checked before any api key
+	assert.Equal(t, http.StatusOK, request(byIP, "10.0.0.1:5000", nil).Code)
+	assert.Equal(t, http.StatusOK, request(byIP, "10.0.0.1:5001", nil).Code)
+	w := request(byIP, "10.0.0.1:5002", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "same ip not limited")
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, request(byIP, "10.0.0.2:5000", nil).Code)
+
+	// apps are limited on their own, whatever address they call from and whoever shares it
+	billing := &models.App{ID: 1, Name: "billing"}
+	assert.Equal(t, http.StatusOK, request(limited, "10.0.0.3:5000", billing).Code)
+	assert.Equal(t, http.StatusTooManyRequests, request(limited, "10.0.0.4:5000", billing).Code)
+	assert.Equal(t, http.StatusOK, request(limited, "10.0.0.3:5001", &models.App{ID: 2, Name: "marketing"}).Code)
+
+	// without apps clients are told apart by address
+	assert.Equal(t, http.StatusOK, request(limited, "10.0.0.3:5002", nil).Code)
+	assert.Equal(t, http.StatusTooManyRequests, request(limited, "10.0.0.3:5003", nil).Code)
+
+	// without a rate nothing is limited
+	h = NewHandler(Config{}, &MockService{}, logger)
+	assert.Nil(t, h.limiter)
+	assert.Nil(t, h.ipLimiter)
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"github.com/gugabfigueiredo/dream-mail-go/service"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// HandleUsage reports the usage of the calling app, it goes behind Authenticate
+func (h *Handler) HandleUsage(w http.ResponseWriter, r *http.Request) {
+
+	app := AppFromContext(r.Context())
+	if app == nil {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	logger := h.Logger.C("app", app.Name)
+
+	report, err := h.Service.Usage(app.ID)
+	if errors.Is(err, service.ErrNotFound) {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.E("unable to read app usage", "err", err)
+		http.Error(w, "unable to read app usage", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report, logger)
+}
+
+// HandleUsageReports reports the usage of every app
+func (h *AdminHandler) HandleUsageReports(w http.ResponseWriter, r *http.Request) {
+	reports, err := h.Service.UsageReports()
+	if err != nil {
+		h.fail(w, err, "unable to read usage")
+		return
+	}
+	writeJSON(w, http.StatusOK, reports, h.Logger)
+}
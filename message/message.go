@@ -0,0 +1,418 @@
+// Package message composes RFC 5322 / MIME messages out of models.Mail, for providers that take raw messages
+package message
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxLineLength is the line length header folding aims for, as recommended by RFC 5322
+const maxLineLength = 78
+
+// base64LineLength is the maximum encoded line length allowed by RFC 2045
+const base64LineLength = 76
+
+// maxEncodedWordLength keeps RFC 2047 encoded words short enough to follow any header name on the first line
+const maxEncodedWordLength = 64
+
+var messageIDPattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+/=?^_{|}~.-]+$`)
+
+// Builder composes raw messages. The zero value is ready to use, Boundary and Now only need to be set to
+// produce deterministic output.
+type Builder struct {
+	Boundary func() string
+	Now      func() time.Time
+}
+
+// NewBuilder returns a builder with random boundaries that stamps messages with the current time
+func NewBuilder() *Builder {
+	return &Builder{
+		Boundary: RandomBoundary,
+		Now:      time.Now,
+	}
+}
+
+// Build composes the raw message for mail. Blind copies are never written to the headers, they must be
+// added to the envelope recipients by the caller.
+//
+// The body is laid out as
+//
+//	multipart/mixed             when there are attachments
+//	  multipart/alternative     when there is both text and html
+//	    text/plain
+//	    multipart/related       when there are inline attachments
+//	      text/html
+//	      inline attachments
+//	  attachments
+func (b *Builder) Build(m *models.Mail) ([]byte, error) {
+
+	body, err := b.body(m)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := formatAddress(m.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := formatAddressList(m.To)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := formatAddressList(m.CC)
+	if err != nil {
+		return nil, err
+	}
+	var replyTo string
+	if m.ReplyTo.Addr != "" {
+		if replyTo, err = formatAddress(m.ReplyTo); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+
+	writeHeader(&buf, "From", from)
+	if to != "" {
+		writeHeader(&buf, "To", to)
+	}
+	if cc != "" {
+		writeHeader(&buf, "Cc", cc)
+	}
+	if replyTo != "" {
+		writeHeader(&buf, "Reply-To", replyTo)
+	}
+	writeHeader(&buf, "Subject", encodeWords(m.Subject))
+	writeHeader(&buf, "Date", b.now().Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageID(m))
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	for _, field := range body.header {
+		writeHeader(&buf, field.name, field.value)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.content)
+	if !bytes.HasSuffix(body.content, []byte("\r\n")) {
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Build composes a message with random boundaries stamped with the current time
+func Build(m *models.Mail) ([]byte, error) {
+	return NewBuilder().Build(m)
+}
+
+// RandomBoundary returns a boundary that will not show up in any encoded content
+func RandomBoundary() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return "dmail-" + hex.EncodeToString(buf[:])
+}
+
+type headerField struct {
+	name  string
+	value string
+}
+
+// part is an encoded MIME entity, content holds everything after the blank line following the header
+type part struct {
+	header  []headerField
+	content []byte
+}
+
+func (b *Builder) body(m *models.Mail) (*part, error) {
+
+	var inline, attached []models.Attachment
+	for _, attachment := range m.Attachments {
+		if attachment.ContentID != "" && m.HTML != "" {
+			inline = append(inline, attachment)
+			continue
+		}
+		attached = append(attached, attachment)
+	}
+
+	var alternatives []*part
+	if m.Text != "" || m.HTML == "" {
+		alternatives = append(alternatives, textPart("text/plain", m.Text))
+	}
+
+	if m.HTML != "" {
+		html := textPart("text/html", m.HTML)
+		if len(inline) > 0 {
+			related := []*part{html}
+			for _, attachment := range inline {
+				p, err := attachmentPart(attachment, "inline")
+				if err != nil {
+					return nil, err
+				}
+				related = append(related, p)
+			}
+			html = b.multipart("related", related)
+		}
+		alternatives = append(alternatives, html)
+	}
+
+	content := alternatives[0]
+	if len(alternatives) > 1 {
+		content = b.multipart("alternative", alternatives)
+	}
+
+	if len(attached) == 0 {
+		return content, nil
+	}
+
+	mixed := []*part{content}
+	for _, attachment := range attached {
+		p, err := attachmentPart(attachment, "attachment")
+		if err != nil {
+			return nil, err
+		}
+		mixed = append(mixed, p)
+	}
+
+	return b.multipart("mixed", mixed), nil
+}
+
+func (b *Builder) multipart(subtype string, parts []*part) *part {
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(b.boundary()); err != nil {
+		// only reachable with a broken Boundary func, boundaries are never user input
+		panic(err)
+	}
+
+	for _, p := range parts {
+		header := make(textproto.MIMEHeader)
+		for _, field := range p.header {
+			header.Set(field.name, field.value)
+		}
+		pw, _ := w.CreatePart(header)
+		_, _ = pw.Write(p.content)
+	}
+	_ = w.Close()
+
+	return &part{
+		header: []headerField{
+			{"Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": w.Boundary()})},
+		},
+		content: buf.Bytes(),
+	}
+}
+
+func textPart(mediaType, text string) *part {
+
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	_, _ = w.Write([]byte(text))
+	_ = w.Close()
+
+	return &part{
+		header: []headerField{
+			{"Content-Type", mime.FormatMediaType(mediaType, map[string]string{"charset": "utf-8"})},
+			{"Content-Transfer-Encoding", "quoted-printable"},
+		},
+		content: buf.Bytes(),
+	}
+}
+
+// attachmentPart re-wraps the base64 attachment data, it is validated so a corrupted attachment fails the
+// build instead of reaching the recipient. The type and content ID are checked as well, they end up in headers.
+func attachmentPart(attachment models.Attachment, disposition string) (*part, error) {
+
+	_, fileName := filepath.Split(attachment.Name)
+
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(attachment.Data), ""))
+	if err != nil {
+		return nil, errors.Wrapf(err, "attachment %s is not valid base64", fileName)
+	}
+
+	mediaType, params := "application/octet-stream", map[string]string(nil)
+	if attachment.Type != "" {
+		if mediaType, params, err = mime.ParseMediaType(attachment.Type); err != nil {
+			return nil, errors.Wrapf(err, "attachment %s has an invalid type", fileName)
+		}
+	}
+
+	if strings.IndexFunc(attachment.ContentID, unicode.IsControl) >= 0 {
+		return nil, errors.New(fmt.Sprintf("attachment %s has an invalid content id", fileName))
+	}
+
+	header := []headerField{
+		{"Content-Type", mime.FormatMediaType(mediaType, params)},
+		{"Content-Transfer-Encoding", "base64"},
+		{"Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName})},
+	}
+	if attachment.ContentID != "" {
+		header = append(header, headerField{"Content-ID", "<" + attachment.ContentID + ">"})
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var buf bytes.Buffer
+	for len(encoded) > base64LineLength {
+		buf.WriteString(encoded[:base64LineLength] + "\r\n")
+		encoded = encoded[base64LineLength:]
+	}
+	buf.WriteString(encoded)
+
+	return &part{header: header, content: buf.Bytes()}, nil
+}
+
+func (b *Builder) boundary() string {
+	if b.Boundary == nil {
+		return RandomBoundary()
+	}
+	return b.Boundary()
+}
+
+func (b *Builder) now() time.Time {
+	if b.Now == nil {
+		return time.Now()
+	}
+	return b.Now()
+}
+
+// parseAddress checks that addr is a single bare address, so it cannot carry anything else into a header
+func parseAddress(addr string) (string, error) {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid address %q", addr)
+	}
+	if parsed.Name != "" || parsed.Address != addr {
+		return "", errors.New(fmt.Sprintf("invalid address %q", addr))
+	}
+	return parsed.Address, nil
+}
+
+// formatAddress renders an address with its display name RFC 2047 encoded when needed
+func formatAddress(email models.Email) (string, error) {
+	addr, err := parseAddress(email.Addr)
+	if err != nil {
+		return "", err
+	}
+	if isPrintableASCII(email.Name) {
+		return (&mail.Address{Name: email.Name, Address: addr}).String(), nil
+	}
+	return encodeWords(email.Name) + " <" + addr + ">", nil
+}
+
+func formatAddressList(emails []models.Email) (string, error) {
+	var addrs []string
+	for _, email := range emails {
+		addr, err := formatAddress(email)
+		if err != nil {
+			return "", err
+		}
+		addrs = append(addrs, addr)
+	}
+	return strings.Join(addrs, ", "), nil
+}
+
+// messageID derives the Message-ID from the mail ID, so the same mail keeps the same ID across retries. The
+// sender address is checked by Build beforehand.
+func messageID(m *models.Mail) string {
+
+	domain := "localhost"
+	if at := strings.LastIndex(m.From.Addr, "@"); at >= 0 && at < len(m.From.Addr)-1 {
+		domain = m.From.Addr[at+1:]
+	}
+
+	id := m.ID
+	if !messageIDPattern.MatchString(id) {
+		id = hex.EncodeToString([]byte(id))
+	}
+	if id == "" {
+		id = strings.TrimPrefix(RandomBoundary(), "dmail-")
+	}
+
+	return fmt.Sprintf("<%s@%s>", id, domain)
+}
+
+// encodeWords RFC 2047 Q-encodes text that is not plain ASCII. The text is split into as many encoded words
+// as needed to keep each one within maxEncodedWordLength, never splitting a character, so the header can
+// be folded between them.
+func encodeWords(text string) string {
+	if isPrintableASCII(text) {
+		return text
+	}
+
+	const prefix, suffix = "=?utf-8?q?", "?="
+
+	var words []string
+	var word strings.Builder
+	for _, r := range text {
+		encoded := qEncode(string(r))
+		if word.Len() > 0 && len(prefix)+word.Len()+len(encoded)+len(suffix) > maxEncodedWordLength {
+			words = append(words, prefix+word.String()+suffix)
+			word.Reset()
+		}
+		word.WriteString(encoded)
+	}
+	words = append(words, prefix+word.String()+suffix)
+
+	return strings.Join(words, " ")
+}
+
+// qEncode applies the RFC 2047 Q encoding, restricted to the characters allowed in a phrase
+func qEncode(text string) string {
+	var buf strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.IndexByte("!*+-/", c) >= 0:
+			buf.WriteByte(c)
+		case c == ' ':
+			buf.WriteByte('_')
+		default:
+			fmt.Fprintf(&buf, "=%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func isPrintableASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] < ' ' || text[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// writeHeader writes a header field folded at whitespace so lines stay within maxLineLength where possible
+func writeHeader(buf *bytes.Buffer, name, value string) {
+
+	buf.WriteString(name + ":")
+	lineLength := len(name) + 1
+
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLength+1+len(word) > maxLineLength {
+			buf.WriteString("\r\n")
+			lineLength = 0
+		}
+		buf.WriteString(" " + word)
+		lineLength += 1 + len(word)
+	}
+
+	buf.WriteString("\r\n")
+}
@@ -0,0 +1,254 @@
+package message
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// testBuilder produces deterministic messages for golden files
+func testBuilder() *Builder {
+	count := 0
+	return &Builder{
+		Boundary: func() string {
+			count++
+			return fmt.Sprintf("boundary-%d", count)
+		},
+		Now: func() time.Time {
+			return time.Date(2023, 7, 24, 20, 10, 21, 0, time.UTC)
+		},
+	}
+}
+
+func TestBuilder_Build(t *testing.T) {
+	tests := []struct {
+		name string
+		mail *models.Mail
+	}{
+		{
+			name: "plaintext",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com", Name: "Sender"},
+				To:      []models.Email{{Addr: "recipient@domain.com", Name: "Recipient"}},
+				Subject: "Test Subject",
+				Text:    "Test Text\nwith a second line and a very long line that goes well beyond the seventy six characters quoted printable allows",
+			},
+		},
+		{
+			name: "html",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				Subject: "Test Subject",
+				HTML:    "<h1>Hello World!</h1>",
+			},
+		},
+		{
+			name: "alternative",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				Subject: "Test Subject",
+				Text:    "Hello World!",
+				HTML:    "<h1>Hello World!</h1>",
+			},
+		},
+		{
+			name: "attachments",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				Subject: "Test Subject",
+				Text:    "Hello World!",
+				HTML:    "<h1>Hello World!</h1>",
+				Attachments: []models.Attachment{
+					{Name: "test.txt", Type: "text/plain", Data: "SGVsbG8gV29ybGQ="},
+					{Name: "/some/path/relatório.bin", Data: strings.Repeat("AAAA", 30)},
+				},
+			},
+		},
+		{
+			name: "related",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				Subject: "Test Subject",
+				Text:    "Hello World!",
+				HTML:    `<h1>Hello World!</h1><img src="cid:logo">`,
+				Attachments: []models.Attachment{
+					{Name: "logo.png", Type: "image/png", Data: "iVBORw0KGgo=", ContentID: "logo"},
+					{Name: "test.txt", Type: "text/plain", Data: "SGVsbG8gV29ybGQ="},
+				},
+			},
+		},
+		{
+			name: "headers",
+			mail: &models.Mail{
+				ID:   "not a valid message id",
+				From: models.Email{Addr: "sender@domain.com", Name: "Zoë Remetente"},
+				To: []models.Email{
+					{Addr: "first.recipient@domain.com", Name: "First Recipient"},
+					{Addr: "second.recipient@domain.com", Name: "Second Recipient"},
+					{Addr: "third.recipient@domain.com"},
+				},
+				CC:      []models.Email{{Addr: "cc@domain.com", Name: "Cópia"}},
+				BCC:     []models.Email{{Addr: "bcc@domain.com"}},
+				ReplyTo: models.Email{Addr: "reply@domain.com"},
+				Subject: "Relatório de vendas do trimestre, com números e projeções para o próximo ano",
+				Text:    "Olá, segue o relatório.",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := testBuilder().Build(tt.mail)
+			assert.NoError(t, err)
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				assert.NoError(t, os.MkdirAll("testdata", 0o755))
+				assert.NoError(t, os.WriteFile(golden, msg, 0o644))
+			}
+
+			expected, err := os.ReadFile(golden)
+			assert.NoError(t, err)
+			assert.Equal(t, string(expected), string(msg), "message does not match %s", golden)
+
+			assert.NotContains(t, string(msg), "bcc@domain.com", "bcc leaked to the headers")
+			for _, line := range strings.Split(string(msg), "\r\n") {
+				assert.LessOrEqual(t, len(line), maxLineLength, "line too long: %s", line)
+			}
+		})
+	}
+}
+
+func TestBuilder_Build_InvalidAttachment(t *testing.T) {
+	tests := []struct {
+		name          string
+		attachment    models.Attachment
+		expectedError string
+	}{
+		{
+			name:          "invalid base64 - should fail",
+			attachment:    models.Attachment{Name: "test.txt", Type: "text/plain", Data: "not base64!"},
+			expectedError: "attachment test.txt is not valid base64",
+		},
+		{
+			name:          "header in type - should fail",
+			attachment:    models.Attachment{Name: "test.txt", Type: "text/plain\r\nBcc: victim@domain.com", Data: "dGVzdA=="},
+			expectedError: "attachment test.txt has an invalid type",
+		},
+		{
+			name:          "header in content id - should fail",
+			attachment:    models.Attachment{Name: "logo.png", Type: "image/png", Data: "dGVzdA==", ContentID: "logo>\r\nBcc: victim@domain.com"},
+			expectedError: "attachment logo.png has an invalid content id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testBuilder().Build(&models.Mail{
+				From:        models.Email{Addr: "sender@domain.com"},
+				To:          []models.Email{{Addr: "recipient@domain.com"}},
+				Subject:     "Test Subject",
+				Attachments: []models.Attachment{tt.attachment},
+			})
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.expectedError)
+			}
+		})
+	}
+}
+
+func TestBuilder_Build_InvalidAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		mail *models.Mail
+	}{
+		{
+			name: "header in recipient - should fail",
+			mail: &models.Mail{
+				From: models.Email{Addr: "sender@domain.com"},
+				To:   []models.Email{{Addr: "t@c.com>\r\nBcc: victim@x.com"}},
+			},
+		},
+		{
+			name: "header in sender - should fail",
+			mail: &models.Mail{
+				From: models.Email{Addr: "a@b.com\r\nX-Evil: 1"},
+				To:   []models.Email{{Addr: "recipient@domain.com"}},
+			},
+		},
+		{
+			name: "header in non ascii recipient - should fail",
+			mail: &models.Mail{
+				From: models.Email{Addr: "sender@domain.com"},
+				To:   []models.Email{{Name: "Jöhn", Addr: "t@c.com>\r\nBcc: victim@x.com"}},
+			},
+		},
+		{
+			name: "header in cc - should fail",
+			mail: &models.Mail{
+				From: models.Email{Addr: "sender@domain.com"},
+				To:   []models.Email{{Addr: "recipient@domain.com"}},
+				CC:   []models.Email{{Addr: "c@c.com\r\nX-Evil: 1"}},
+			},
+		},
+		{
+			name: "header in reply to - should fail",
+			mail: &models.Mail{
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				ReplyTo: models.Email{Addr: "r@c.com\r\nX-Evil: 1"},
+			},
+		},
+		{
+			name: "address with a name - should fail",
+			mail: &models.Mail{
+				From: models.Email{Addr: "sender@domain.com"},
+				To:   []models.Email{{Addr: "Recipient <recipient@domain.com>"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mail.Subject, tt.mail.Text = "Test Subject", "Test Text"
+			msg, err := testBuilder().Build(tt.mail)
+			assert.ErrorContains(t, err, "invalid address")
+			assert.Nil(t, msg)
+		})
+	}
+}
+
+func TestBuild_RandomBoundary(t *testing.T) {
+	mail := &models.Mail{
+		From:    models.Email{Addr: "sender@domain.com"},
+		To:      []models.Email{{Addr: "recipient@domain.com"}},
+		Subject: "Test Subject",
+		Text:    "Hello World!",
+		HTML:    "<h1>Hello World!</h1>",
+	}
+
+	first, err := Build(mail)
+	assert.NoError(t, err)
+	second, err := Build(mail)
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, string(first), string(second), "boundaries are not random")
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"encoding/json"
 	"github.com/pkg/errors"
+	"net/mail"
+	"time"
 )
 
 type Email struct {
@@ -14,16 +16,27 @@ type Attachment struct {
 	Name string `json:"name"`
 	Type string `json:"type"`
 	Data string `json:"data"`
+	// ContentID makes the attachment inline, referenced from the html as cid:<ContentID>
+	ContentID string `json:"content_id,omitempty"`
 }
 
 type Mail struct {
 	ID          string       `json:"id"`
 	From        Email        `json:"from"`
 	To          []Email      `json:"to"`
+	CC          []Email      `json:"cc,omitempty"`
+	BCC         []Email      `json:"bcc,omitempty"`
+	ReplyTo     Email        `json:"reply_to"`
 	Subject     string       `json:"subject"`
 	Text        string       `json:"text"`
 	HTML        string       `json:"html"`
 	Attachments []Attachment `json:"attachments"`
+	// Tags categorize the mail, such as marketing or password-reset, routing rules can pick providers by tag
+	Tags []string `json:"tags,omitempty"`
+	// App is the application the mail is sent on behalf of, stamped from the API key of the request. The mail
+	// belongs to the app of AppID, names can be changed and reused.
+	App   string `json:"app,omitempty"`
+	AppID int    `json:"app_id,omitempty"`
 }
 
 func NewMail(from Email, subject, text string) *Mail {
@@ -40,6 +53,29 @@ func (m *Mail) AddTo(to ...Email) {
 	}
 }
 
+func (m *Mail) AddCC(cc ...Email) {
+	m.CC = append(m.CC, cc...)
+}
+
+func (m *Mail) AddBCC(bcc ...Email) {
+	m.BCC = append(m.BCC, bcc...)
+}
+
+func (m *Mail) SetReplyTo(replyTo Email) {
+	m.ReplyTo = replyTo
+}
+
+// Recipients lists every address the mail must be delivered to, including the blind copies
+func (m *Mail) Recipients() []string {
+	var recipients []string
+	for _, list := range [][]Email{m.To, m.CC, m.BCC} {
+		for _, recipient := range list {
+			recipients = append(recipients, recipient.Addr)
+		}
+	}
+	return recipients
+}
+
 func (m *Mail) AddAttachment(name, mimeType string, data string) {
 	m.Attachments = append(m.Attachments, Attachment{
 		Name: name,
@@ -48,6 +84,12 @@ func (m *Mail) AddAttachment(name, mimeType string, data string) {
 	})
 }
 
+// validAddress tells whether addr is a single bare address, such as user@domain.com
+func validAddress(addr string) bool {
+	parsed, err := mail.ParseAddress(addr)
+	return err == nil && parsed.Name == "" && parsed.Address == addr
+}
+
 func (m *Mail) Validate() (bool, error) {
 
 	// validate email
@@ -55,6 +97,10 @@ func (m *Mail) Validate() (bool, error) {
 		return false, errors.New("missing sender")
 	}
 
+	if !validAddress(m.From.Addr) {
+		return false, errors.New("invalid sender address")
+	}
+
 	if len(m.To) == 0 {
 		return false, errors.New("missing recipient")
 	}
@@ -63,6 +109,35 @@ func (m *Mail) Validate() (bool, error) {
 		if recipient.Addr == "" {
 			return false, errors.New("missing recipient address")
 		}
+		if !validAddress(recipient.Addr) {
+			return false, errors.New("invalid recipient address")
+		}
+	}
+
+	for _, recipient := range m.CC {
+		if recipient.Addr == "" {
+			return false, errors.New("missing cc address")
+		}
+		if !validAddress(recipient.Addr) {
+			return false, errors.New("invalid cc address")
+		}
+	}
+
+	for _, recipient := range m.BCC {
+		if recipient.Addr == "" {
+			return false, errors.New("missing bcc address")
+		}
+		if !validAddress(recipient.Addr) {
+			return false, errors.New("invalid bcc address")
+		}
+	}
+
+	if m.ReplyTo.Name != "" && m.ReplyTo.Addr == "" {
+		return false, errors.New("missing reply-to address")
+	}
+
+	if m.ReplyTo.Addr != "" && !validAddress(m.ReplyTo.Addr) {
+		return false, errors.New("invalid reply-to address")
 	}
 
 	if m.Subject == "" {
@@ -72,9 +147,65 @@ func (m *Mail) Validate() (bool, error) {
 	return true, nil
 }
 
+type MailState string
+
+const (
+	MailQueued  MailState = "queued"
+	MailSending MailState = "sending"
+	MailSent    MailState = "sent"
+	MailFailed  MailState = "failed"
+	MailBounced MailState = "bounced"
+)
+
+// Attempt is a single try at handing a mail to a provider
+type Attempt struct {
+	Provider string    `json:"provider"`
+	At       time.Time `json:"at"`
+	Error    string    `json:"error,omitempty"`
+	// Kind classifies the error: transient, permanent, rate_limited or auth_failed
+	Kind string `json:"kind,omitempty"`
+}
+
+// MailStatus tracks what happened to a mail since it was queued
+type MailStatus struct {
+	ID string `json:"id"`
+	// App is the app the mail was sent by, only the app of AppID can read the status
+	App       string    `json:"app,omitempty"`
+	AppID     int       `json:"app_id,omitempty"`
+	State     MailState `json:"state"`
+	Provider  string    `json:"provider,omitempty"`
+	Attempts  []Attempt `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CircuitState string
+
+const (
+	// CircuitClosed providers get every mail
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen providers are skipped until their cooldown is over
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen providers get a single probe mail, its outcome closes or opens the circuit again
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// ProviderHealth is the circuit breaker state of a provider
+type ProviderHealth struct {
+	Provider            string       `json:"provider"`
+	State               CircuitState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	LastError           string       `json:"last_error,omitempty"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+}
+
 type Provider struct {
-	ID     int             `json:"id"`
-	Name   string          `json:"name"`
+	ID int `json:"id"`
+	// Name is what the provider built from the record goes by in routing, weights, limits and statuses
+	Name string `json:"name"`
+	// Type is the registered provider type the record is built with, the name when empty
+	Type   string          `json:"type,omitempty"`
 	Config json.RawMessage `json:"config"`
 }
 
@@ -83,4 +214,26 @@ type App struct {
 	Name      string `json:"name"`
 	Providers []int  `json:"providers"`
 	APIKey    string `json:"api_key"`
+	// DailyLimit caps the mail accepted from the app per UTC day, 0 leaves it uncapped
+	DailyLimit int `json:"daily_limit,omitempty"`
+	// Senders lists the domains and addresses the app may send from, among the ones allowed globally
+	Senders []string `json:"senders,omitempty"`
+}
+
+// UsageBucket counts the mail of an app over an hour or a day starting at Start. Sent, failed and bounced
+// mail is counted when the outcome is known, in the bucket of that time.
+type UsageBucket struct {
+	Start    time.Time `json:"start"`
+	Accepted int       `json:"accepted"`
+	Sent     int       `json:"sent"`
+	// Failed mail exhausted its delivery attempts, Bounced mail was refused for good by every provider
+	Failed  int `json:"failed"`
+	Bounced int `json:"bounced"`
+}
+
+// UsageReport is the usage of an app by hour and by day, oldest first
+type UsageReport struct {
+	App    string        `json:"app"`
+	Hourly []UsageBucket `json:"hourly"`
+	Daily  []UsageBucket `json:"daily"`
 }
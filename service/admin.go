@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+)
+
+// ErrNotManaged is returned when changing providers that were not built from provider records
+var ErrNotManaged = errors.New("providers are not managed by records, a providers file is needed")
+
+// ErrAppsNotPersisted is returned when changing apps only kept in memory, they and their API keys would be
+// lost on restart
+var ErrAppsNotPersisted = errors.New("apps are not persisted, an apps file is needed")
+
+// InvalidError is returned for apps and provider records refused as given, the reason tells what to fix
+type InvalidError struct {
+	Reason string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Reason
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &InvalidError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// IAdminService manages the apps allowed to send mail and the provider records the chain is built from
+type IAdminService interface {
+	ListApps() ([]*models.App, error)
+	GetApp(id int) (*models.App, error)
+	SaveApp(app *models.App) error
+	DeleteApp(id int) error
+	RotateAppKey(id int) (*models.App, error)
+	ListProviderRecords() ([]*models.Provider, error)
+	GetProviderRecord(id int) (*models.Provider, error)
+	SaveProviderRecord(record *models.Provider) error
+	DeleteProviderRecord(id int) error
+	TestProvider(ctx context.Context, record *models.Provider, mail *models.Mail) error
+	UsageReports() ([]*models.UsageReport, error)
+}
+
+func (s *Service) ListApps() ([]*models.App, error) {
+	return s.Apps.List()
+}
+
+func (s *Service) GetApp(id int) (*models.App, error) {
+	return s.Apps.Get(id)
+}
+
+// SaveApp creates the app when its ID is 0 or else replaces it. An app saved without an API key keeps the one
+// it has, or gets a new one when created. The providers of an app must be records of the current chain.
+func (s *Service) SaveApp(app *models.App) error {
+	if !s.appsPersisted() {
+		return ErrAppsNotPersisted
+	}
+
+	if app.APIKey == "" && app.ID != 0 {
+		current, err := s.Apps.Get(app.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if current != nil {
+			app.APIKey = current.APIKey
+		}
+	}
+	if app.APIKey == "" {
+		key, err := newAPIKey()
+		if err != nil {
+			return err
+		}
+		app.APIKey = key
+	}
+
+	if err := validSenders(app.Senders); err != nil {
+		return invalid("app %s given an %s", app.Name, err)
+	}
+
+	if err := checkProviders(app, s.currentChain().ids); err != nil {
+		return err
+	}
+
+	if err := s.Apps.Save(app); err != nil {
+		return err
+	}
+
+	s.Logger.I("app saved", "app", app.Name, "appID", app.ID)
+	return nil
+}
+
+func (s *Service) DeleteApp(id int) error {
+	if !s.appsPersisted() {
+		return ErrAppsNotPersisted
+	}
+	if err := s.Apps.Delete(id); err != nil {
+		return err
+	}
+
+	s.Logger.I("app deleted", "appID", id)
+	return nil
+}
+
+// RotateAppKey gives the app a new API key, the previous one stops working at once
+func (s *Service) RotateAppKey(id int) (*models.App, error) {
+	if !s.appsPersisted() {
+		return nil, ErrAppsNotPersisted
+	}
+
+	app, err := s.Apps.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.APIKey, err = newAPIKey(); err != nil {
+		return nil, err
+	}
+	if err := s.Apps.Save(app); err != nil {
+		return nil, err
+	}
+
+	s.Logger.I("app key rotated", "app", app.Name, "appID", app.ID)
+	return app, nil
+}
+
+// appsPersisted tells whether apps outlive a restart, only then can they be changed
+func (s *Service) appsPersisted() bool {
+	_, inMemory := s.Apps.(*MemoryAppStore)
+	return !inMemory
+}
+
+func newAPIKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "unable to generate api key")
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func (s *Service) ListProviderRecords() ([]*models.Provider, error) {
+	if s.Records == nil {
+		return nil, ErrNotManaged
+	}
+	return s.Records.List()
+}
+
+func (s *Service) GetProviderRecord(id int) (*models.Provider, error) {
+	if s.Records == nil {
+		return nil, ErrNotManaged
+	}
+	return s.Records.Get(id)
+}
+
+// SaveProviderRecord creates the record when its ID is 0 or else replaces it, then rebuilds the chain from the
+// records. A record that does not build, or leaves a chain the routing, weights or limits do not fit, is
+// refused and the records are left as they were.
+func (s *Service) SaveProviderRecord(record *models.Provider) error {
+	if s.Records == nil {
+		return ErrNotManaged
+	}
+
+	if _, err := buildRecord(record, ProviderDeps{Logger: s.Logger, Signer: s.signer}); err != nil {
+		return invalid(err.Error())
+	}
+
+	s.recordsMu.Lock()
+	defer s.recordsMu.Unlock()
+
+	var previous *models.Provider
+	if record.ID != 0 {
+		current, err := s.Records.Get(record.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		previous = current
+	}
+
+	if err := s.Records.Save(record); err != nil {
+		return errors.Wrap(err, "unable to save provider record")
+	}
+
+	if err := s.loadRecords(); err != nil {
+		undo := func() error { return s.Records.Delete(record.ID) }
+		if previous != nil {
+			undo = func() error { return s.Records.Save(previous) }
+		}
+		if err := undo(); err != nil {
+			s.Logger.E("unable to restore provider records", "err", err)
+		}
+		return invalid(err.Error())
+	}
+	return nil
+}
+
+// DeleteProviderRecord takes the record out and rebuilds the chain from the others, records apps send through
+// cannot be deleted
+func (s *Service) DeleteProviderRecord(id int) error {
+	if s.Records == nil {
+		return ErrNotManaged
+	}
+
+	apps, err := s.Apps.List()
+	if err != nil {
+		return err
+	}
+	for _, app := range apps {
+		for _, provider := range app.Providers {
+			if provider == id {
+				return invalid("provider %d is used by app %s", id, app.Name)
+			}
+		}
+	}
+
+	s.recordsMu.Lock()
+	defer s.recordsMu.Unlock()
+
+	previous, err := s.Records.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := s.Records.Delete(id); err != nil {
+		return errors.Wrap(err, "unable to delete provider record")
+	}
+
+	if err := s.loadRecords(); err != nil {
+		if err := s.Records.Save(previous); err != nil {
+			s.Logger.E("unable to restore provider records", "err", err)
+		}
+		return invalid(err.Error())
+	}
+	return nil
+}
+
+// TestProvider builds a provider from the record without putting it in the chain, then sends the mail through
+// it when one is given. Records that do not build fail with an InvalidError, sends with the provider error.
+func (s *Service) TestProvider(ctx context.Context, record *models.Provider, mail *models.Mail) error {
+
+	provider, err := buildRecord(record, ProviderDeps{Logger: s.Logger, Signer: s.signer})
+	if err != nil {
+		return invalid(err.Error())
+	}
+	if mail == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout(provider.Name()))
+	defer cancel()
+	return provider.SendMail(ctx, mail)
+}
+
+// loadRecords rebuilds the chain from the provider records
+func (s *Service) loadRecords() error {
+	listed, err := s.Records.List()
+	if err != nil {
+		return err
+	}
+
+	records := make([]models.Provider, 0, len(listed))
+	for _, record := range listed {
+		records = append(records, *record)
+	}
+	return s.LoadProviders(records)
+}
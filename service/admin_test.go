@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAdminService(t *testing.T, dir string) *Service {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	providersFile := filepath.Join(dir, "providers.json")
+	if _, err := os.Stat(providersFile); os.IsNotExist(err) {
+		assert.NoError(t, writeJSONFile(providersFile, []models.Provider{
+			{Name: "first", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+		}))
+	}
+
+	s, err := NewService(Config{
+		Workers:       1,
+		ProvidersFile: providersFile,
+		Apps:          AppsConfig{File: filepath.Join(dir, "apps.json")},
+	}, nil, logger)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestService_AdminApps(t *testing.T) {
+
+	dir := t.TempDir()
+	s := newAdminService(t, dir)
+
+	// created apps get an ID and an API key
+	app := &models.App{Name: "billing", Providers: []int{1}}
+	assert.NoError(t, s.SaveApp(app))
+	assert.Equal(t, 1, app.ID)
+	assert.Len(t, app.APIKey, 64)
+
+	var invalid *InvalidError
+	assert.ErrorAs(t, s.SaveApp(&models.App{Name: "billing"}), &invalid)
+	assert.EqualError(t, s.SaveApp(&models.App{Name: "marketing", Providers: []int{7}}), "app marketing given unknown provider 7")
+
+	// updates keep the key, rotations replace it
+	key := app.APIKey
+	assert.NoError(t, s.SaveApp(&models.App{ID: app.ID, Name: "payments"}))
+	updated, err := s.Authenticate(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "payments", updated.Name)
+
+	rotated, err := s.RotateAppKey(app.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, rotated.APIKey)
+	_, err = s.Authenticate(key)
+	assert.ErrorIs(t, err, ErrNotFound, "previous key still accepted")
+
+	_, err = s.RotateAppKey(42)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// apps survive a restart through their file
+	s.Quit()
+	s = newAdminService(t, dir)
+	defer s.Quit()
+
+	found, err := s.Authenticate(rotated.APIKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "payments", found.Name)
+
+	assert.NoError(t, s.DeleteApp(found.ID))
+	assert.ErrorIs(t, s.DeleteApp(found.ID), ErrNotFound)
+}
+
+func TestService_AdminProviders(t *testing.T) {
+
+	dir := t.TempDir()
+	s := newAdminService(t, dir)
+	defer s.Quit()
+
+	// records are numbered on first read and new ones go last in the chain
+	record := &models.Provider{Name: "second", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)}
+	assert.NoError(t, s.SaveProviderRecord(record))
+	assert.Equal(t, 2, record.ID)
+	assert.Equal(t, []string{"first", "second"}, providerNames(s.Providers()))
+
+	// updates keep their place in the chain
+	assert.NoError(t, s.SaveProviderRecord(&models.Provider{ID: 1, Name: "renamed", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)}))
+	assert.Equal(t, []string{"renamed", "second"}, providerNames(s.Providers()))
+
+	// records that do not build are refused and leave the file as it was
+	var invalid *InvalidError
+	assert.ErrorAs(t, s.SaveProviderRecord(&models.Provider{ID: 2, Name: "second", Type: "mock", Config: json.RawMessage(`{}`)}), &invalid)
+	records, err := s.ListProviderRecords()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.JSONEq(t, `{"name": "account"}`, string(records[1].Config))
+
+	// records an app sends through cannot be deleted, the last one leaves no chain
+	assert.NoError(t, s.SaveApp(&models.App{Name: "billing", Providers: []int{2}}))
+	assert.EqualError(t, s.DeleteProviderRecord(2), "provider 2 is used by app billing")
+	assert.NoError(t, s.DeleteProviderRecord(1))
+	assert.Equal(t, []string{"second"}, providerNames(s.Providers()))
+	assert.ErrorIs(t, s.DeleteProviderRecord(1), ErrNotFound)
+
+	assert.NoError(t, s.DeleteApp(1))
+	assert.EqualError(t, s.DeleteProviderRecord(2), "no provider configured")
+	_, err = s.GetProviderRecord(2)
+	assert.NoError(t, err, "record of a refused delete not restored")
+
+	// tests do not touch the chain
+	assert.NoError(t, s.TestProvider(context.Background(), &models.Provider{Name: "trial", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)}, &models.Mail{ID: "test"}))
+	assert.ErrorAs(t, s.TestProvider(context.Background(), &models.Provider{Name: "sendgrid"}, nil), &invalid)
+	assert.Equal(t, []string{"second"}, providerNames(s.Providers()))
+}
+
+func TestService_AdminProviders_NotManaged(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	s, err := NewService(Config{Workers: 1}, []IProvider{&MockProvider{}}, logger)
+	assert.NoError(t, err)
+	defer s.Quit()
+
+	_, err = s.ListProviderRecords()
+	assert.ErrorIs(t, err, ErrNotManaged)
+
+	// apps kept in memory would be lost on restart along with their keys
+	assert.ErrorIs(t, s.SaveApp(&models.App{Name: "billing"}), ErrAppsNotPersisted)
+	_, err = s.RotateAppKey(1)
+	assert.ErrorIs(t, err, ErrAppsNotPersisted)
+	assert.ErrorIs(t, s.DeleteApp(1), ErrAppsNotPersisted)
+	assert.ErrorIs(t, s.SaveProviderRecord(&models.Provider{Name: "mock", Config: json.RawMessage(`{"name": "first"}`)}), ErrNotManaged)
+	assert.ErrorIs(t, s.ReloadProviders(), ErrNotManaged)
+}
@@ -0,0 +1,332 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// IAppStore keeps the apps allowed to send mail, looked up by ID, name or API key
+type IAppStore interface {
+	List() ([]*models.App, error)
+	Get(id int) (*models.App, error)
+	GetByName(name string) (*models.App, error)
+	GetByKey(key string) (*models.App, error)
+	// Save creates the app when its ID is 0, giving it the next free ID, or else puts it under its ID
+	Save(app *models.App) error
+	Delete(id int) error
+}
+
+type AppsConfig struct {
+	// File holds a JSON array of apps, apps changed through the admin API are written back to it. Once given
+	// mail is only accepted with the API key of one of them.
+	File string `json:"file"`
+}
+
+// NewAppStore opens the apps file of the config, without one apps are only kept in memory
+func NewAppStore(cfg AppsConfig) (IAppStore, error) {
+	if cfg.File == "" {
+		return NewMemoryAppStore(nil)
+	}
+	return NewFileAppStore(cfg.File)
+}
+
+type MemoryAppStore struct {
+	mu   sync.RWMutex
+	apps map[int]models.App
+	keys map[string]int
+	// lastID is the highest ID ever given out, IDs of deleted apps are never given again as mail and usage
+	// stay tied to them
+	lastID int
+}
+
+// NewMemoryAppStore keeps the apps given, every app needs a name and an API key of its own
+func NewMemoryAppStore(apps []models.App) (*MemoryAppStore, error) {
+	m := &MemoryAppStore{
+		apps: make(map[int]models.App),
+		keys: make(map[string]int),
+	}
+
+	for i := range apps {
+		if _, taken := m.apps[apps[i].ID]; taken {
+			return nil, invalid("app id %d listed twice", apps[i].ID)
+		}
+		if err := m.Save(&apps[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *MemoryAppStore) List() ([]*models.App, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	apps := make([]*models.App, 0, len(m.apps))
+	for _, app := range m.apps {
+		listed := app
+		listed.Providers = append([]int(nil), app.Providers...)
+		apps = append(apps, &listed)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].ID < apps[j].ID })
+	return apps, nil
+}
+
+func (m *MemoryAppStore) Get(id int) (*models.App, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	app, ok := m.apps[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	app.Providers = append([]int(nil), app.Providers...)
+	return &app, nil
+}
+
+func (m *MemoryAppStore) GetByName(name string) (*models.App, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, app := range m.apps {
+		if app.Name == name {
+			app.Providers = append([]int(nil), app.Providers...)
+			return &app, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryAppStore) GetByKey(key string) (*models.App, error) {
+	m.mu.RLock()
+	id, ok := m.keys[key]
+	m.mu.RUnlock()
+
+	if !ok || key == "" {
+		return nil, ErrNotFound
+	}
+	return m.Get(id)
+}
+
+func (m *MemoryAppStore) Save(app *models.App) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case app.Name == "":
+		return invalid("app without a name")
+	case app.APIKey == "":
+		return invalid("app %s without an api key", app.Name)
+	}
+	for id, current := range m.apps {
+		if id == app.ID {
+			continue
+		}
+		if current.Name == app.Name {
+			return invalid("app %s already exists", app.Name)
+		}
+		if current.APIKey == app.APIKey {
+			return invalid("app %s reuses the api key of another app", app.Name)
+		}
+	}
+
+	if app.ID == 0 {
+		app.ID = m.lastID
+		for id := range m.apps {
+			if id > app.ID {
+				app.ID = id
+			}
+		}
+		app.ID++
+	}
+	if app.ID > m.lastID {
+		m.lastID = app.ID
+	}
+
+	if previous, ok := m.apps[app.ID]; ok {
+		delete(m.keys, previous.APIKey)
+	}
+	saved := *app
+	saved.Providers = append([]int(nil), app.Providers...)
+	m.apps[app.ID] = saved
+	m.keys[app.APIKey] = app.ID
+	return nil
+}
+
+func (m *MemoryAppStore) Delete(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	app, ok := m.apps[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.apps, id)
+	delete(m.keys, app.APIKey)
+	return nil
+}
+
+// appsFile is how FileAppStore writes its file, a file holding a plain list of apps is read as well
+type appsFile struct {
+	LastID int          `json:"last_id"`
+	Apps   []models.App `json:"apps"`
+}
+
+// FileAppStore keeps the apps of a JSON file in memory, changes are written to the file before they apply
+type FileAppStore struct {
+	*MemoryAppStore
+	Path string
+
+	// mu serializes changes, so the file is always written with every change before it
+	mu sync.Mutex
+}
+
+func NewFileAppStore(path string) (*FileAppStore, error) {
+
+	var file appsFile
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, errors.Wrap(err, "unable to read apps")
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")):
+		if err := json.Unmarshal(data, &file.Apps); err != nil {
+			return nil, errors.Wrap(err, "invalid apps")
+		}
+	default:
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, errors.Wrap(err, "invalid apps")
+		}
+	}
+
+	memory, err := NewMemoryAppStore(file.Apps)
+	if err != nil {
+		return nil, err
+	}
+	if file.LastID > memory.lastID {
+		memory.lastID = file.LastID
+	}
+	return &FileAppStore{MemoryAppStore: memory, Path: path}, nil
+}
+
+func (f *FileAppStore) Save(app *models.App) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := app.ID
+	if err := f.commit(func(m *MemoryAppStore) error { return m.Save(app) }); err != nil {
+		app.ID = id
+		return err
+	}
+	return nil
+}
+
+func (f *FileAppStore) Delete(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.commit(func(m *MemoryAppStore) error { return m.Delete(id) })
+}
+
+// commit applies the change to a copy of the apps and writes it to the file, then to the apps themselves
+func (f *FileAppStore) commit(change func(m *MemoryAppStore) error) error {
+
+	apps, err := f.MemoryAppStore.List()
+	if err != nil {
+		return err
+	}
+	f.MemoryAppStore.mu.RLock()
+	next := &MemoryAppStore{apps: make(map[int]models.App), keys: make(map[string]int), lastID: f.MemoryAppStore.lastID}
+	f.MemoryAppStore.mu.RUnlock()
+	for _, app := range apps {
+		next.apps[app.ID] = *app
+		next.keys[app.APIKey] = app.ID
+	}
+
+	if err := change(next); err != nil {
+		return err
+	}
+
+	file := appsFile{LastID: next.lastID, Apps: make([]models.App, 0, len(next.apps))}
+	for _, app := range next.apps {
+		file.Apps = append(file.Apps, app)
+	}
+	sort.Slice(file.Apps, func(i, j int) bool { return file.Apps[i].ID < file.Apps[j].ID })
+	if err := writeJSONFile(f.Path, file); err != nil {
+		return errors.Wrap(err, "unable to write apps")
+	}
+
+	f.MemoryAppStore.mu.Lock()
+	f.MemoryAppStore.apps, f.MemoryAppStore.keys, f.MemoryAppStore.lastID = next.apps, next.keys, next.lastID
+	f.MemoryAppStore.mu.Unlock()
+	return nil
+}
+
+// Authenticate resolves the app an API key belongs to, unknown keys get ErrNotFound
+func (s *Service) Authenticate(key string) (*models.App, error) {
+	return s.Apps.GetByKey(key)
+}
+
+// checkProviders fails when the app lists a provider ID that is not the record of a provider in ids
+func checkProviders(app *models.App, ids map[int]string) error {
+	for _, id := range app.Providers {
+		if _, ok := ids[id]; !ok {
+			return invalid("app %s given unknown provider %d", app.Name, id)
+		}
+	}
+	return nil
+}
+
+// checkAppProviders fails when an app lists a provider ID that is not the record of a provider in ids
+func checkAppProviders(apps IAppStore, ids map[int]string) error {
+	listed, err := apps.List()
+	if err != nil {
+		return err
+	}
+	for _, app := range listed {
+		if err := checkProviders(app, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowedProviders narrows the routed providers down to the ones built from the records the app of the mail
+// may send through, keeping their order. Mail without an app, or from an app listing no providers, goes
+// through every provider.
+func (s *Service) allowedProviders(mail *models.Mail, providers []IProvider) ([]IProvider, error) {
+	if mail.AppID == 0 {
+		return providers, nil
+	}
+
+	app, err := s.Apps.Get(mail.AppID)
+	if errors.Is(err, ErrNotFound) {
+		// the app was removed after the mail was accepted, the mail is delivered like it would have been
+		s.Logger.I("mail from an unknown app, providers not restricted", "mailID", mail.ID, "app", mail.App)
+		return providers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(app.Providers) == 0 {
+		return providers, nil
+	}
+
+	allowed := make(map[int]bool)
+	for _, id := range app.Providers {
+		allowed[id] = true
+	}
+
+	var kept []IProvider
+	for _, provider := range providers {
+		if record, ok := provider.(*RecordProvider); ok && allowed[record.RecordID] {
+			kept = append(kept, provider)
+		}
+	}
+	return kept, nil
+}
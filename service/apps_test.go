@@ -0,0 +1,169 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMemoryAppStore(t *testing.T) {
+	tests := []struct {
+		name          string
+		apps          []models.App
+		expectedError string
+	}{
+		{
+			name: "apps with their own keys - should keep them",
+			apps: []models.App{{Name: "billing", APIKey: "billing-key"}, {Name: "marketing", APIKey: "marketing-key"}},
+		},
+		{
+			name:          "app without a key - should fail",
+			apps:          []models.App{{Name: "billing"}},
+			expectedError: "app billing without an api key",
+		},
+		{
+			name:          "same name twice - should fail",
+			apps:          []models.App{{Name: "billing", APIKey: "billing-key"}, {Name: "billing", APIKey: "other-key"}},
+			expectedError: "app billing already exists",
+		},
+		{
+			name:          "shared key - should fail",
+			apps:          []models.App{{Name: "billing", APIKey: "billing-key"}, {Name: "marketing", APIKey: "billing-key"}},
+			expectedError: "app marketing reuses the api key of another app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewMemoryAppStore(tt.apps)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+
+			for _, app := range tt.apps {
+				found, err := store.GetByKey(app.APIKey)
+				assert.NoError(t, err)
+				assert.Equal(t, app.Name, found.Name)
+			}
+			_, err = store.GetByKey("unknown")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			apps, err := store.List()
+			assert.NoError(t, err)
+			assert.Len(t, apps, len(tt.apps))
+		})
+	}
+}
+
+func TestFileAppStore_IDsNotReused(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "apps.json")
+	store, err := NewFileAppStore(path)
+	assert.NoError(t, err)
+
+	billing := &models.App{Name: "billing", APIKey: "billing-key"}
+	assert.NoError(t, store.Save(billing))
+	assert.Equal(t, 1, billing.ID)
+	assert.NoError(t, store.Delete(billing.ID))
+
+	// the id of a deleted app is not given again, not even after a restart
+	store, err = NewFileAppStore(path)
+	assert.NoError(t, err)
+
+	recreated := &models.App{Name: "billing", APIKey: "new-key"}
+	assert.NoError(t, store.Save(recreated))
+	assert.Equal(t, 2, recreated.ID)
+}
+
+func TestService_AppProviders(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	dir := t.TempDir()
+	write := func(name string, v interface{}) string {
+		data, err := json.Marshal(v)
+		assert.NoError(t, err)
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, data, 0o600))
+		return path
+	}
+
+	providersFile := write("providers.json", []models.Provider{
+		// two accounts of the same provider, told apart by their records
+		{ID: 1, Name: "shared", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+		{ID: 2, Name: "dedicated", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+	})
+
+	// apps listing providers that do not exist are refused at startup, whatever the providers are built from
+	orphans := AppsConfig{File: write("orphans.json", []models.App{{Name: "orphan", APIKey: "orphan-key", Providers: []int{3}}})}
+	_, err := NewService(Config{Workers: 1, ProvidersFile: providersFile, Apps: orphans}, nil, logger)
+	assert.EqualError(t, err, "invalid apps: app orphan given unknown provider 3")
+	_, err = NewService(Config{Workers: 1, Apps: orphans}, []IProvider{&MockProvider{}}, logger)
+	assert.EqualError(t, err, "invalid apps: app orphan given unknown provider 3")
+
+	s, err := NewService(Config{
+		Workers:       1,
+		ProvidersFile: providersFile,
+		Retry:         RetryConfig{MaxAttempts: 1},
+		Routing:       RoutingConfig{Rules: RoutingRules{{Name: "shared", Tags: []string{"shared"}, Providers: []string{"shared"}}}},
+		Apps: AppsConfig{File: write("apps.json", []models.App{
+			{Name: "billing", APIKey: "billing-key", Providers: []int{2}},
+			{Name: "marketing", APIKey: "marketing-key"},
+		})},
+	}, nil, logger)
+	assert.NoError(t, err)
+	defer s.Quit()
+
+	// records apps send through cannot be dropped by a reload
+	assert.EqualError(t, s.LoadProviders([]models.Provider{{ID: 1, Name: "shared", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)}}),
+		"app billing given unknown provider 2")
+
+	app, err := s.Authenticate("billing-key")
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", app.Name)
+
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "billing", App: "billing", AppID: 1}))
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "marketing", App: "marketing", AppID: 2}))
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "misrouted", App: "billing", AppID: 1, Tags: []string{"shared"}}))
+	time.Sleep(50 * time.Millisecond)
+
+	tests := []struct {
+		id               string
+		expectedState    models.MailState
+		expectedProvider string
+	}{
+		{id: "billing", expectedState: models.MailSent, expectedProvider: "dedicated"},
+		{id: "marketing", expectedState: models.MailSent, expectedProvider: "shared"},
+		// routed away from the providers of its app, the mail is given up on without bouncing
+		{id: "misrouted", expectedState: models.MailFailed},
+	}
+
+	for _, tt := range tests {
+		status, err := s.Status(tt.id)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expectedState, status.State, "unexpected state for %s", tt.id)
+		assert.Equal(t, tt.expectedProvider, status.Provider, "unexpected provider for %s", tt.id)
+	}
+
+	status, err := s.Status("billing")
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", status.App)
+	assert.Equal(t, 1, status.AppID)
+
+	usage, err := s.Usage(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usage.Daily[0].Failed)
+	assert.Equal(t, 0, usage.Daily[0].Bounced)
+}
@@ -1,9 +1,12 @@
 package service
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+	"github.com/gugabfigueiredo/dream-mail-go/message"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
 	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
 
 	//go get -u github.com/aws/aws-sdk-go
 	"github.com/aws/aws-sdk-go/aws"
@@ -20,17 +23,21 @@ type SESProvider struct {
 	Logger  *log.Logger
 	Client  sesiface.SESAPI
 	Session *session.Session
+	Builder message.Builder
+	Signer  IMessageSigner
 }
 
-func NewSESProvider(cfg SESConfig, logger *log.Logger) *SESProvider {
-	// Create a new session in the us-west-2 region.
-	// Replace us-west-2 with the AWS Region you're using for Amazon SES.
+func NewSESProvider(cfg SESConfig, logger *log.Logger) (*SESProvider, error) {
+
+	if cfg.Region == "" {
+		return nil, errors.New("missing ses region")
+	}
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(cfg.Region)},
 	)
-
 	if err != nil {
-		logger.F("Error creating AWS session: %s", err)
+		return nil, errors.Wrap(err, "unable to create aws session")
 	}
 
 	// Create an SES session.
@@ -40,17 +47,26 @@ func NewSESProvider(cfg SESConfig, logger *log.Logger) *SESProvider {
 		Logger:  logger.C("provider", "ses"),
 		Client:  svc,
 		Session: sess,
-	}
+		Builder: *message.NewBuilder(),
+	}, nil
 }
 
-func (s *SESProvider) SendMail(mail *models.Mail) error {
+func (s *SESProvider) Name() string {
+	return "ses"
+}
+
+func (s *SESProvider) SendMail(ctx context.Context, mail *models.Mail) error {
 
 	logger := s.Logger.C("from", mail.From.Addr, "to", mail.To, "subject", mail.Subject, "id", mail.ID)
 
-	sesInput := s.buildInput(mail)
+	sesInput, err := s.buildInput(mail)
+	if err != nil {
+		logger.E("unable to build message", "err", err)
+		return buildError(s.Name(), err)
+	}
 
 	// Attempt to send the email.
-	result, err := s.Client.SendRawEmail(sesInput)
+	result, err := s.Client.SendRawEmailWithContext(ctx, sesInput)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			logger.E("unable to send email", "err", aerr.Error(), "code", aerr.Code())
@@ -58,7 +74,7 @@ func (s *SESProvider) SendMail(mail *models.Mail) error {
 			logger.E("unknown error", "err", err.Error())
 		}
 
-		return err
+		return s.sendError(err)
 	}
 
 	logger.I("SES SendRawEmail successful", "result", result)
@@ -66,20 +82,49 @@ func (s *SESProvider) SendMail(mail *models.Mail) error {
 	return nil
 }
 
-func (s *SESProvider) buildInput(mail *models.Mail) *ses.SendRawEmailInput {
+func (s *SESProvider) buildInput(mail *models.Mail) (*ses.SendRawEmailInput, error) {
 
-	var tos []string
-	for _, to := range mail.To {
-		tos = append(tos, to.Addr)
+	msg, err := buildRawMessage(&s.Builder, s.Signer, mail)
+	if err != nil {
+		return nil, err
 	}
 
-	msg := buildSMTPMessage(mail, tos)
-
+	// destinations are set explicitly, otherwise SES only delivers to the recipients found in the headers
 	input := &ses.SendRawEmailInput{
+		Destinations: aws.StringSlice(mail.Recipients()),
 		RawMessage: &ses.RawMessage{
 			Data: msg,
 		},
 	}
 
-	return input
+	return input, nil
+}
+
+// sendError classifies an SES failure by its AWS error code, falling back to its HTTP status
+func (s *SESProvider) sendError(err error) *SendError {
+
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return NewSendError(ErrorTransient, s.Name(), "", err)
+	}
+
+	switch aerr.Code() {
+	case ses.ErrCodeMessageRejected:
+		return NewSendError(ErrorPermanent, s.Name(), aerr.Code(), err)
+	case "Throttling", "ThrottlingException":
+		return NewSendError(ErrorRateLimited, s.Name(), aerr.Code(), err)
+	case ses.ErrCodeMailFromDomainNotVerifiedException,
+		ses.ErrCodeAccountSendingPausedException,
+		ses.ErrCodeConfigurationSetSendingPausedException,
+		ses.ErrCodeConfigurationSetDoesNotExistException,
+		"InvalidClientTokenId", "SignatureDoesNotMatch", "UnrecognizedClientException",
+		"AccessDenied", "AccessDeniedException", "ExpiredToken":
+		return NewSendError(ErrorAuthFailed, s.Name(), aerr.Code(), err)
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() != 0 {
+		return NewSendError(httpErrorKind(reqErr.StatusCode()), s.Name(), aerr.Code(), err)
+	}
+
+	return NewSendError(ErrorTransient, s.Name(), aerr.Code(), err)
 }
@@ -1,11 +1,16 @@
 package service
 
 import (
+	"context"
 	log "github.com/gugabfigueiredo/tiny-go-log"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+	"github.com/gugabfigueiredo/dream-mail-go/message"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
 	"github.com/stretchr/testify/assert"
 )
@@ -18,7 +23,7 @@ type MockSESClient struct {
 	CalledWith *ses.SendRawEmailInput
 }
 
-func (m *MockSESClient) SendRawEmail(input *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+func (m *MockSESClient) SendRawEmailWithContext(_ aws.Context, input *ses.SendRawEmailInput, _ ...request.Option) (*ses.SendRawEmailOutput, error) {
 	m.CalledWith = input
 	return m.Output, m.Error
 }
@@ -31,6 +36,7 @@ func TestSESProvider_SendMail(t *testing.T) {
 		mockOutput           *ses.SendRawEmailOutput
 		mockError            error
 		expectedSESInputData string
+		expectedDestinations []string
 		expectedError        error
 	}{
 		{
@@ -52,7 +58,8 @@ func TestSESProvider_SendMail(t *testing.T) {
 			},
 			mockOutput:           &ses.SendRawEmailOutput{},
 			mockError:            nil,
-			expectedSESInputData: "From: sender@domain.com\r\nTo: recipient@domain.com\r\nSubject: Test Subject\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"dmailboundary\"\r\n\r\n--dmailboundary\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\nTest Text\r\n\r\n--dmailboundary\r\n",
+			expectedSESInputData: "From: \"Sender\" <sender@domain.com>\r\nTo: \"Recipient\" <recipient@domain.com>\r\nSubject: Test Subject\r\nDate: Mon, 24 Jul 2023 20:10:21 +0000\r\nMessage-ID: <1234@domain.com>\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nTest Text\r\n",
+			expectedDestinations: []string{"recipient@domain.com"},
 			expectedError:        nil,
 		},
 		{
@@ -74,7 +81,8 @@ func TestSESProvider_SendMail(t *testing.T) {
 			},
 			mockOutput:           &ses.SendRawEmailOutput{},
 			mockError:            nil,
-			expectedSESInputData: "From: sender@domain.com\r\nTo: recipient@domain.com\r\nSubject: Test Subject\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"dmailboundary\"\r\n\r\n--dmailboundary\r\nContent-Type: text/html; charset=\"utf-8\"\r\n\r\n<h1>Hello World!</h1>\r\n\r\n--dmailboundary\r\n",
+			expectedSESInputData: "From: \"Sender\" <sender@domain.com>\r\nTo: \"Recipient\" <recipient@domain.com>\r\nSubject: Test Subject\r\nDate: Mon, 24 Jul 2023 20:10:21 +0000\r\nMessage-ID: <1234@domain.com>\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n<h1>Hello World!</h1>\r\n",
+			expectedDestinations: []string{"recipient@domain.com"},
 			expectedError:        nil,
 		},
 		{
@@ -103,7 +111,8 @@ func TestSESProvider_SendMail(t *testing.T) {
 			},
 			mockOutput:           &ses.SendRawEmailOutput{},
 			mockError:            nil,
-			expectedSESInputData: "From: sender@domain.com\r\nTo: recipient@domain.com\r\nSubject: Test Subject\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"dmailboundary\"\r\n\r\n--dmailboundary\r\nContent-Type: text/html; charset=\"utf-8\"\r\n\r\n<h1>Hello World!</h1>\r\n\r\n--dmailboundary\r\nContent-Type: text/plain; charset=\"utf-8\"\r\nContent-Disposition: attachment;filename=\"test.txt\"\r\n\r\ntest\r\n\r\n--dmailboundary\r\n",
+			expectedSESInputData: "From: \"Sender\" <sender@domain.com>\r\nTo: \"Recipient\" <recipient@domain.com>\r\nSubject: Test Subject\r\nDate: Mon, 24 Jul 2023 20:10:21 +0000\r\nMessage-ID: <1234@domain.com>\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=dmailboundary\r\n\r\n--dmailboundary\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<h1>Hello World!</h1>\r\n--dmailboundary\r\nContent-Disposition: attachment; filename=test.txt\r\nContent-Transfer-Encoding: base64\r\nContent-Type: text/plain\r\n\r\ntest\r\n--dmailboundary--\r\n",
+			expectedDestinations: []string{"recipient@domain.com"},
 			expectedError:        nil,
 		},
 		{
@@ -132,7 +141,44 @@ func TestSESProvider_SendMail(t *testing.T) {
 			},
 			mockOutput:           &ses.SendRawEmailOutput{},
 			mockError:            nil,
-			expectedSESInputData: "From: sender@domain.com\r\nTo: recipient@domain.com\r\nSubject: Test Subject\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"dmailboundary\"\r\n\r\n--dmailboundary\r\nContent-Type: text/html; charset=\"utf-8\"\r\n\r\n<h1>Hello World!</h1>\r\n\r\n--dmailboundary\r\nContent-Type: text/plain; charset=\"utf-8\"\r\nContent-Disposition: attachment;filename=\"test.txt\"\r\n\r\ntest\r\n\r\n--dmailboundary\r\n",
+			expectedSESInputData: "From: \"Sender\" <sender@domain.com>\r\nTo: \"Recipient\" <recipient@domain.com>\r\nSubject: Test Subject\r\nDate: Mon, 24 Jul 2023 20:10:21 +0000\r\nMessage-ID: <1234@domain.com>\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=dmailboundary\r\n\r\n--dmailboundary\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<h1>Hello World!</h1>\r\n--dmailboundary\r\nContent-Disposition: attachment; filename=test.txt\r\nContent-Transfer-Encoding: base64\r\nContent-Type: text/plain\r\n\r\ntest\r\n--dmailboundary--\r\n",
+			expectedDestinations: []string{"recipient@domain.com"},
+			expectedError:        nil,
+		},
+		{
+			name: "send email with cc, bcc and reply-to",
+			mail: &models.Mail{
+				ID: "1234",
+				From: models.Email{
+					Addr: "sender@domain.com",
+					Name: "Sender",
+				},
+				To: []models.Email{
+					{
+						Addr: "recipient@domain.com",
+						Name: "Recipient",
+					},
+				},
+				CC: []models.Email{
+					{
+						Addr: "cc@domain.com",
+					},
+				},
+				BCC: []models.Email{
+					{
+						Addr: "bcc@domain.com",
+					},
+				},
+				ReplyTo: models.Email{
+					Addr: "reply@domain.com",
+				},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			mockOutput:           &ses.SendRawEmailOutput{},
+			mockError:            nil,
+			expectedSESInputData: "From: \"Sender\" <sender@domain.com>\r\nTo: \"Recipient\" <recipient@domain.com>\r\nCc: <cc@domain.com>\r\nReply-To: <reply@domain.com>\r\nSubject: Test Subject\r\nDate: Mon, 24 Jul 2023 20:10:21 +0000\r\nMessage-ID: <1234@domain.com>\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nTest Text\r\n",
+			expectedDestinations: []string{"recipient@domain.com", "cc@domain.com", "bcc@domain.com"},
 			expectedError:        nil,
 		},
 	}
@@ -155,12 +201,17 @@ func TestSESProvider_SendMail(t *testing.T) {
 			provider := &SESProvider{
 				Logger: logger,
 				Client: mockSvc,
+				Builder: message.Builder{
+					Boundary: func() string { return "dmailboundary" },
+					Now:      func() time.Time { return time.Date(2023, 7, 24, 20, 10, 21, 0, time.UTC) },
+				},
 			}
 
-			err := provider.SendMail(tt.mail)
+			err := provider.SendMail(context.Background(), tt.mail)
 
 			// Assertions
 			assert.Equal(t, tt.expectedSESInputData, string(mockSvc.CalledWith.RawMessage.Data), "Unexpected SES input")
+			assert.Equal(t, tt.expectedDestinations, aws.StringValueSlice(mockSvc.CalledWith.Destinations), "Unexpected SES destinations")
 			assert.Equal(t, tt.expectedError, err, "Unexpected error")
 		})
 	}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"sync"
+	"time"
+)
+
+type BreakerConfig struct {
+	// Threshold is the number of consecutive failures that opens the circuit of a provider
+	Threshold int `json:"threshold" default:"5"`
+	// Cooldown is how long an open provider is skipped before a probe mail is sent through it
+	Cooldown time.Duration `json:"cooldown" default:"30s"`
+}
+
+// withDefaults fills the gaps left by configs that did not go through envconfig
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.Threshold <= 0 {
+		c.Threshold = 5
+	}
+	if c.Cooldown <= 0 {
+		c.Cooldown = 30 * time.Second
+	}
+	return c
+}
+
+// breaker tracks the health of a provider. Failures the provider is not to blame for, such as a mail refused
+// for good, prove it is up and reset the count like a delivery does.
+type breaker struct {
+	cfg BreakerConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	state     models.CircuitState
+	failures  int
+	lastError string
+	openedAt  time.Time
+	probing   bool
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	return &breaker{cfg: cfg, now: time.Now, state: models.CircuitClosed}
+}
+
+// allow tells whether a mail may be sent through the provider. Once the cooldown is over a single mail is let
+// through as a probe, the others keep skipping the provider until the probe is done.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case models.CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.Cooldown {
+			return false
+		}
+		b.state = models.CircuitHalfOpen
+		b.probing = true
+		return true
+	case models.CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record closes or opens the circuit with the outcome of a send, it tells whether the send opened the circuit
+func (b *breaker) record(err error) (opened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if err == nil || ErrorKindOf(err) == ErrorPermanent {
+		b.state = models.CircuitClosed
+		b.failures = 0
+		return false
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	if b.state != models.CircuitOpen && (b.state == models.CircuitHalfOpen || b.failures >= b.cfg.Threshold) {
+		b.state = models.CircuitOpen
+		b.openedAt = b.now()
+		return true
+	}
+	return false
+}
+
+// release gives up a probe that was interrupted before it had an outcome
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) health(provider string) models.ProviderHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := models.ProviderHealth{
+		Provider:            provider,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		LastError:           b.lastError,
+	}
+	if b.state != models.CircuitClosed {
+		openedAt := b.openedAt
+		health.OpenedAt = &openedAt
+	}
+	return health
+}
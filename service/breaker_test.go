@@ -0,0 +1,159 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+
+	transient := errors.New("connection refused")
+	permanent := NewSendError(ErrorPermanent, "mock", "550", errors.New("no such user"))
+
+	// each step moves the clock, sends if the breaker allows it and records the outcome
+	type step struct {
+		after         time.Duration
+		err           error
+		expectedAllow bool
+		expectedState models.CircuitState
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "failures below the threshold - should stay closed",
+			steps: []step{
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: nil, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+			},
+		},
+		{
+			name: "consecutive failures - should open and skip the provider",
+			steps: []step{
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitOpen},
+				{after: time.Second, expectedAllow: false, expectedState: models.CircuitOpen},
+			},
+		},
+		{
+			name: "permanent failures - should not open",
+			steps: []step{
+				{err: permanent, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: permanent, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: permanent, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: permanent, expectedAllow: true, expectedState: models.CircuitClosed},
+			},
+		},
+		{
+			name: "probe delivered after the cooldown - should close",
+			steps: []step{
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitOpen},
+				{after: time.Minute, err: nil, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+			},
+		},
+		{
+			name: "probe failed after the cooldown - should open again",
+			steps: []step{
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitClosed},
+				{err: transient, expectedAllow: true, expectedState: models.CircuitOpen},
+				{after: time.Minute, err: transient, expectedAllow: true, expectedState: models.CircuitOpen},
+				{after: time.Second, expectedAllow: false, expectedState: models.CircuitOpen},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			b := newBreaker(BreakerConfig{Threshold: 3, Cooldown: 30 * time.Second})
+			b.now = func() time.Time { return now }
+
+			for i, step := range tt.steps {
+				now = now.Add(step.after)
+
+				allowed := b.allow()
+				assert.Equal(t, step.expectedAllow, allowed, "unexpected allow at step %d", i)
+				if allowed {
+					b.record(step.err)
+				}
+
+				assert.Equal(t, step.expectedState, b.health("mock").State, "unexpected state at step %d", i)
+			}
+		})
+	}
+}
+
+func TestBreaker_SingleProbe(t *testing.T) {
+
+	now := time.Now()
+	b := newBreaker(BreakerConfig{Threshold: 1, Cooldown: 30 * time.Second})
+	b.now = func() time.Time { return now }
+
+	assert.True(t, b.allow())
+	assert.True(t, b.record(errors.New("connection refused")), "circuit not opened")
+
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(), "probe not allowed after the cooldown")
+	assert.False(t, b.allow(), "second probe allowed while the first is in flight")
+
+	b.release()
+	assert.True(t, b.allow(), "probe not allowed after the interrupted one")
+	assert.Equal(t, models.CircuitHalfOpen, b.health("mock").State)
+}
+
+func TestService_SkipsOpenProviders(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	down := &MockNamedProvider{name: "down", MockProvider: MockProvider{CallsBeforeError: -1, Error: errors.New("connection refused")}}
+	up := &MockNamedProvider{name: "up"}
+
+	s, err := NewService(Config{
+		Workers: 1,
+		Breaker: BreakerConfig{Threshold: 2, Cooldown: time.Hour},
+	}, []IProvider{down, up}, logger)
+	assert.NoError(t, err)
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		assert.NoError(t, s.QueueMail(&models.Mail{ID: id}))
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.Quit()
+
+	down.mu.Lock()
+	assert.Equal(t, 2, down.CallCount, "open provider still called")
+	down.mu.Unlock()
+
+	up.mu.Lock()
+	assert.Equal(t, 4, up.CallCount, "mail not failed over")
+	up.mu.Unlock()
+
+	health := s.Health()
+	if assert.Len(t, health, 2) {
+		assert.Equal(t, "down", health[0].Provider)
+		assert.Equal(t, models.CircuitOpen, health[0].State)
+		assert.Equal(t, 2, health[0].ConsecutiveFailures)
+		assert.Equal(t, "connection refused", health[0].LastError)
+		assert.NotNil(t, health[0].OpenedAt)
+		assert.Equal(t, models.CircuitClosed, health[1].State)
+	}
+}
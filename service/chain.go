@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+)
+
+// chain holds the providers mail is sent through along with everything resolved against their names. It is
+// replaced as a whole when the providers change, sends in progress finish with the chain they started with.
+type chain struct {
+	providers []IProvider
+	router    *Router
+	// balancer reorders the providers of every mail with the weighted strategy, it is nil with failover
+	balancer *balancer
+	// limiters hold providers to their rates and quotas, by provider name
+	limiters map[string]*limiter
+	// ids maps the IDs of the records providers were built from to provider names, apps list providers by ID
+	ids map[int]string
+}
+
+// recordIDs maps the record IDs of the providers built from records to their names
+func recordIDs(providers []IProvider) map[int]string {
+	ids := make(map[int]string)
+	for _, provider := range providers {
+		if record, ok := provider.(*RecordProvider); ok && record.RecordID != 0 {
+			ids[record.RecordID] = record.Record
+		}
+	}
+	return ids
+}
+
+// newChain resolves the routing, weights and limits of cfg against the providers. Limiters of the previous
+// chain are kept for the providers still in it, so replacing the chain does not reset their quotas.
+func newChain(cfg Config, providers []IProvider, previous *chain) (*chain, error) {
+
+	router, err := NewRouter(cfg.Routing, providers)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid routing")
+	}
+
+	var balancer *balancer
+	switch cfg.Strategy {
+	case "", StrategyFailover:
+	case StrategyWeighted:
+		if balancer, err = newBalancer(cfg.Weights, providers); err != nil {
+			return nil, errors.Wrap(err, "invalid provider weights")
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown provider strategy %s", cfg.Strategy))
+	}
+
+	limiters, err := newLimiters(cfg.Limits, providers)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid provider limits")
+	}
+	if previous != nil {
+		for name := range limiters {
+			if kept, ok := previous.limiters[name]; ok {
+				limiters[name] = kept
+			}
+		}
+	}
+
+	return &chain{providers: providers, router: router, balancer: balancer, limiters: limiters, ids: recordIDs(providers)}, nil
+}
+
+func (s *Service) currentChain() *chain {
+	s.chainMu.RLock()
+	defer s.chainMu.RUnlock()
+	return s.chain
+}
+
+// Providers lists the providers mail is sent through, in failover order
+func (s *Service) Providers() []IProvider {
+	return s.currentChain().providers
+}
+
+// LoadProviders replaces the providers mail is sent through with the ones built from the records, in order.
+// Records apps send through cannot be left out.
+func (s *Service) LoadProviders(records []models.Provider) error {
+	providers, err := BuildProviders(records, ProviderDeps{Logger: s.Logger, Signer: s.signer})
+	if err != nil {
+		return err
+	}
+	if err := checkAppProviders(s.Apps, recordIDs(providers)); err != nil {
+		return err
+	}
+
+	s.chainMu.Lock()
+	defer s.chainMu.Unlock()
+
+	chain, err := newChain(s.cfg, providers, s.chain)
+	if err != nil {
+		return err
+	}
+	s.chain = chain
+
+	s.Logger.I("providers loaded", "providers", providerNames(providers))
+	return nil
+}
+
+// ReloadProviders rebuilds the providers from their records, keeping the current ones when they do not build
+func (s *Service) ReloadProviders() error {
+	if s.Records == nil {
+		return ErrNotManaged
+	}
+
+	s.recordsMu.Lock()
+	defer s.recordsMu.Unlock()
+	return s.loadRecords()
+}
+
+func providerNames(providers []IProvider) []string {
+	names := make([]string, 0, len(providers))
+	for _, provider := range providers {
+		names = append(names, providerName(provider))
+	}
+	return names
+}
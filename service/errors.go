@@ -0,0 +1,85 @@
+package service
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+)
+
+// ErrorKind tells what a failed send says about the mail and the provider
+type ErrorKind string
+
+const (
+	// ErrorTransient failures may go away on their own, the mail is retried
+	ErrorTransient ErrorKind = "transient"
+	// ErrorPermanent failures come from the mail itself, such as an invalid recipient, retrying is pointless
+	ErrorPermanent ErrorKind = "permanent"
+	// ErrorRateLimited means the provider asked to slow down, the mail is retried
+	ErrorRateLimited ErrorKind = "rate_limited"
+	// ErrorAuthFailed means the provider refused the credentials or the account, other providers may still work
+	ErrorAuthFailed ErrorKind = "auth_failed"
+)
+
+// SendError is a provider failure classified by kind, along with the upstream code it was classified by
+type SendError struct {
+	Kind     ErrorKind
+	Provider string
+	// Code is the upstream error code, such as an HTTP status, an SMTP reply code or an AWS error code
+	Code string
+	Err  error
+}
+
+func NewSendError(kind ErrorKind, provider, code string, err error) *SendError {
+	return &SendError{Kind: kind, Provider: provider, Code: code, Err: err}
+}
+
+func (e *SendError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s %s error: %s", e.Provider, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s %s error %s: %s", e.Provider, e.Kind, e.Code, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKindOf classifies any error returned by a provider, errors that are not a SendError are transient
+func ErrorKindOf(err error) ErrorKind {
+	var sendErr *SendError
+	if errors.As(err, &sendErr) {
+		return sendErr.Kind
+	}
+	return ErrorTransient
+}
+
+// httpErrorKind classifies the HTTP status of a failed API request
+func httpErrorKind(status int) ErrorKind {
+	switch {
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return ErrorAuthFailed
+	case status == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case status == http.StatusRequestTimeout:
+		return ErrorTransient
+	case status >= 400 && status < 500:
+		return ErrorPermanent
+	default:
+		return ErrorTransient
+	}
+}
+
+// buildError marks a mail the message could not be built from as permanent, it would be built the same way on
+// every attempt
+func buildError(provider string, err error) *SendError {
+	return NewSendError(ErrorPermanent, provider, "", errors.Wrap(err, "unable to build message"))
+}
+
+// httpSendError classifies a failed API request by its status, requests that got no answer are transient
+func httpSendError(provider string, status int, err error) *SendError {
+	if status == 0 {
+		return NewSendError(ErrorTransient, provider, "", err)
+	}
+	return NewSendError(httpErrorKind(status), provider, strconv.Itoa(status), err)
+}
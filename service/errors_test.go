@@ -0,0 +1,324 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/textproto"
+	"testing"
+	"time"
+
+	sparkpost "github.com/SparkPost/gosparkpost"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/sendgrid/rest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKindOf(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedKind ErrorKind
+	}{
+		{
+			name:         "send error - should report its kind",
+			err:          NewSendError(ErrorPermanent, "ses", "MessageRejected", errors.New("rejected")),
+			expectedKind: ErrorPermanent,
+		},
+		{
+			name:         "wrapped send error - should report its kind",
+			err:          errors.Wrap(NewSendError(ErrorRateLimited, "sendgrid", "429", errors.New("slow down")), "attempt failed"),
+			expectedKind: ErrorRateLimited,
+		},
+		{
+			name:         "plain error - should be transient",
+			err:          errors.New("error sending email"),
+			expectedKind: ErrorTransient,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedKind, ErrorKindOf(tt.err))
+		})
+	}
+}
+
+func TestSMTPProvider_SendError(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedKind ErrorKind
+		expectedCode string
+	}{
+		{
+			name:         "service not available - should be transient",
+			err:          &textproto.Error{Code: 421, Msg: "service not available"},
+			expectedKind: ErrorTransient,
+			expectedCode: "421",
+		},
+		{
+			name:         "mailbox busy - should be transient",
+			err:          &textproto.Error{Code: 450, Msg: "mailbox unavailable"},
+			expectedKind: ErrorTransient,
+			expectedCode: "450",
+		},
+		{
+			name:         "bad credentials - should be an auth failure",
+			err:          &textproto.Error{Code: 535, Msg: "authentication failed"},
+			expectedKind: ErrorAuthFailed,
+			expectedCode: "535",
+		},
+		{
+			name:         "unknown mailbox - should be permanent",
+			err:          &textproto.Error{Code: 550, Msg: "no such user"},
+			expectedKind: ErrorPermanent,
+			expectedCode: "550",
+		},
+		{
+			name:         "connection refused - should be transient",
+			err:          &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			expectedKind: ErrorTransient,
+		},
+	}
+
+	provider := &SMTPProvider{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provider.sendError(tt.err)
+			assert.Equal(t, tt.expectedKind, err.Kind)
+			assert.Equal(t, tt.expectedCode, err.Code)
+			assert.Equal(t, "smtp", err.Provider)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestSESProvider_SendError(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedKind ErrorKind
+	}{
+		{
+			name:         "message rejected - should be permanent",
+			err:          awserr.NewRequestFailure(awserr.New("MessageRejected", "Email address is not verified.", nil), 400, "1"),
+			expectedKind: ErrorPermanent,
+		},
+		{
+			name:         "throttled - should be rate limited",
+			err:          awserr.NewRequestFailure(awserr.New("Throttling", "Maximum sending rate exceeded.", nil), 400, "1"),
+			expectedKind: ErrorRateLimited,
+		},
+		{
+			name:         "invalid credentials - should be an auth failure",
+			err:          awserr.NewRequestFailure(awserr.New("InvalidClientTokenId", "The security token included in the request is invalid.", nil), 403, "1"),
+			expectedKind: ErrorAuthFailed,
+		},
+		{
+			name:         "service error - should be transient",
+			err:          awserr.NewRequestFailure(awserr.New("InternalFailure", "internal failure", nil), 500, "1"),
+			expectedKind: ErrorTransient,
+		},
+		{
+			name:         "unknown error - should be transient",
+			err:          errors.New("connection reset"),
+			expectedKind: ErrorTransient,
+		},
+	}
+
+	provider := &SESProvider{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedKind, provider.sendError(tt.err).Kind)
+		})
+	}
+}
+
+func TestHTTPProviders_SendError(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	mail := &models.Mail{
+		ID:      "1234",
+		From:    models.Email{Addr: "sender@domain.com"},
+		To:      []models.Email{{Addr: "recipient@domain.com"}},
+		Subject: "Test Subject",
+		Text:    "Test Text",
+	}
+
+	tests := []struct {
+		name         string
+		provider     IProvider
+		expectedKind ErrorKind
+		expectedCode string
+	}{
+		{
+			name: "sendgrid rate limit - should be rate limited",
+			provider: &SendgridProvider{Logger: logger, Client: &MockSendGridClient{
+				Response: &rest.Response{StatusCode: 429, Body: `{"errors":[{"message":"too many requests"}]}`},
+			}},
+			expectedKind: ErrorRateLimited,
+			expectedCode: "429",
+		},
+		{
+			name: "sendgrid bad request - should be permanent",
+			provider: &SendgridProvider{Logger: logger, Client: &MockSendGridClient{
+				Response: &rest.Response{StatusCode: 400, Body: `{"errors":[{"message":"invalid email"}]}`},
+			}},
+			expectedKind: ErrorPermanent,
+			expectedCode: "400",
+		},
+		{
+			name: "sendgrid unreachable - should be transient",
+			provider: &SendgridProvider{Logger: logger, Client: &MockSendGridClient{
+				Error: errors.New("connection refused"),
+			}},
+			expectedKind: ErrorTransient,
+		},
+		{
+			name: "sparkpost unauthorized - should be an auth failure",
+			provider: &SparkpostProvider{Logger: logger, Client: &MockSparkPostClient{
+				Response: &sparkpost.Response{HTTP: &http.Response{StatusCode: 401}},
+				Error:    errors.New("Unauthorized."),
+			}},
+			expectedKind: ErrorAuthFailed,
+			expectedCode: "401",
+		},
+		{
+			name: "sparkpost unreachable - should be transient",
+			provider: &SparkpostProvider{Logger: logger, Client: &MockSparkPostClient{
+				Error: errors.New("connection refused"),
+			}},
+			expectedKind: ErrorTransient,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.provider.SendMail(context.Background(), mail)
+
+			var sendErr *SendError
+			if assert.ErrorAs(t, err, &sendErr) {
+				assert.Equal(t, tt.expectedKind, sendErr.Kind)
+				assert.Equal(t, tt.expectedCode, sendErr.Code)
+				assert.Equal(t, providerName(tt.provider), sendErr.Provider)
+			}
+		})
+	}
+}
+
+func TestProviders_BuildError(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	mail := &models.Mail{
+		ID:          "1234",
+		From:        models.Email{Addr: "sender@domain.com"},
+		To:          []models.Email{{Addr: "recipient@domain.com"}},
+		Subject:     "Test Subject",
+		Text:        "Test Text",
+		Attachments: []models.Attachment{{Name: "test.txt", Type: "text/plain", Data: "not base64!"}},
+	}
+
+	tests := []struct {
+		name     string
+		provider IProvider
+	}{
+		{
+			name:     "smtp invalid attachment - should be permanent",
+			provider: &SMTPProvider{Addr: "127.0.0.1:0", Logger: logger},
+		},
+		{
+			name:     "ses invalid attachment - should be permanent",
+			provider: &SESProvider{Logger: logger, Client: &MockSESClient{}},
+		},
+		{
+			name:     "mailgun invalid attachment - should be permanent",
+			provider: NewMailgunProvider(MailgunConfig{Domain: "mg.domain.com", ApiKey: "key-1234", BaseURL: "http://127.0.0.1:0/v3"}, logger),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.provider.SendMail(context.Background(), mail)
+
+			var sendErr *SendError
+			if assert.ErrorAs(t, err, &sendErr) {
+				assert.Equal(t, ErrorPermanent, sendErr.Kind)
+				assert.Equal(t, providerName(tt.provider), sendErr.Provider)
+				assert.Contains(t, sendErr.Error(), "attachment test.txt is not valid base64")
+			}
+		})
+	}
+}
+
+func TestService_PermanentFailureSkipsRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		errors           []error
+		expectedAttempts int
+		expectedState    models.MailState
+	}{
+		{
+			name:             "every provider refused for good - should dead letter at once as bounced",
+			errors:           []error{NewSendError(ErrorPermanent, "first", "550", errors.New("no such user")), NewSendError(ErrorPermanent, "second", "400", errors.New("invalid email"))},
+			expectedAttempts: 1,
+			expectedState:    models.MailBounced,
+		},
+		{
+			name:             "one provider failed temporarily - should retry",
+			errors:           []error{NewSendError(ErrorPermanent, "first", "550", errors.New("no such user")), NewSendError(ErrorTransient, "second", "503", errors.New("unavailable"))},
+			expectedAttempts: 3,
+			expectedState:    models.MailFailed,
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []IProvider
+			for _, err := range tt.errors {
+				providers = append(providers, &MockProvider{CallsBeforeError: -1, Error: err})
+			}
+
+			s, err := NewService(Config{
+				Retry: RetryConfig{MaxAttempts: 3, Backoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+			}, providers, logger)
+			assert.NoError(t, err)
+
+			assert.NoError(t, s.QueueMail(&models.Mail{ID: "1234"}))
+			time.Sleep(300 * time.Millisecond)
+			s.Quit()
+
+			deadLetter, err := s.DeadLetter("1234")
+			assert.NoError(t, err, "mail was not dead lettered")
+			if err == nil {
+				assert.Equal(t, tt.expectedAttempts, deadLetter.Attempts, "unexpected number of attempts")
+			}
+
+			status, err := s.Status("1234")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedState, status.State)
+			assert.Equal(t, string(ErrorKindOf(tt.errors[0])), status.Attempts[0].Kind)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// jsonDir stores one JSON document per key in a directory. Files are written to a temporary name,
+// synced and renamed into place, so a crash never leaves a half written document behind.
+type jsonDir struct {
+	Dir string
+	Ext string
+}
+
+func (d jsonDir) write(key string, v interface{}) error {
+	return writeJSONFile(d.path(key), v)
+}
+
+func (d jsonDir) read(key string, v interface{}) error {
+
+	data, err := os.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read file")
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.Wrapf(err, "corrupted file for %s", key)
+	}
+	return nil
+}
+
+func (d jsonDir) remove(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to remove file")
+	}
+	return d.sync()
+}
+
+// readAll returns the content of every document, oldest first
+func (d jsonDir) readAll() ([][]byte, error) {
+
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read directory")
+	}
+
+	type file struct {
+		data  []byte
+		mtime int64
+	}
+
+	var files []file
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), d.Ext) {
+			continue
+		}
+
+		// a document deleted since the directory was read is no longer part of the listing
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to stat file")
+		}
+
+		data, err := os.ReadFile(filepath.Join(d.Dir, entry.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read file")
+		}
+
+		files = append(files, file{data: data, mtime: info.ModTime().UnixNano()})
+	}
+
+	sort.SliceStable(files, func(i, j int) bool { return files[i].mtime < files[j].mtime })
+
+	documents := make([][]byte, 0, len(files))
+	for _, f := range files {
+		documents = append(documents, f.data)
+	}
+	return documents, nil
+}
+
+// modifiedBefore lists the keys of the documents last written before t
+func (d jsonDir) modifiedBefore(t time.Time) ([]string, error) {
+
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read directory")
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, d.Ext) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to stat file")
+		}
+		if !info.ModTime().Before(t) {
+			continue
+		}
+
+		key, err := hex.DecodeString(strings.TrimSuffix(name, d.Ext))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+// path hex encodes the key so client supplied IDs can never escape the directory
+func (d jsonDir) path(key string) string {
+	return filepath.Join(d.Dir, hex.EncodeToString([]byte(key))+d.Ext)
+}
+
+func (d jsonDir) sync() error {
+	return syncDir(d.Dir)
+}
+
+// writeJSONFile writes v to a temporary file next to path, syncs it and renames it into place
+func writeJSONFile(path string, v interface{}) error {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode document")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "unable to create file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to write file")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to sync file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "unable to close file")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "unable to commit file")
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to open directory")
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync directory")
+	}
+	return nil
+}
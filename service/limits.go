@@ -0,0 +1,229 @@
+package service
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+type LimitsConfig struct {
+	// Rates caps the mail sent per second by provider name, bursts go up to a second worth of mail
+	Rates map[string]float64 `json:"rates"`
+	// Daily and Monthly cap the mail sent by provider name over UTC calendar days and months
+	Daily   map[string]int `json:"daily"`
+	Monthly map[string]int `json:"monthly"`
+	// Dir keeps the quota counters of every provider across restarts, without it quotas start over from zero
+	// on every start
+	Dir string `json:"dir"`
+	// Spillover sends mail through the next provider of the chain while a provider is throttled, otherwise
+	// the mail waits in the queue for the provider
+	Spillover bool `json:"spillover" default:"false"`
+}
+
+// quota counts the mail sent over a calendar window, reset when the next window starts
+type quota struct {
+	window string
+	limit  int
+	used   int
+	start  func(t time.Time) time.Time
+	next   func(t time.Time) time.Time
+	since  time.Time
+}
+
+// quotaCount is what is kept of a quota across restarts
+type quotaCount struct {
+	Since time.Time `json:"since"`
+	Used  int       `json:"used"`
+}
+
+func (q *quota) reset(now time.Time) {
+	if start := q.start(now); start.After(q.since) {
+		q.since = start
+		q.used = 0
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// limiter holds a provider to its send rate, a token bucket, and to its quotas
+type limiter struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	quotas []*quota
+
+	// files keeps the quota counters under the provider name, nil keeps them in memory only
+	files *jsonDir
+	name  string
+}
+
+func newLimiter(rate float64, daily, monthly int) *limiter {
+	l := &limiter{now: time.Now, rate: rate}
+
+	if rate > 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+		l.tokens = l.burst
+	}
+	if daily > 0 {
+		l.quotas = append(l.quotas, &quota{window: "daily", limit: daily, start: startOfDay, next: func(t time.Time) time.Time {
+			return startOfDay(t).AddDate(0, 0, 1)
+		}})
+	}
+	if monthly > 0 {
+		l.quotas = append(l.quotas, &quota{window: "monthly", limit: monthly, start: startOfMonth, next: func(t time.Time) time.Time {
+			return startOfMonth(t).AddDate(0, 1, 0)
+		}})
+	}
+
+	return l
+}
+
+// take reserves a send, when the provider is throttled it returns false along with when to try again
+func (l *limiter) take() (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	var until time.Time
+	for _, q := range l.quotas {
+		q.reset(now)
+		if q.used >= q.limit {
+			if next := q.next(now); next.After(until) {
+				until = next
+			}
+		}
+	}
+	if !until.IsZero() {
+		return until, false
+	}
+
+	if l.rate > 0 {
+		if !l.last.IsZero() {
+			l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return now.Add(time.Duration((1 - l.tokens) / l.rate * float64(time.Second))), false
+		}
+		l.tokens--
+	}
+
+	for _, q := range l.quotas {
+		q.used++
+	}
+	return time.Time{}, true
+}
+
+// release gives back the quota reserved for a send the provider did not accept, the rate is not given back
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, q := range l.quotas {
+		if q.used > 0 {
+			q.used--
+		}
+	}
+}
+
+// save writes the quota counters of the provider to its file, it does nothing when they are kept in memory
+func (l *limiter) save() error {
+	if l.files == nil || len(l.quotas) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counts := make(map[string]quotaCount)
+	for _, q := range l.quotas {
+		counts[q.window] = quotaCount{Since: q.since, Used: q.used}
+	}
+	return l.files.write(l.name, counts)
+}
+
+// load restores the quota counters saved by a previous run, counters of a window over are reset on the next take
+func (l *limiter) load() error {
+	if l.files == nil || len(l.quotas) == 0 {
+		return nil
+	}
+
+	var counts map[string]quotaCount
+	if err := l.files.read(l.name, &counts); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	for _, q := range l.quotas {
+		if count, ok := counts[q.window]; ok {
+			q.since, q.used = count.Since, count.Used
+		}
+	}
+	return nil
+}
+
+// newLimiters builds the limiter of every provider given a rate or a quota
+func newLimiters(cfg LimitsConfig, providers []IProvider) (map[string]*limiter, error) {
+
+	known := make(map[string]bool)
+	for _, provider := range providers {
+		known[providerName(provider)] = true
+	}
+
+	names := make(map[string]bool)
+	for name, rate := range cfg.Rates {
+		if rate < 0 {
+			return nil, errors.New(fmt.Sprintf("negative rate given to provider %s", name))
+		}
+		names[name] = true
+	}
+	for _, quotas := range []map[string]int{cfg.Daily, cfg.Monthly} {
+		for name, limit := range quotas {
+			if limit < 0 {
+				return nil, errors.New(fmt.Sprintf("negative quota given to provider %s", name))
+			}
+			names[name] = true
+		}
+	}
+
+	var files *jsonDir
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return nil, errors.Wrap(err, "unable to create quota directory")
+		}
+		files = &jsonDir{Dir: cfg.Dir, Ext: ".quota"}
+	}
+
+	limiters := make(map[string]*limiter)
+	for name := range names {
+		if !known[name] {
+			return nil, errors.New(fmt.Sprintf("limit given to unknown provider %s", name))
+		}
+		l := newLimiter(cfg.Rates[name], cfg.Daily[name], cfg.Monthly[name])
+		l.files, l.name = files, name
+		if err := l.load(); err != nil {
+			return nil, errors.Wrapf(err, "unable to load quotas of provider %s", name)
+		}
+		limiters[name] = l
+	}
+
+	return limiters, nil
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_Take(t *testing.T) {
+
+	start := time.Date(2024, time.January, 31, 23, 59, 0, 0, time.UTC)
+
+	// each step moves the clock and takes a send
+	type step struct {
+		after         time.Duration
+		expectedOK    bool
+		expectedUntil time.Time
+	}
+
+	tests := []struct {
+		name    string
+		rate    float64
+		daily   int
+		monthly int
+		steps   []step
+	}{
+		{
+			name: "no limits - should always send",
+			steps: []step{
+				{expectedOK: true},
+				{expectedOK: true},
+				{expectedOK: true},
+			},
+		},
+		{
+			name: "rate exceeded - should throttle until a token is back",
+			rate: 2,
+			steps: []step{
+				{expectedOK: true},
+				{expectedOK: true},
+				{expectedOK: false, expectedUntil: start.Add(500 * time.Millisecond)},
+				{after: 500 * time.Millisecond, expectedOK: true},
+				{expectedOK: false, expectedUntil: start.Add(time.Second)},
+			},
+		},
+		{
+			name: "slow rate - should allow a single send per period",
+			rate: 0.5,
+			steps: []step{
+				{expectedOK: true},
+				{after: time.Second, expectedOK: false, expectedUntil: start.Add(2 * time.Second)},
+				{after: time.Second, expectedOK: true},
+			},
+		},
+		{
+			name:  "daily quota used up - should throttle until the next day",
+			daily: 2,
+			steps: []step{
+				{expectedOK: true},
+				{expectedOK: true},
+				{expectedOK: false, expectedUntil: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+				{after: time.Minute, expectedOK: true},
+			},
+		},
+		{
+			name:    "monthly quota used up - should throttle until the next month",
+			daily:   10,
+			monthly: 1,
+			steps: []step{
+				{expectedOK: true},
+				{expectedOK: false, expectedUntil: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+				{after: time.Minute, expectedOK: true},
+				{after: 24 * time.Hour, expectedOK: false, expectedUntil: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start
+			l := newLimiter(tt.rate, tt.daily, tt.monthly)
+			l.now = func() time.Time { return now }
+
+			for i, step := range tt.steps {
+				now = now.Add(step.after)
+
+				until, ok := l.take()
+				assert.Equal(t, step.expectedOK, ok, "unexpected take at step %d", i)
+				if !step.expectedOK {
+					assert.Equal(t, step.expectedUntil, until, "unexpected until at step %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiter_Release(t *testing.T) {
+
+	l := newLimiter(0, 1, 0)
+
+	_, ok := l.take()
+	assert.True(t, ok)
+
+	_, ok = l.take()
+	assert.False(t, ok, "quota not enforced")
+
+	l.release()
+	_, ok = l.take()
+	assert.True(t, ok, "quota of a refused send not given back")
+}
+
+func TestLimiter_Persisted(t *testing.T) {
+
+	cfg := LimitsConfig{Daily: map[string]int{"ses": 2}, Monthly: map[string]int{"ses": 3}, Dir: t.TempDir()}
+	providers := []IProvider{&MockNamedProvider{name: "ses"}}
+	now := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+
+	restart := func() *limiter {
+		limiters, err := newLimiters(cfg, providers)
+		assert.NoError(t, err)
+		l := limiters["ses"]
+		l.now = func() time.Time { return now }
+		return l
+	}
+
+	l := restart()
+	for i := 0; i < 2; i++ {
+		_, ok := l.take()
+		assert.True(t, ok)
+	}
+	assert.NoError(t, l.save())
+
+	l = restart()
+	_, ok := l.take()
+	assert.False(t, ok, "daily quota started over on restart")
+
+	// the day is over, only the monthly quota is still counted
+	now = now.Add(24 * time.Hour)
+	l = restart()
+	_, ok = l.take()
+	assert.True(t, ok)
+	assert.NoError(t, l.save())
+
+	now = now.Add(24 * time.Hour)
+	l = restart()
+	_, ok = l.take()
+	assert.False(t, ok, "monthly quota started over on restart")
+
+	now = now.AddDate(0, 1, 0)
+	l = restart()
+	_, ok = l.take()
+	assert.True(t, ok, "monthly quota of a past month kept")
+}
+
+func TestNewLimiters(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           LimitsConfig
+		expected      []string
+		expectedError string
+	}{
+		{
+			name:     "rates and quotas - should limit each provider named",
+			cfg:      LimitsConfig{Rates: map[string]float64{"ses": 14}, Monthly: map[string]int{"sendgrid": 40000}},
+			expected: []string{"ses", "sendgrid"},
+		},
+		{
+			name:          "unknown provider - should fail",
+			cfg:           LimitsConfig{Daily: map[string]int{"mandrill": 100}},
+			expectedError: "limit given to unknown provider mandrill",
+		},
+		{
+			name:          "negative rate - should fail",
+			cfg:           LimitsConfig{Rates: map[string]float64{"ses": -1}},
+			expectedError: "negative rate given to provider ses",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiters, err := newLimiters(tt.cfg, []IProvider{&MockNamedProvider{name: "ses"}, &MockNamedProvider{name: "sendgrid"}})
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+
+			var names []string
+			for name := range limiters {
+				names = append(names, name)
+			}
+			assert.ElementsMatch(t, tt.expected, names)
+		})
+	}
+}
+
+func TestService_Limits(t *testing.T) {
+	tests := []struct {
+		name              string
+		spillover         bool
+		expectedCallsSES  int
+		expectedCallsSMTP int
+		expectedHeld      bool
+	}{
+		{
+			name:             "throttled without spillover - should hold the mail for the provider",
+			expectedCallsSES: 1,
+			expectedHeld:     true,
+		},
+		{
+			name:              "throttled with spillover - should send through the next provider",
+			spillover:         true,
+			expectedCallsSES:  1,
+			expectedCallsSMTP: 1,
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ses := &MockNamedProvider{name: "ses"}
+			smtp := &MockNamedProvider{name: "smtp"}
+
+			s, err := NewService(Config{
+				Workers: 1,
+				Limits:  LimitsConfig{Daily: map[string]int{"ses": 1}, Spillover: tt.spillover},
+			}, []IProvider{ses, smtp}, logger)
+			assert.NoError(t, err)
+
+			assert.NoError(t, s.QueueMail(&models.Mail{ID: "first"}))
+			assert.NoError(t, s.QueueMail(&models.Mail{ID: "second"}))
+			time.Sleep(100 * time.Millisecond)
+			s.Quit()
+
+			ses.mu.Lock()
+			assert.Equal(t, tt.expectedCallsSES, ses.CallCount, "unexpected ses calls")
+			ses.mu.Unlock()
+
+			smtp.mu.Lock()
+			assert.Equal(t, tt.expectedCallsSMTP, smtp.CallCount, "unexpected smtp calls")
+			smtp.mu.Unlock()
+
+			status, err := s.Status("second")
+			assert.NoError(t, err)
+			if !tt.expectedHeld {
+				assert.Equal(t, models.MailSent, status.State)
+				return
+			}
+
+			assert.Equal(t, models.MailQueued, status.State, "held mail not left in the queue")
+			assert.Empty(t, status.Attempts, "held mail counted as attempted")
+
+			pending, err := s.Store.Load()
+			assert.NoError(t, err)
+			if assert.Len(t, pending, 1) {
+				assert.Equal(t, "second", pending[0].Mail.ID)
+				assert.Equal(t, 0, pending[0].Attempts)
+				assert.True(t, pending[0].NextAttempt.After(time.Now()), "held mail not scheduled for when the quota resets")
+			}
+		})
+	}
+}
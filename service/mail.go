@@ -1,73 +1,777 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	sp "github.com/SparkPost/gosparkpost"
+	"github.com/gugabfigueiredo/dream-mail-go/dkim"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
 	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
 )
 
 type IService interface {
-	QueueMail(mail *models.Mail)
+	QueueMail(mail *models.Mail) error
+	Pending() int
+	Status(id string) (*models.MailStatus, error)
+	DeadLetters() ([]*Delivery, error)
+	DeadLetter(id string) (*Delivery, error)
+	Requeue(id string) error
+	Health() []models.ProviderHealth
+	Authenticate(key string) (*models.App, error)
+	Usage(app int) (*models.UsageReport, error)
 }
 
+// IProvider sends a mail, giving up once ctx is done. Providers written against the previous interface can be
+// adapted with AdaptLegacyProvider.
 type IProvider interface {
-	SendMail(mail *models.Mail) error
+	SendMail(ctx context.Context, mail *models.Mail) error
 }
 
+// INamedProvider lets a provider pick the name it is reported under in statuses and logs
+type INamedProvider interface {
+	Name() string
+}
+
+// IMessageSigner signs the raw messages built for providers that take them, such as with DKIM
+type IMessageSigner interface {
+	Sign(msg []byte) ([]byte, error)
+}
+
+// defaultTimeout bounds a provider send when the config does not
+const defaultTimeout = 30 * time.Second
+
+// defaultWorkers is the number of concurrent senders when the config does not set it
+const defaultWorkers = 4
+
 type Config struct {
+	// Providers is the provider chain by name, in failover order. Empty enables every provider configured below.
+	Providers []string `json:"providers"`
+	// ProvidersFile holds a JSON array of provider records, the service builds its providers from it instead
+	// of the settings below and rebuilds them whenever it is reloaded
+	ProvidersFile string `json:"providers_file"`
+	// Timeout bounds a single provider send, Timeouts overrides it by provider name
+	Timeout  time.Duration            `json:"timeout" default:"30s"`
+	Timeouts map[string]time.Duration `json:"timeouts"`
+	// Workers is the number of mail sent concurrently. Mail is picked up in queue order but with more than one
+	// worker a mail may be delivered before one queued ahead of it, set it to 1 to deliver in queue order.
+	Workers int `json:"workers" default:"4"`
+	// Strategy picks the provider each mail is sent through first: failover always starts with the first
+	// provider of the chain, weighted spreads mail across the chain by Weights. Both fail over in chain order.
+	Strategy string `json:"strategy" default:"failover"`
+	// Weights by provider name, providers left out only get mail failed over to them. Without weights the
+	// weighted strategy goes round-robin.
+	Weights   map[string]int `json:"weights"`
+	Queue     QueueConfig
+	Retry     RetryConfig
+	Breaker   BreakerConfig
+	Routing   RoutingConfig
+	Limits    LimitsConfig
+	Status    StatusConfig
+	Apps      AppsConfig
+	Usage     UsageConfig
+	Senders   SenderConfig
+	DKIM      dkim.Config
 	SMTP      SMTPConfig
 	SES       SESConfig
 	Sendgrid  SendgridConfig
 	Sparkpost sp.Config
+	Mailgun   MailgunConfig
+	Postmark  PostmarkConfig
 }
 
 type Service struct {
-	Logger       *log.Logger
-	Providers    []IProvider
-	mailingQueue chan *models.Mail
+	Logger          *log.Logger
+	Store           IQueueStore
+	DeadLetterStore IQueueStore
+	Statuses        IStatusStore
+	Apps            IAppStore
+	// Records are the provider records the chain is built from, nil when providers are given instead
+	Records      IProviderStore
+	Retry        RetryConfig
+	Timeout      time.Duration
+	Timeouts     map[string]time.Duration
+	Limits       LimitsConfig
+	mailingQueue chan *Delivery
+
+	// cfg is kept to resolve routing, weights and limits again when providers change
+	cfg     Config
+	chainMu sync.RWMutex
+	chain   *chain
+	// signer is handed to providers built at runtime, see LoadProviders
+	signer IMessageSigner
+	// recordsMu serializes changes to the provider records along with the chain built from them
+	recordsMu sync.Mutex
+
+	breakerCfg BreakerConfig
+	breakersMu sync.Mutex
+	breakers   map[string]*breaker
+
+	usage *usageMeter
+
+	// ctx is cancelled once shutdown gives up on draining, interrupting the sends in progress
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	// stopping is closed when shutdown starts, from then on mail is refused and workers exit once the queue
+	// is empty
+	acceptMu sync.RWMutex
+	stopped  bool
+	stopping chan struct{}
+
+	mu     sync.Mutex
+	timers map[*Delivery]*time.Timer
+
+	statusMu sync.Mutex
+	// idsMu makes checking that a mail ID is free and taking it one step, see take
+	idsMu sync.Mutex
 }
 
-var done chan bool
+func NewService(cfg Config, providers []IProvider, logger *log.Logger) (*Service, error) {
+
+	store, err := NewQueueStore(cfg.Queue)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open mailing queue")
+	}
+
+	deadLetters, err := NewDeadLetterStore(cfg.Queue)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open dead letter queue")
+	}
+
+	statuses, err := NewStatusStore(cfg.Status)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open status store")
+	}
+
+	apps, err := NewAppStore(cfg.Apps)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load apps")
+	}
+
+	if err := validSenders(cfg.Senders.Allowed); err != nil {
+		return nil, errors.Wrap(err, "invalid allowed senders")
+	}
+
+	signer, err := newSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// providers from a file are built here rather than given, so apps can refer to them by record ID
+	var records IProviderStore
+	if cfg.ProvidersFile != "" {
+		if len(providers) > 0 {
+			return nil, errors.New("providers given along with a providers file")
+		}
+		records = NewFileProviderStore(cfg.ProvidersFile)
+		listed, err := records.List()
+		if err != nil {
+			return nil, err
+		}
+		built := make([]models.Provider, 0, len(listed))
+		for _, record := range listed {
+			built = append(built, *record)
+		}
+		if providers, err = BuildProviders(built, ProviderDeps{Logger: logger, Signer: signer}); err != nil {
+			return nil, err
+		}
+	}
+
+	chain, err := newChain(cfg, providers, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// apps are refused up front rather than having their mail fail, the providers they list must exist
+	if err := checkAppProviders(apps, chain.ids); err != nil {
+		return nil, errors.Wrap(err, "invalid apps")
+	}
+
+	// mail left behind by a previous run is delivered before anything new
+	pending, err := store.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load queued mail")
+	}
+
+	usage, err := newUsageMeter(cfg.Usage, logger)
+	if err != nil {
+		return nil, err
+	}
 
-func NewService(providers []IProvider, logger *log.Logger) *Service {
+	size := cfg.Queue.Size
+	if size <= 0 {
+		size = 100
+	}
 
 	s := &Service{
-		Logger:       logger,
-		Providers:    providers,
-		mailingQueue: make(chan *models.Mail, 100),
+		Logger:          logger,
+		Store:           store,
+		DeadLetterStore: deadLetters,
+		Statuses:        statuses,
+		Apps:            apps,
+		Records:         records,
+		Retry:           cfg.Retry.withDefaults(),
+		Timeout:         cfg.Timeout,
+		Timeouts:        cfg.Timeouts,
+		Limits:          cfg.Limits,
+		cfg:             cfg,
+		chain:           chain,
+		signer:          signer,
+		mailingQueue:    make(chan *Delivery, size),
+		timers:          make(map[*Delivery]*time.Timer),
+		stopping:        make(chan struct{}),
+		breakerCfg:      cfg.Breaker.withDefaults(),
+		breakers:        make(map[string]*breaker),
+		usage:           usage,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	s.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.sendQueued()
+	}
+
+	if len(pending) > 0 {
+		logger.I("replaying queued mail", "count", len(pending))
+		go func() {
+			for _, delivery := range pending {
+				if delivery.NextAttempt.After(time.Now()) {
+					s.schedule(delivery)
+					continue
+				}
+				s.enqueue(delivery)
+			}
+		}()
+	}
+
+	return s, nil
+}
+
+// QueueMail persists the mail before handing it to the senders, once it returns nil the mail is
+// guaranteed to be delivered, dead lettered or replayed on the next start. Mail is refused with
+// ErrShuttingDown once shutdown started, with ErrMailExists when its ID is taken, with a SenderError when its
+// sender is not allowed, with a QuotaError once its app reached its daily limit and with ErrQueueFull while the
+// queue is full.
+func (s *Service) QueueMail(mail *models.Mail) error {
+
+	var app *models.App
+	if mail.AppID != 0 {
+		found, err := s.Apps.Get(mail.AppID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return errors.Wrap(err, "unable to read app")
+		}
+		app = found
+	}
+
+	if err := s.checkSender(mail, app); err != nil {
+		return err
+	}
+
+	if mail.AppID == 0 {
+		return s.queue(mail, false)
+	}
+
+	limit := 0
+	if app != nil {
+		limit = app.DailyLimit
+	}
+
+	if until, ok := s.usage.accept(mail.AppID, limit); !ok {
+		return &QuotaError{App: mail.App, Limit: limit, Until: until}
+	}
+	if err := s.queue(mail, false); err != nil {
+		s.usage.unaccept(mail.AppID)
+		return err
+	}
+	return nil
+}
+
+// queue persists the mail and hands it to the senders, whatever the limits of its app. The mail is refused
+// when its ID is taken, unless it is requeued from the dead letters it is then taken out of.
+func (s *Service) queue(mail *models.Mail, requeue bool) error {
+	delivery := &Delivery{Mail: mail}
+
+	// shutdown waits for the mail being accepted, so whatever it finds in the store is complete
+	s.acceptMu.RLock()
+	if s.stopped {
+		s.acceptMu.RUnlock()
+		return ErrShuttingDown
+	}
+	if err := s.take(delivery, requeue); err != nil {
+		s.acceptMu.RUnlock()
+		return err
+	}
+
+	// new mail never waits for room, it is taken back when the queue is full
+	if !requeue {
+		defer s.acceptMu.RUnlock()
+		select {
+		case s.mailingQueue <- delivery:
+			return nil
+		default:
+		}
+		if err := s.untake(delivery); err != nil {
+			return err
+		}
+		return ErrQueueFull
+	}
+	s.acceptMu.RUnlock()
+
+	s.enqueue(delivery)
+	return nil
+}
+
+// take persists the delivery under the ID of its mail and gives it a status. The ID is checked to be free
+// under the same lock, so two mail cannot take the same ID and a dead letter is only requeued once.
+func (s *Service) take(delivery *Delivery, requeue bool) error {
+	mail := delivery.Mail
+
+	s.idsMu.Lock()
+	defer s.idsMu.Unlock()
+
+	switch {
+	case requeue:
+		if err := s.deadLettered(mail.ID); err != nil {
+			return err
+		}
+	case mail.ID != "":
+		taken, err := s.idTaken(mail.ID)
+		if err != nil {
+			return errors.Wrap(err, "unable to check mail id")
+		}
+		if taken {
+			return ErrMailExists
+		}
+	}
+
+	if err := s.Store.Save(delivery); err != nil {
+		return errors.Wrap(err, "unable to persist mail")
+	}
+
+	if requeue {
+		if err := s.DeadLetterStore.Delete(mail.ID); err != nil {
+			return errors.Wrap(err, "unable to remove requeued mail from dead letters")
+		}
+	}
+
+	s.updateStatus(mail.ID, func(status *models.MailStatus) {
+		status.App, status.AppID = mail.App, mail.AppID
+		status.State = models.MailQueued
+	})
+	return nil
+}
+
+// untake removes a delivery the workers never got along with its status, freeing its ID
+func (s *Service) untake(delivery *Delivery) error {
+	s.idsMu.Lock()
+	defer s.idsMu.Unlock()
+
+	if err := s.Store.Delete(delivery.Mail.ID); err != nil {
+		return errors.Wrap(err, "unable to remove refused mail from queue")
+	}
+	if err := s.Statuses.Delete(delivery.Mail.ID); err != nil {
+		return errors.Wrap(err, "unable to remove status of refused mail")
+	}
+	return nil
+}
+
+// deadLettered checks that the mail is still a dead letter and not queued already, a dead letter requeued by
+// someone else is not found
+func (s *Service) deadLettered(id string) error {
+	if _, err := s.Store.Get(id); !errors.Is(err, ErrNotFound) {
+		if err != nil {
+			return errors.Wrap(err, "unable to check mail id")
+		}
+		return ErrMailExists
+	}
+	_, err := s.DeadLetterStore.Get(id)
+	return err
+}
+
+// idTaken tells whether a mail with the ID is queued, dead lettered or has a status
+func (s *Service) idTaken(id string) (bool, error) {
+	if _, err := s.Statuses.Get(id); !errors.Is(err, ErrNotFound) {
+		return err == nil, err
+	}
+	if _, err := s.Store.Get(id); !errors.Is(err, ErrNotFound) {
+		return err == nil, err
+	}
+	if _, err := s.DeadLetterStore.Get(id); !errors.Is(err, ErrNotFound) {
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// Pending is the number of mail waiting for a sender, mail scheduled for a retry is not counted
+func (s *Service) Pending() int {
+	return len(s.mailingQueue)
+}
+
+// Status reports the delivery status of a queued mail
+func (s *Service) Status(id string) (*models.MailStatus, error) {
+	return s.Statuses.Get(id)
+}
+
+// DeadLetters lists the mail that exhausted its delivery attempts, oldest first
+func (s *Service) DeadLetters() ([]*Delivery, error) {
+	return s.DeadLetterStore.Load()
+}
+
+func (s *Service) DeadLetter(id string) (*Delivery, error) {
+	return s.DeadLetterStore.Get(id)
+}
+
+// Requeue moves a dead lettered mail back to the queue with a fresh set of attempts, it does not count against
+// the daily limit of its app again
+func (s *Service) Requeue(id string) error {
+
+	delivery, err := s.DeadLetterStore.Get(id)
+	if err != nil {
+		return err
 	}
 
-	done = make(chan bool)
-	go s.sendQueued()
+	if err := s.queue(delivery.Mail, true); err != nil {
+		return err
+	}
 
-	return s
+	s.Logger.I("dead letter requeued", "mailID", id)
+	return nil
 }
 
-func (s *Service) QueueMail(mail *models.Mail) {
-	s.mailingQueue <- mail
+// enqueue hands the delivery to the workers. Once the service quits it is left in the store, to be replayed
+// on the next start.
+func (s *Service) enqueue(delivery *Delivery) {
+	select {
+	case s.mailingQueue <- delivery:
+	case <-s.ctx.Done():
+	}
 }
 
+// sendQueued is a worker, it sends queued mail one at a time until shutdown. Once shutdown starts it sends
+// what is left in the queue and exits, or exits right away when shutdown gives up on draining.
 func (s *Service) sendQueued() {
+	defer s.workers.Done()
 	for {
 		select {
-		case mail := <-s.mailingQueue:
-			var err error
-			logger := s.Logger.C("mailID", mail.ID, "from", mail.From.Addr, "to", mail.To)
-			for _, provider := range s.Providers {
-				err = provider.SendMail(mail)
-				if err == nil {
-					break
+		case delivery := <-s.mailingQueue:
+			s.send(delivery)
+		case <-s.ctx.Done():
+			return
+		case <-s.stopping:
+			for s.ctx.Err() == nil {
+				select {
+				case delivery := <-s.mailingQueue:
+					s.send(delivery)
+				default:
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
+func (s *Service) send(delivery *Delivery) {
+	mail := delivery.Mail
+	logger := s.Logger.C("mailID", mail.ID, "from", mail.From.Addr, "to", mail.To)
+
+	delivery.Attempts++
+
+	s.updateStatus(mail.ID, func(status *models.MailStatus) {
+		status.State = models.MailSending
+	})
+
+	chain := s.currentChain()
+	route, providers := chain.router.Route(mail)
+	if chain.balancer != nil {
+		providers = chain.balancer.order(route, providers)
+	}
+	logger = logger.C("route", route)
+
+	// a mail every provider refused for good is not retried, a mail a provider was throttled for waits for it
+	var errs []string
+	var heldUntil time.Time
+	permanent := true
+
+	// mail from an app only goes through the providers the app is given
+	allowed, err := s.allowedProviders(mail, providers)
+	switch {
+	case err != nil:
+		logger.E("unable to read the app of the mail", "app", mail.App, "err", err)
+		errs, permanent = append(errs, err.Error()), false
+		providers = nil
+	case len(allowed) == 0:
+		// the route and the providers of the app do not meet, that is no fault of the mail so it is retried
+		errs, permanent = append(errs, fmt.Sprintf("no provider allowed for app %s", mail.App)), false
+		providers = nil
+	default:
+		providers = allowed
+	}
+
+	for _, provider := range providers {
+		name := providerName(provider)
+
+		// a provider that keeps failing is skipped until its cooldown is over
+		circuit := s.breaker(name)
+		if !circuit.allow() {
+			logger.I("provider skipped, circuit open", "provider", name)
+			continue
+		}
+
+		limiter := chain.limiters[name]
+		if limiter != nil {
+			if until, ok := limiter.take(); !ok {
+				circuit.release()
+				if heldUntil.IsZero() || until.Before(heldUntil) {
+					heldUntil = until
+				}
+				if s.Limits.Spillover {
+					logger.I("provider skipped, throttled", "provider", name, "until", until)
+					continue
 				}
-				logger.E("unable to send to provider", "err", err)
+				break
+			}
+		}
+
+		attempt := models.Attempt{Provider: name, At: time.Now()}
+
+		ctx, cancel := context.WithTimeout(s.ctx, s.timeout(name))
+		err := provider.SendMail(ctx, mail)
+		cancel()
+
+		if limiter != nil {
+			if err != nil {
+				limiter.release()
+			}
+			if err := limiter.save(); err != nil {
+				logger.E("unable to save provider quotas", "provider", name, "err", err)
+			}
+		}
+
+		if err != nil && s.ctx.Err() != nil {
+			circuit.release()
+			// the mail is still in the store, it is replayed on the next start without losing an attempt
+			delivery.Attempts--
+			s.updateStatus(mail.ID, func(status *models.MailStatus) {
+				status.State = models.MailQueued
+			})
+			logger.I("delivery interrupted by shutdown", "provider", name)
+			return
+		}
+
+		if circuit.record(err) {
+			logger.E("provider circuit opened", "provider", name, "cooldown", s.breakerCfg.Cooldown)
+		}
+
+		if err == nil {
+			if err := s.Store.Delete(mail.ID); err != nil {
+				logger.E("unable to remove delivered mail from queue", "err", err)
 			}
-		case <-done:
-			close(s.mailingQueue)
+			s.updateStatus(mail.ID, func(status *models.MailStatus) {
+				status.State = models.MailSent
+				status.Provider = name
+				status.Attempts = append(status.Attempts, attempt)
+			})
+			s.countUsage(mail, func(bucket *models.UsageBucket) { bucket.Sent++ })
+			return
+		}
+
+		kind := ErrorKindOf(err)
+		logger.E("unable to send to provider", "provider", name, "kind", kind, "err", err)
+		errs = append(errs, err.Error())
+		permanent = permanent && kind == ErrorPermanent
+
+		attempt.Error = err.Error()
+		attempt.Kind = string(kind)
+		s.updateStatus(mail.ID, func(status *models.MailStatus) {
+			status.Attempts = append(status.Attempts, attempt)
+			status.LastError = attempt.Error
+		})
+	}
+
+	if !heldUntil.IsZero() {
+		s.hold(delivery, heldUntil, logger)
+		return
+	}
+
+	delivery.LastError = strings.Join(errs, "; ")
+	if len(errs) == 0 {
+		delivery.LastError = "no provider available"
+	}
+
+	if len(errs) > 0 && permanent {
+		logger.E("mail refused permanently by every provider")
+		s.deadLetter(delivery, true, logger)
+		return
+	}
+
+	if delivery.Attempts >= s.Retry.MaxAttempts {
+		s.deadLetter(delivery, false, logger)
+		return
+	}
+
+	s.updateStatus(mail.ID, func(status *models.MailStatus) {
+		status.State = models.MailQueued
+		status.LastError = delivery.LastError
+	})
+
+	delivery.NextAttempt = time.Now().Add(s.Retry.backoff(delivery.Attempts))
+	if err := s.Store.Save(delivery); err != nil {
+		logger.E("unable to persist mail for retry", "err", err)
+	}
+
+	logger.I("mail scheduled for retry", "attempts", delivery.Attempts, "nextAttempt", delivery.NextAttempt)
+	s.schedule(delivery)
+}
+
+// hold puts a mail a provider was throttled for back in the queue until the provider frees up, without
+// counting it as a failed attempt
+func (s *Service) hold(delivery *Delivery, until time.Time, logger *log.Logger) {
+	delivery.Attempts--
+
+	s.updateStatus(delivery.Mail.ID, func(status *models.MailStatus) {
+		status.State = models.MailQueued
+	})
+
+	delivery.NextAttempt = until
+	if err := s.Store.Save(delivery); err != nil {
+		logger.E("unable to persist held mail", "err", err)
+	}
+
+	logger.I("mail held, provider throttled", "nextAttempt", delivery.NextAttempt)
+	s.schedule(delivery)
+}
+
+// deadLetter gives up on the mail, it bounced when every provider refused it for good
+func (s *Service) deadLetter(delivery *Delivery, bounced bool, logger *log.Logger) {
+	if err := s.DeadLetterStore.Save(delivery); err != nil {
+		// keep it in the queue so it is at least replayed on the next start
+		logger.E("unable to dead letter mail", "err", err)
+		return
+	}
+	if err := s.Store.Delete(delivery.Mail.ID); err != nil {
+		logger.E("unable to remove dead lettered mail from queue", "err", err)
+	}
+	s.updateStatus(delivery.Mail.ID, func(status *models.MailStatus) {
+		status.State = models.MailFailed
+		if bounced {
+			status.State = models.MailBounced
+		}
+		status.LastError = delivery.LastError
+	})
+	logger.E("mail dead lettered", "attempts", delivery.Attempts, "err", delivery.LastError)
+
+	s.countUsage(delivery.Mail, func(bucket *models.UsageBucket) {
+		if bounced {
+			bucket.Bounced++
 			return
 		}
+		bucket.Failed++
+	})
+}
+
+// countUsage counts an outcome of the mail for its app, mail without an app is not counted
+func (s *Service) countUsage(mail *models.Mail, change func(bucket *models.UsageBucket)) {
+	if mail.AppID != 0 {
+		s.usage.count(mail.AppID, change)
+	}
+}
+
+// updateStatus applies a change to the status of a mail, creating it on first use. Status tracking is
+// best effort, a failing store never holds back delivery.
+func (s *Service) updateStatus(id string, update func(status *models.MailStatus)) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	now := time.Now()
+
+	status, err := s.Statuses.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		status, err = &models.MailStatus{ID: id, CreatedAt: now}, nil
+	}
+	if err != nil {
+		s.Logger.E("unable to read mail status", "mailID", id, "err", err)
+		return
+	}
+
+	update(status)
+	status.UpdatedAt = now
+
+	if err := s.Statuses.Save(status); err != nil {
+		s.Logger.E("unable to save mail status", "mailID", id, "err", err)
+	}
+}
+
+// Health reports the circuit breaker state of every provider, in failover order
+func (s *Service) Health() []models.ProviderHealth {
+	providers := s.Providers()
+	health := make([]models.ProviderHealth, 0, len(providers))
+	for _, provider := range providers {
+		name := providerName(provider)
+		health = append(health, s.breaker(name).health(name))
+	}
+	return health
+}
+
+// breaker returns the circuit breaker of the named provider, creating it on first use
+func (s *Service) breaker(name string) *breaker {
+	s.breakersMu.Lock()
+	defer s.breakersMu.Unlock()
+
+	b, ok := s.breakers[name]
+	if !ok {
+		b = newBreaker(s.breakerCfg)
+		s.breakers[name] = b
 	}
+	return b
 }
 
-func (s *Service) Quit() {
-	done <- true
-	close(done)
+// providerName identifies a provider in statuses and logs
+func providerName(provider IProvider) string {
+	if named, ok := provider.(INamedProvider); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", provider)
+}
+
+// timeout is how long a send through the named provider may take
+func (s *Service) timeout(name string) time.Duration {
+	if timeout, ok := s.Timeouts[name]; ok && timeout > 0 {
+		return timeout
+	}
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return defaultTimeout
+}
+
+// schedule hands the delivery to the senders once its next attempt is due. Nothing is scheduled during
+// shutdown, the delivery is already persisted with its next attempt.
+func (s *Service) schedule(delivery *Delivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.stopping:
+		return
+	default:
+	}
+
+	s.timers[delivery] = time.AfterFunc(time.Until(delivery.NextAttempt), func() {
+		s.mu.Lock()
+		delete(s.timers, delivery)
+		s.mu.Unlock()
+
+		s.enqueue(delivery)
+	})
 }
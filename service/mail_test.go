@@ -1,15 +1,20 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
 	log "github.com/gugabfigueiredo/tiny-go-log"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 	"time"
 )
 
 type MockProvider struct {
+	mu sync.Mutex
+
 	CallCount  int
 	CalledWith []*models.Mail
 
@@ -20,7 +25,10 @@ type MockProvider struct {
 	ExpectedCalledWith []*models.Mail
 }
 
-func (m *MockProvider) SendMail(mail *models.Mail) error {
+func (m *MockProvider) SendMail(_ context.Context, mail *models.Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.CallCount++
 	m.CalledWith = append(m.CalledWith, mail)
 	if m.CallsBeforeError != 0 && m.CallCount > m.CallsBeforeError {
@@ -410,10 +418,12 @@ func TestService_QueueAndSendMail(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := NewService(tt.providers, logger)
+			// a single worker keeps the calls in queue order
+			s, err := NewService(Config{Workers: 1}, tt.providers, logger)
+			assert.NoError(t, err)
 
 			for _, mail := range tt.mails {
-				s.QueueMail(mail)
+				assert.NoError(t, s.QueueMail(mail))
 			}
 
 			time.Sleep(1 * time.Second)
@@ -426,3 +436,210 @@ func TestService_QueueAndSendMail(t *testing.T) {
 		})
 	}
 }
+
+// MockConcurrentProvider records how many sends are in progress at once
+type MockConcurrentProvider struct {
+	mu sync.Mutex
+
+	Delay         time.Duration
+	InFlight      int
+	MaxInFlight   int
+	DeliveredByID map[string]int
+}
+
+func (m *MockConcurrentProvider) SendMail(_ context.Context, mail *models.Mail) error {
+	m.mu.Lock()
+	m.InFlight++
+	if m.InFlight > m.MaxInFlight {
+		m.MaxInFlight = m.InFlight
+	}
+	m.mu.Unlock()
+
+	time.Sleep(m.Delay)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.InFlight--
+	m.DeliveredByID[mail.ID]++
+	return nil
+}
+
+func TestService_Workers(t *testing.T) {
+	tests := []struct {
+		name                string
+		workers             int
+		mails               int
+		expectedMaxInFlight int
+	}{
+		{
+			name:                "single worker - should send one mail at a time",
+			workers:             1,
+			mails:               10,
+			expectedMaxInFlight: 1,
+		},
+		{
+			name:                "worker pool - should send concurrently",
+			workers:             4,
+			mails:               40,
+			expectedMaxInFlight: 4,
+		},
+		{
+			name:                "more workers than mail - should deliver every mail once",
+			workers:             16,
+			mails:               8,
+			expectedMaxInFlight: 8,
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &MockConcurrentProvider{Delay: 20 * time.Millisecond, DeliveredByID: make(map[string]int)}
+
+			s, err := NewService(Config{Workers: tt.workers, Queue: QueueConfig{Size: 1}}, []IProvider{provider}, logger)
+			assert.NoError(t, err)
+
+			// a full queue refuses mail, it is sent again until a worker frees up some room
+			for i := 0; i < tt.mails; i++ {
+				mail := &models.Mail{ID: fmt.Sprintf("mail-%d", i)}
+				assert.Eventually(t, func() bool {
+					err := s.QueueMail(mail)
+					assert.True(t, err == nil || errors.Is(err, ErrQueueFull), "unexpected error %v", err)
+					return err == nil
+				}, 5*time.Second, time.Millisecond, "queue never freed up")
+			}
+
+			assert.Eventually(t, func() bool {
+				pending, err := s.Store.Load()
+				return err == nil && len(pending) == 0
+			}, 5*time.Second, 10*time.Millisecond, "queued mail was not delivered")
+			s.Quit()
+
+			provider.mu.Lock()
+			defer provider.mu.Unlock()
+
+			assert.Equal(t, tt.expectedMaxInFlight, provider.MaxInFlight, "unexpected concurrency")
+			assert.Len(t, provider.DeliveredByID, tt.mails, "mail lost")
+			for id, count := range provider.DeliveredByID {
+				assert.Equal(t, 1, count, "mail %s delivered more than once", id)
+			}
+		})
+	}
+}
+
+func TestService_QueueFull(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	provider := &MockConcurrentProvider{Delay: 500 * time.Millisecond, DeliveredByID: make(map[string]int)}
+
+	s, err := NewService(Config{Workers: 1, Queue: QueueConfig{Size: 1}}, []IProvider{provider}, logger)
+	assert.NoError(t, err)
+	defer s.Quit()
+
+	// one mail is held by the worker and one by the queue, the next is refused at once
+	var refused string
+	for i := 0; i < 3 && refused == ""; i++ {
+		id := fmt.Sprintf("mail-%d", i)
+		if err := s.QueueMail(&models.Mail{ID: id}); err != nil {
+			assert.ErrorIs(t, err, ErrQueueFull)
+			refused = id
+		}
+	}
+	assert.NotEmpty(t, refused, "full queue waited for room")
+
+	// the refused mail is forgotten, its id can be sent again
+	_, err = s.Store.Get(refused)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.Status(refused)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestService_WorkersQuitKeepsUndeliveredMail(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	provider := &MockConcurrentProvider{Delay: 20 * time.Millisecond, DeliveredByID: make(map[string]int)}
+
+	s, err := NewService(Config{Workers: 4}, []IProvider{provider}, logger)
+	assert.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, s.QueueMail(&models.Mail{ID: fmt.Sprintf("mail-%d", i)}))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	s.Quit()
+
+	pending, err := s.Store.Load()
+	assert.NoError(t, err)
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	// every mail is either delivered or still in the store for the next start, never both
+	assert.NotEmpty(t, provider.DeliveredByID, "no mail delivered before quit")
+	assert.NotEmpty(t, pending, "quit waited for the whole queue")
+	assert.Equal(t, 50, len(provider.DeliveredByID)+len(pending), "mail lost on quit")
+	for _, delivery := range pending {
+		assert.Zero(t, provider.DeliveredByID[delivery.Mail.ID], "delivered mail %s still queued", delivery.Mail.ID)
+	}
+}
+
+func TestService_MailIDTaken(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	provider := &MockProvider{}
+	s, err := NewService(Config{Workers: 1}, []IProvider{provider}, logger)
+	assert.NoError(t, err)
+	defer s.Quit()
+
+	// mail given the same id at once, by different apps, only one of them is accepted
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(app string) {
+			defer wg.Done()
+			results <- s.QueueMail(&models.Mail{ID: "1234", App: app})
+		}(fmt.Sprintf("app-%d", i))
+	}
+	wg.Wait()
+	close(results)
+
+	accepted := 0
+	for err := range results {
+		if err == nil {
+			accepted++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrMailExists)
+	}
+	assert.Equal(t, 1, accepted)
+
+	// the id stays taken once the mail is delivered
+	time.Sleep(50 * time.Millisecond)
+	assert.ErrorIs(t, s.QueueMail(&models.Mail{ID: "1234"}), ErrMailExists)
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	assert.Equal(t, 1, provider.CallCount)
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type MailgunConfig struct {
+	Domain  string `json:"domain"`
+	ApiKey  string `json:"api_key"`
+	BaseURL string `json:"base_url" default:"https://api.mailgun.net/v3"`
+}
+
+// MailgunMessage holds the fields posted to the Mailgun messages API
+type MailgunMessage struct {
+	From        string
+	To          []string
+	CC          []string
+	BCC         []string
+	ReplyTo     string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []MailgunAttachment
+	Inline      []MailgunAttachment
+}
+
+// MailgunAttachment is a file sent along a message, inline files are referenced from the html by file name
+type MailgunAttachment struct {
+	Name string
+	Type string
+	Data []byte
+}
+
+type MailgunResponse struct {
+	StatusCode int    `json:"-"`
+	ID         string `json:"id"`
+	Message    string `json:"message"`
+}
+
+type IMailgunClient interface {
+	Send(ctx context.Context, msg *MailgunMessage) (*MailgunResponse, error)
+}
+
+// MailgunClient posts messages to the Mailgun HTTP API of a single sending domain
+type MailgunClient struct {
+	BaseURL    string
+	Domain     string
+	ApiKey     string
+	HTTPClient *http.Client
+}
+
+func NewMailgunClient(cfg MailgunConfig) *MailgunClient {
+	return &MailgunClient{
+		BaseURL:    strings.TrimSuffix(cfg.BaseURL, "/"),
+		Domain:     cfg.Domain,
+		ApiKey:     cfg.ApiKey,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Send posts msg and returns the API response, errors are only returned when no response was received
+func (c *MailgunClient) Send(ctx context.Context, msg *MailgunMessage) (*MailgunResponse, error) {
+
+	body, contentType, err := msg.encode()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode mailgun message")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s/messages", c.BaseURL, c.Domain), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth("api", c.ApiKey)
+
+	httpResp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	// error bodies are not always json, the status code is what matters then
+	resp := &MailgunResponse{}
+	_ = json.NewDecoder(httpResp.Body).Decode(resp)
+	resp.StatusCode = httpResp.StatusCode
+
+	return resp, nil
+}
+
+func (m *MailgunMessage) encode() (*bytes.Buffer, string, error) {
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	fields := []struct {
+		name   string
+		values []string
+	}{
+		{"from", []string{m.From}},
+		{"to", m.To},
+		{"cc", m.CC},
+		{"bcc", m.BCC},
+		{"h:Reply-To", []string{m.ReplyTo}},
+		{"subject", []string{m.Subject}},
+		{"text", []string{m.Text}},
+		{"html", []string{m.HTML}},
+	}
+
+	for _, field := range fields {
+		for _, value := range field.values {
+			if value == "" {
+				continue
+			}
+			if err := w.WriteField(field.name, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	for _, files := range []struct {
+		field       string
+		attachments []MailgunAttachment
+	}{
+		{"attachment", m.Attachments},
+		{"inline", m.Inline},
+	} {
+		for _, attachment := range files.attachments {
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+				"name":     files.field,
+				"filename": attachment.Name,
+			}))
+			header.Set("Content-Type", attachment.Type)
+			if attachment.Type == "" {
+				header.Set("Content-Type", "application/octet-stream")
+			}
+
+			fw, err := w.CreatePart(header)
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := fw.Write(attachment.Data); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return &buf, w.FormDataContentType(), nil
+}
+
+type MailgunProvider struct {
+	Logger *log.Logger
+	Client IMailgunClient
+}
+
+func NewMailgunProvider(cfg MailgunConfig, logger *log.Logger) *MailgunProvider {
+	return &MailgunProvider{
+		Logger: logger,
+		Client: NewMailgunClient(cfg),
+	}
+}
+
+func (s *MailgunProvider) Name() string {
+	return "mailgun"
+}
+
+func (s *MailgunProvider) SendMail(ctx context.Context, mail *models.Mail) error {
+
+	logger := s.Logger.C("from", mail.From.Addr, "to", mail.To, "subject", mail.Subject, "id", mail.ID)
+
+	msg, err := s.buildMessage(mail)
+	if err != nil {
+		logger.E("unable to build message", "err", err)
+		return buildError(s.Name(), err)
+	}
+
+	resp, err := s.Client.Send(ctx, msg)
+	if err != nil {
+		logger.E("failed to send message", "err", err)
+		return httpSendError(s.Name(), 0, errors.Wrap(err, "failed to send message"))
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		logger.I("mailgun request successful", "status", resp.StatusCode, "mailgunID", resp.ID)
+	default:
+		logger.E("mailgun request failed", "status", resp.StatusCode, "message", resp.Message)
+		return httpSendError(s.Name(), resp.StatusCode, errors.New(fmt.Sprintf("mailgun request failed: %s", resp.Message)))
+	}
+
+	return nil
+}
+
+func (s *MailgunProvider) buildMessage(mail *models.Mail) (*MailgunMessage, error) {
+
+	msg := &MailgunMessage{
+		From:    formatAddress(mail.From),
+		To:      formatAddresses(mail.To),
+		CC:      formatAddresses(mail.CC),
+		BCC:     formatAddresses(mail.BCC),
+		Subject: mail.Subject,
+		Text:    mail.Text,
+		HTML:    mail.HTML,
+	}
+
+	if mail.ReplyTo.Addr != "" {
+		msg.ReplyTo = formatAddress(mail.ReplyTo)
+	}
+
+	for _, attachment := range mail.Attachments {
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(attachment.Data), ""))
+		if err != nil {
+			return nil, errors.Wrapf(err, "attachment %s is not valid base64", attachment.Name)
+		}
+
+		// mailgun gives inline files their file name as content id
+		if attachment.ContentID != "" && mail.HTML != "" {
+			msg.Inline = append(msg.Inline, MailgunAttachment{Name: attachment.ContentID, Type: attachment.Type, Data: data})
+			continue
+		}
+
+		_, fileName := filepath.Split(attachment.Name)
+		msg.Attachments = append(msg.Attachments, MailgunAttachment{Name: fileName, Type: attachment.Type, Data: data})
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockMailgunServer stands in for the Mailgun API, recording the form of the last request
+type MockMailgunServer struct {
+	*httptest.Server
+
+	StatusCode int
+	Body       string
+	Path       string
+	User       string
+	Pass       string
+	Form       map[string][]string
+	Files      map[string]map[string]string
+}
+
+func NewMockMailgunServer(statusCode int, body string) *MockMailgunServer {
+	m := &MockMailgunServer{StatusCode: statusCode, Body: body}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Path = r.URL.Path
+		m.User, m.Pass, _ = r.BasicAuth()
+
+		if err := r.ParseMultipartForm(1 << 20); err == nil {
+			m.Form = r.MultipartForm.Value
+			m.Files = make(map[string]map[string]string)
+			for field, headers := range r.MultipartForm.File {
+				m.Files[field] = make(map[string]string)
+				for _, header := range headers {
+					f, _ := header.Open()
+					data, _ := io.ReadAll(f)
+					m.Files[field][header.Filename] = header.Header.Get("Content-Type") + ":" + string(data)
+				}
+			}
+		}
+
+		w.WriteHeader(m.StatusCode)
+		_, _ = w.Write([]byte(m.Body))
+	}))
+	return m
+}
+
+func TestMailgunProvider_SendMail(t *testing.T) {
+	tests := []struct {
+		name          string
+		mail          *models.Mail
+		statusCode    int
+		body          string
+		expectedForm  map[string][]string
+		expectedFiles map[string]map[string]string
+		expectedError error
+	}{
+		{
+			name: "send email plaintext",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com", Name: "Sender"},
+				To:      []models.Email{{Addr: "recipient@domain.com", Name: "Recipient"}},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			statusCode: 200,
+			body:       `{"id": "<20230724.1@mg.domain.com>", "message": "Queued. Thank you."}`,
+			expectedForm: map[string][]string{
+				"from":    {`"Sender" <sender@domain.com>`},
+				"to":      {`"Recipient" <recipient@domain.com>`},
+				"subject": {"Test Subject"},
+				"text":    {"Test Text"},
+			},
+		},
+		{
+			name: "send email with cc, bcc, reply-to and attachments",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}, {Addr: "other@domain.com"}},
+				CC:      []models.Email{{Addr: "cc@domain.com", Name: "Copy"}},
+				BCC:     []models.Email{{Addr: "bcc@domain.com"}},
+				ReplyTo: models.Email{Addr: "reply@domain.com"},
+				Subject: "Test Subject",
+				HTML:    `<img src="cid:logo">`,
+				Attachments: []models.Attachment{
+					{Name: "docs/test.txt", Type: "text/plain", Data: "dGVzdA=="},
+					{Name: "logo.png", Type: "image/png", Data: "bG9nbw==", ContentID: "logo"},
+				},
+			},
+			statusCode: 200,
+			body:       `{"id": "<20230724.2@mg.domain.com>", "message": "Queued. Thank you."}`,
+			expectedForm: map[string][]string{
+				"from":       {"<sender@domain.com>"},
+				"to":         {"<recipient@domain.com>", "<other@domain.com>"},
+				"cc":         {`"Copy" <cc@domain.com>`},
+				"bcc":        {"<bcc@domain.com>"},
+				"h:Reply-To": {"<reply@domain.com>"},
+				"subject":    {"Test Subject"},
+				"html":       {`<img src="cid:logo">`},
+			},
+			expectedFiles: map[string]map[string]string{
+				"attachment": {"test.txt": "text/plain:test"},
+				"inline":     {"logo": "image/png:logo"},
+			},
+		},
+		{
+			name: "rejected by mailgun - should report the failure",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			statusCode: 400,
+			body:       `{"message": "'to' parameter is not a valid address"}`,
+			expectedForm: map[string][]string{
+				"from":    {"<sender@domain.com>"},
+				"to":      {"<recipient@domain.com>"},
+				"subject": {"Test Subject"},
+				"text":    {"Test Text"},
+			},
+			expectedError: errors.New("mailgun permanent error 400: mailgun request failed: 'to' parameter is not a valid address"),
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewMockMailgunServer(tt.statusCode, tt.body)
+			defer server.Close()
+
+			provider := NewMailgunProvider(MailgunConfig{
+				Domain:  "mg.domain.com",
+				ApiKey:  "key-1234",
+				BaseURL: server.URL + "/v3",
+			}, logger)
+
+			err := provider.SendMail(context.Background(), tt.mail)
+
+			assert.Equal(t, "/v3/mg.domain.com/messages", server.Path, "unexpected endpoint")
+			assert.Equal(t, "api", server.User, "unexpected user")
+			assert.Equal(t, "key-1234", server.Pass, "unexpected api key")
+			assert.Equal(t, tt.expectedForm, server.Form, "unexpected form")
+			if tt.expectedFiles != nil {
+				assert.Equal(t, tt.expectedFiles, server.Files, "unexpected files")
+			}
+			if tt.expectedError == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.expectedError.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PostmarkConfig struct {
+	ServerToken   string `json:"server_token"`
+	MessageStream string `json:"message_stream" default:"outbound"`
+	BaseURL       string `json:"base_url" default:"https://api.postmarkapp.com"`
+}
+
+// PostmarkMessage is the body of the Postmark single email API
+type PostmarkMessage struct {
+	From          string               `json:"From"`
+	To            string               `json:"To"`
+	Cc            string               `json:"Cc,omitempty"`
+	Bcc           string               `json:"Bcc,omitempty"`
+	ReplyTo       string               `json:"ReplyTo,omitempty"`
+	Subject       string               `json:"Subject"`
+	TextBody      string               `json:"TextBody,omitempty"`
+	HtmlBody      string               `json:"HtmlBody,omitempty"`
+	MessageStream string               `json:"MessageStream,omitempty"`
+	Metadata      map[string]string    `json:"Metadata,omitempty"`
+	Attachments   []PostmarkAttachment `json:"Attachments,omitempty"`
+}
+
+type PostmarkAttachment struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+	ContentID   string `json:"ContentID,omitempty"`
+}
+
+type PostmarkResponse struct {
+	StatusCode  int    `json:"-"`
+	To          string `json:"To"`
+	SubmittedAt string `json:"SubmittedAt"`
+	MessageID   string `json:"MessageID"`
+	ErrorCode   int    `json:"ErrorCode"`
+	Message     string `json:"Message"`
+}
+
+type IPostmarkClient interface {
+	Send(ctx context.Context, msg *PostmarkMessage) (*PostmarkResponse, error)
+}
+
+// PostmarkErrorClass tells what a failed Postmark request says about the mail and the account
+type PostmarkErrorClass string
+
+const (
+	// PostmarkRejected means the mail itself is refused, sending it again will fail the same way
+	PostmarkRejected PostmarkErrorClass = "rejected"
+	// PostmarkMisconfigured means the token, sender signature or account can not send right now
+	PostmarkMisconfigured PostmarkErrorClass = "misconfigured"
+	// PostmarkTemporary means the request may succeed later, such as when rate limited
+	PostmarkTemporary PostmarkErrorClass = "temporary"
+)
+
+// postmarkErrorClasses classifies the API error codes, see https://postmarkapp.com/developer/api/overview#error-codes
+var postmarkErrorClasses = map[int]PostmarkErrorClass{
+	10:   PostmarkMisconfigured, // bad or missing server token
+	100:  PostmarkTemporary,     // maintenance
+	300:  PostmarkRejected,      // invalid email request
+	400:  PostmarkMisconfigured, // sender signature not found
+	401:  PostmarkMisconfigured, // sender signature not confirmed
+	402:  PostmarkRejected,      // invalid JSON
+	403:  PostmarkRejected,      // incompatible JSON
+	405:  PostmarkMisconfigured, // not allowed to send, out of credits
+	406:  PostmarkRejected,      // inactive recipient
+	409:  PostmarkRejected,      // JSON required
+	411:  PostmarkRejected,      // forbidden attachment type
+	412:  PostmarkMisconfigured, // account pending approval
+	413:  PostmarkMisconfigured, // not allowed to send, account suspended
+	429:  PostmarkTemporary,     // rate limit exceeded
+	1235: PostmarkMisconfigured, // message stream not found
+}
+
+// PostmarkError is a request Postmark answered with an error
+type PostmarkError struct {
+	StatusCode int
+	ErrorCode  int
+	Message    string
+}
+
+func (e *PostmarkError) Error() string {
+	return fmt.Sprintf("postmark request failed: %d code %d %s", e.StatusCode, e.ErrorCode, e.Message)
+}
+
+// Class classifies the error by its Postmark error code, falling back to the HTTP status
+func (e *PostmarkError) Class() PostmarkErrorClass {
+	if class, ok := postmarkErrorClasses[e.ErrorCode]; ok {
+		return class
+	}
+	switch {
+	case e.StatusCode == http.StatusUnauthorized:
+		return PostmarkMisconfigured
+	case e.StatusCode == http.StatusUnprocessableEntity:
+		return PostmarkRejected
+	default:
+		return PostmarkTemporary
+	}
+}
+
+// Kind maps the class of the error to the kind the service acts on
+func (e *PostmarkError) Kind() ErrorKind {
+	switch {
+	case e.ErrorCode == 429 || e.StatusCode == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case e.Class() == PostmarkRejected:
+		return ErrorPermanent
+	case e.Class() == PostmarkMisconfigured:
+		return ErrorAuthFailed
+	default:
+		return ErrorTransient
+	}
+}
+
+// PostmarkClient posts messages to the Postmark API of a single server
+type PostmarkClient struct {
+	BaseURL     string
+	ServerToken string
+	HTTPClient  *http.Client
+}
+
+func NewPostmarkClient(cfg PostmarkConfig) *PostmarkClient {
+	return &PostmarkClient{
+		BaseURL:     strings.TrimSuffix(cfg.BaseURL, "/"),
+		ServerToken: cfg.ServerToken,
+		HTTPClient:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Send posts msg and returns the API response, errors are only returned when no response was received
+func (c *PostmarkClient) Send(ctx context.Context, msg *PostmarkMessage) (*PostmarkResponse, error) {
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode postmark message")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/email", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", c.ServerToken)
+
+	httpResp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	// error bodies are not always json, the status code is what matters then
+	resp := &PostmarkResponse{}
+	_ = json.NewDecoder(httpResp.Body).Decode(resp)
+	resp.StatusCode = httpResp.StatusCode
+
+	return resp, nil
+}
+
+type PostmarkProvider struct {
+	Logger        *log.Logger
+	Client        IPostmarkClient
+	MessageStream string
+}
+
+func NewPostmarkProvider(cfg PostmarkConfig, logger *log.Logger) *PostmarkProvider {
+	return &PostmarkProvider{
+		Logger:        logger,
+		Client:        NewPostmarkClient(cfg),
+		MessageStream: cfg.MessageStream,
+	}
+}
+
+func (s *PostmarkProvider) Name() string {
+	return "postmark"
+}
+
+func (s *PostmarkProvider) SendMail(ctx context.Context, mail *models.Mail) error {
+
+	logger := s.Logger.C("from", mail.From.Addr, "to", mail.To, "subject", mail.Subject, "id", mail.ID)
+
+	resp, err := s.Client.Send(ctx, s.buildMessage(mail))
+	if err != nil {
+		logger.E("failed to send message", "err", err)
+		return httpSendError(s.Name(), 0, errors.Wrap(err, "failed to send message"))
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.ErrorCode != 0 {
+		postmarkErr := &PostmarkError{StatusCode: resp.StatusCode, ErrorCode: resp.ErrorCode, Message: resp.Message}
+		logger.E("postmark request failed", "status", resp.StatusCode, "code", resp.ErrorCode, "class", postmarkErr.Class(), "message", resp.Message)
+		// answers without a Postmark error code are reported by their HTTP status
+		code := strconv.Itoa(resp.ErrorCode)
+		if resp.ErrorCode == 0 {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		return NewSendError(postmarkErr.Kind(), s.Name(), code, postmarkErr)
+	}
+
+	logger.I("postmark request successful", "status", resp.StatusCode, "postmarkID", resp.MessageID)
+	return nil
+}
+
+func (s *PostmarkProvider) buildMessage(mail *models.Mail) *PostmarkMessage {
+
+	msg := &PostmarkMessage{
+		From:          formatAddress(mail.From),
+		To:            strings.Join(formatAddresses(mail.To), ", "),
+		Cc:            strings.Join(formatAddresses(mail.CC), ", "),
+		Bcc:           strings.Join(formatAddresses(mail.BCC), ", "),
+		Subject:       mail.Subject,
+		TextBody:      mail.Text,
+		HtmlBody:      mail.HTML,
+		MessageStream: s.MessageStream,
+		Metadata:      map[string]string{"mail_id": mail.ID},
+	}
+
+	if mail.ReplyTo.Addr != "" {
+		msg.ReplyTo = formatAddress(mail.ReplyTo)
+	}
+
+	for _, attachment := range mail.Attachments {
+		_, fileName := filepath.Split(attachment.Name)
+
+		contentType := attachment.Type
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		pmAttachment := PostmarkAttachment{
+			Name:        fileName,
+			Content:     strings.Join(strings.Fields(attachment.Data), ""),
+			ContentType: contentType,
+		}
+		if attachment.ContentID != "" {
+			pmAttachment.ContentID = "cid:" + attachment.ContentID
+		}
+
+		msg.Attachments = append(msg.Attachments, pmAttachment)
+	}
+
+	return msg
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockPostmarkClient struct {
+	Response   *PostmarkResponse
+	Error      error
+	CalledWith *PostmarkMessage
+}
+
+func (m *MockPostmarkClient) Send(_ context.Context, msg *PostmarkMessage) (*PostmarkResponse, error) {
+	m.CalledWith = msg
+	return m.Response, m.Error
+}
+
+func TestPostmarkProvider_SendMail(t *testing.T) {
+	tests := []struct {
+		name            string
+		mail            *models.Mail
+		mockResponse    *PostmarkResponse
+		expectedMessage *PostmarkMessage
+		expectedClass   PostmarkErrorClass
+	}{
+		{
+			name: "send email plaintext",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com", Name: "Sender"},
+				To:      []models.Email{{Addr: "recipient@domain.com", Name: "Recipient"}},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			mockResponse: &PostmarkResponse{StatusCode: 200, MessageID: "b7bc2f4a-e38e-4336-af7d-e6c392c2f817"},
+			expectedMessage: &PostmarkMessage{
+				From:          `"Sender" <sender@domain.com>`,
+				To:            `"Recipient" <recipient@domain.com>`,
+				Subject:       "Test Subject",
+				TextBody:      "Test Text",
+				MessageStream: "outbound",
+				Metadata:      map[string]string{"mail_id": "1234"},
+			},
+		},
+		{
+			name: "send email with cc, bcc, reply-to and attachments",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}, {Addr: "other@domain.com"}},
+				CC:      []models.Email{{Addr: "cc@domain.com"}},
+				BCC:     []models.Email{{Addr: "bcc@domain.com"}},
+				ReplyTo: models.Email{Addr: "reply@domain.com"},
+				Subject: "Test Subject",
+				HTML:    `<img src="cid:logo">`,
+				Attachments: []models.Attachment{
+					{Name: "docs/test.txt", Type: "text/plain", Data: "dGVzdA=="},
+					{Name: "logo.png", Type: "image/png", Data: "bG9nbw==", ContentID: "logo"},
+				},
+			},
+			mockResponse: &PostmarkResponse{StatusCode: 200},
+			expectedMessage: &PostmarkMessage{
+				From:          "<sender@domain.com>",
+				To:            "<recipient@domain.com>, <other@domain.com>",
+				Cc:            "<cc@domain.com>",
+				Bcc:           "<bcc@domain.com>",
+				ReplyTo:       "<reply@domain.com>",
+				Subject:       "Test Subject",
+				HtmlBody:      `<img src="cid:logo">`,
+				MessageStream: "outbound",
+				Metadata:      map[string]string{"mail_id": "1234"},
+				Attachments: []PostmarkAttachment{
+					{Name: "test.txt", Content: "dGVzdA==", ContentType: "text/plain"},
+					{Name: "logo.png", Content: "bG9nbw==", ContentType: "image/png", ContentID: "cid:logo"},
+				},
+			},
+		},
+		{
+			name: "inactive recipient - should be rejected",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			mockResponse: &PostmarkResponse{StatusCode: 422, ErrorCode: 406, Message: "You tried to send to a recipient that has been marked as inactive."},
+			expectedMessage: &PostmarkMessage{
+				From:          "<sender@domain.com>",
+				To:            "<recipient@domain.com>",
+				Subject:       "Test Subject",
+				TextBody:      "Test Text",
+				MessageStream: "outbound",
+				Metadata:      map[string]string{"mail_id": "1234"},
+			},
+			expectedClass: PostmarkRejected,
+		},
+		{
+			name: "bad server token - should be misconfigured",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			mockResponse: &PostmarkResponse{StatusCode: 401, ErrorCode: 10, Message: "No Account or Server API tokens were supplied in the HTTP headers."},
+			expectedMessage: &PostmarkMessage{
+				From:          "<sender@domain.com>",
+				To:            "<recipient@domain.com>",
+				Subject:       "Test Subject",
+				TextBody:      "Test Text",
+				MessageStream: "outbound",
+				Metadata:      map[string]string{"mail_id": "1234"},
+			},
+			expectedClass: PostmarkMisconfigured,
+		},
+		{
+			name: "service unavailable - should be temporary",
+			mail: &models.Mail{
+				ID:      "1234",
+				From:    models.Email{Addr: "sender@domain.com"},
+				To:      []models.Email{{Addr: "recipient@domain.com"}},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			mockResponse: &PostmarkResponse{StatusCode: 503},
+			expectedMessage: &PostmarkMessage{
+				From:          "<sender@domain.com>",
+				To:            "<recipient@domain.com>",
+				Subject:       "Test Subject",
+				TextBody:      "Test Text",
+				MessageStream: "outbound",
+				Metadata:      map[string]string{"mail_id": "1234"},
+			},
+			expectedClass: PostmarkTemporary,
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockPostmarkClient{Response: tt.mockResponse}
+
+			provider := &PostmarkProvider{
+				Logger:        logger,
+				Client:        mockClient,
+				MessageStream: "outbound",
+			}
+
+			err := provider.SendMail(context.Background(), tt.mail)
+
+			assert.Equal(t, tt.expectedMessage, mockClient.CalledWith, "unexpected message")
+			if tt.expectedClass == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var postmarkErr *PostmarkError
+			if assert.ErrorAs(t, err, &postmarkErr, "unexpected error type %T", err) {
+				assert.Equal(t, tt.expectedClass, postmarkErr.Class(), "unexpected error class")
+				assert.Equal(t, postmarkErr.Kind(), ErrorKindOf(err), "unexpected error kind")
+			}
+		})
+	}
+}
+
+func TestPostmarkClient_Send(t *testing.T) {
+
+	var token string
+	var received PostmarkMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/email", r.URL.Path)
+		token = r.Header.Get("X-Postmark-Server-Token")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"ErrorCode": 300, "Message": "Invalid 'From' address."}`))
+	}))
+	defer server.Close()
+
+	client := NewPostmarkClient(PostmarkConfig{ServerToken: "server-token", BaseURL: server.URL + "/"})
+
+	resp, err := client.Send(context.Background(), &PostmarkMessage{From: "sender", To: "recipient@domain.com", Subject: "Test Subject", MessageStream: "outbound"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "server-token", token, "unexpected server token")
+	assert.Equal(t, PostmarkMessage{From: "sender", To: "recipient@domain.com", Subject: "Test Subject", MessageStream: "outbound"}, received)
+	assert.Equal(t, &PostmarkResponse{StatusCode: 422, ErrorCode: 300, Message: "Invalid 'From' address."}, resp)
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+)
+
+// ILegacyProvider is a provider written before sends took a context
+type ILegacyProvider interface {
+	SendMail(mail *models.Mail) error
+}
+
+// LegacyProvider adapts an ILegacyProvider to IProvider. A legacy send can not be interrupted, when ctx is
+// done first SendMail returns right away and the send is left to finish in the background, so a mail timed
+// out this way may still be delivered and then sent again on retry.
+type LegacyProvider struct {
+	Provider ILegacyProvider
+}
+
+func AdaptLegacyProvider(provider ILegacyProvider) *LegacyProvider {
+	return &LegacyProvider{Provider: provider}
+}
+
+// Name reports the adapted provider under its own name
+func (l *LegacyProvider) Name() string {
+	if named, ok := l.Provider.(INamedProvider); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", l.Provider)
+}
+
+func (l *LegacyProvider) SendMail(ctx context.Context, mail *models.Mail) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- l.Provider.SendMail(mail)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "legacy provider send abandoned")
+	}
+}
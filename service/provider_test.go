@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockBlockingProvider never finishes a send on its own, it only returns once ctx is done
+type MockBlockingProvider struct {
+	name    string
+	started chan struct{}
+}
+
+func (m *MockBlockingProvider) Name() string {
+	return m.name
+}
+
+func (m *MockBlockingProvider) SendMail(ctx context.Context, _ *models.Mail) error {
+	if m.started != nil {
+		m.started <- struct{}{}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// MockLegacyProvider implements the provider interface from before sends took a context
+type MockLegacyProvider struct {
+	Delay time.Duration
+	Error error
+}
+
+func (m *MockLegacyProvider) Name() string {
+	return "legacy"
+}
+
+func (m *MockLegacyProvider) SendMail(_ *models.Mail) error {
+	time.Sleep(m.Delay)
+	return m.Error
+}
+
+func TestLegacyProvider_SendMail(t *testing.T) {
+	tests := []struct {
+		name          string
+		provider      *MockLegacyProvider
+		timeout       time.Duration
+		expectedError error
+	}{
+		{
+			name:     "send within timeout - should succeed",
+			provider: &MockLegacyProvider{},
+			timeout:  time.Second,
+		},
+		{
+			name:          "send failed - should return the provider error",
+			provider:      &MockLegacyProvider{Error: errors.New("error sending email")},
+			timeout:       time.Second,
+			expectedError: errors.New("error sending email"),
+		},
+		{
+			name:          "send too slow - should give up at the deadline",
+			provider:      &MockLegacyProvider{Delay: time.Second},
+			timeout:       10 * time.Millisecond,
+			expectedError: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapted := AdaptLegacyProvider(tt.provider)
+			assert.Equal(t, "legacy", providerName(adapted), "adapter hides the provider name")
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			err := adapted.SendMail(ctx, &models.Mail{ID: "1234"})
+
+			switch {
+			case tt.expectedError == nil:
+				assert.NoError(t, err)
+			case errors.Is(tt.expectedError, context.DeadlineExceeded):
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			default:
+				assert.EqualError(t, err, tt.expectedError.Error())
+			}
+		})
+	}
+}
+
+func TestService_ProviderTimeout(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	fallback := &MockNamedProvider{name: "fallback"}
+
+	s, err := NewService(Config{
+		Timeout:  time.Hour,
+		Timeouts: map[string]time.Duration{"slow": 20 * time.Millisecond},
+	}, []IProvider{&MockBlockingProvider{name: "slow"}, fallback}, logger)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "1234"}))
+	time.Sleep(200 * time.Millisecond)
+	s.Quit()
+
+	status, err := s.Status("1234")
+	assert.NoError(t, err)
+	assert.Equal(t, models.MailSent, status.State, "mail not sent by the fallback provider")
+	assert.Equal(t, "fallback", status.Provider)
+	assert.Equal(t, context.DeadlineExceeded.Error(), status.Attempts[0].Error)
+}
+
+func TestService_QuitInterruptsSend(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	provider := &MockBlockingProvider{name: "hung", started: make(chan struct{}, 1)}
+
+	s, err := NewService(Config{}, []IProvider{provider}, logger)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "1234"}))
+
+	select {
+	case <-provider.started:
+	case <-time.After(time.Second):
+		t.Fatal("send never started")
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		s.Quit()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("quit did not interrupt the hung send")
+	}
+
+	// interrupted mail stays queued for the next start
+	time.Sleep(50 * time.Millisecond)
+	pending, err := s.Store.Load()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1, "interrupted mail was dropped")
+	assert.Equal(t, 0, pending[0].Attempts, "interrupted send counted as an attempt")
+
+	status, err := s.Status("1234")
+	assert.NoError(t, err)
+	assert.Equal(t, models.MailQueued, status.State)
+}
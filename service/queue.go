@@ -0,0 +1,190 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// ErrMailExists is returned for mail given the ID of a mail already queued, dead lettered or tracked, mail IDs
+// are shared by every app
+var ErrMailExists = errors.New("a mail with the same id exists")
+
+// ErrQueueFull is returned for mail queued while the mailing queue is full, mail is refused rather than left
+// waiting for a sender
+var ErrQueueFull = errors.New("mailing queue is full")
+
+// Delivery is a queued mail along with its delivery attempts
+type Delivery struct {
+	Mail        *models.Mail `json:"mail"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	LastError   string       `json:"last_error,omitempty"`
+}
+
+// IQueueStore persists accepted mail until it is delivered, so it can be replayed after a restart
+type IQueueStore interface {
+	Save(delivery *Delivery) error
+	Get(id string) (*Delivery, error)
+	Delete(id string) error
+	Load() ([]*Delivery, error)
+}
+
+type QueueConfig struct {
+	Backend       string `json:"backend" default:"file"`
+	Dir           string `json:"dir" default:"/var/lib/dream-mail-go/queue"`
+	DeadLetterDir string `json:"dead_letter_dir" default:"/var/lib/dream-mail-go/dead-letter"`
+	Size          int    `json:"size" default:"100"`
+}
+
+// NewQueueStore builds the queue backend selected in the config
+func NewQueueStore(cfg QueueConfig) (IQueueStore, error) {
+	return newStore(cfg.Backend, cfg.Dir)
+}
+
+// NewDeadLetterStore builds the store for mail that exhausted its delivery attempts, it uses the same
+// backend as the queue
+func NewDeadLetterStore(cfg QueueConfig) (IQueueStore, error) {
+	dir := cfg.DeadLetterDir
+	if dir == "" {
+		dir = filepath.Join(cfg.Dir, "dead-letter")
+	}
+	return newStore(cfg.Backend, dir)
+}
+
+func newStore(backend, dir string) (IQueueStore, error) {
+	switch backend {
+	case "", "memory":
+		return NewMemoryQueueStore(), nil
+	case "file":
+		return NewFileQueueStore(dir)
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown queue backend: %s", backend))
+	}
+}
+
+// MemoryQueueStore keeps queued mail in memory only, nothing survives a restart
+type MemoryQueueStore struct {
+	mu    sync.Mutex
+	seq   int
+	mails map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	seq      int
+	delivery *Delivery
+}
+
+func NewMemoryQueueStore() *MemoryQueueStore {
+	return &MemoryQueueStore{
+		mails: make(map[string]memoryEntry),
+	}
+}
+
+func (m *MemoryQueueStore) Save(delivery *Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seq++
+	m.mails[delivery.Mail.ID] = memoryEntry{seq: m.seq, delivery: delivery}
+	return nil
+}
+
+func (m *MemoryQueueStore) Get(id string) (*Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.mails[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return entry.delivery, nil
+}
+
+func (m *MemoryQueueStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.mails, id)
+	return nil
+}
+
+func (m *MemoryQueueStore) Load() ([]*Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]memoryEntry, 0, len(m.mails))
+	for _, entry := range m.mails {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	deliveries := make([]*Delivery, 0, len(entries))
+	for _, entry := range entries {
+		deliveries = append(deliveries, entry.delivery)
+	}
+	return deliveries, nil
+}
+
+// FileQueueStore keeps one file per queued mail in a directory
+type FileQueueStore struct {
+	Dir string
+}
+
+func NewFileQueueStore(dir string) (*FileQueueStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "unable to create queue directory")
+	}
+	return &FileQueueStore{Dir: dir}, nil
+}
+
+func (f *FileQueueStore) Save(delivery *Delivery) error {
+	return f.files().write(delivery.Mail.ID, delivery)
+}
+
+func (f *FileQueueStore) Get(id string) (*Delivery, error) {
+	var delivery Delivery
+	if err := f.files().read(id, &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (f *FileQueueStore) Delete(id string) error {
+	return f.files().remove(id)
+}
+
+// Load returns every stored mail, oldest first
+func (f *FileQueueStore) Load() ([]*Delivery, error) {
+
+	files, err := f.files().readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]*Delivery, 0, len(files))
+	for _, data := range files {
+		var delivery Delivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			return nil, errors.Wrap(err, "corrupted queue file")
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	return deliveries, nil
+}
+
+func (f *FileQueueStore) path(id string) string {
+	return f.files().path(id)
+}
+
+func (f *FileQueueStore) files() jsonDir {
+	return jsonDir{Dir: f.Dir, Ext: ".mail"}
+}
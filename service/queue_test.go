@@ -0,0 +1,138 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileQueueStore(t *testing.T) {
+	tests := []struct {
+		name     string
+		save     []*Delivery
+		delete   []string
+		expected []*Delivery
+	}{
+		{
+			name: "save and load - should return mail oldest first",
+			save: []*Delivery{
+				{Mail: &models.Mail{ID: "1", Subject: "Test email 1"}},
+				{Mail: &models.Mail{ID: "2", Subject: "Test email 2"}, Attempts: 1, LastError: "error sending email"},
+			},
+			expected: []*Delivery{
+				{Mail: &models.Mail{ID: "1", Subject: "Test email 1"}},
+				{Mail: &models.Mail{ID: "2", Subject: "Test email 2"}, Attempts: 1, LastError: "error sending email"},
+			},
+		},
+		{
+			name: "save and delete - should not return delivered mail",
+			save: []*Delivery{
+				{Mail: &models.Mail{ID: "1", Subject: "Test email 1"}},
+				{Mail: &models.Mail{ID: "2", Subject: "Test email 2"}, Attempts: 1, LastError: "error sending email"},
+			},
+			delete: []string{"1"},
+			expected: []*Delivery{
+				{Mail: &models.Mail{ID: "2", Subject: "Test email 2"}, Attempts: 1, LastError: "error sending email"},
+			},
+		},
+		{
+			name: "save with unsafe id - should stay inside queue directory",
+			save: []*Delivery{
+				{Mail: &models.Mail{ID: "../../escape", Subject: "Test email 1"}},
+			},
+			expected: []*Delivery{
+				{Mail: &models.Mail{ID: "../../escape", Subject: "Test email 1"}},
+			},
+		},
+		{
+			name:     "delete unknown mail - should not fail",
+			delete:   []string{"unknown"},
+			expected: []*Delivery{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "queue")
+
+			store, err := NewFileQueueStore(dir)
+			assert.NoError(t, err)
+
+			for i, delivery := range tt.save {
+				assert.NoError(t, store.Save(delivery))
+				// mtime resolution may be coarse, make the order explicit
+				mtime := time.Now().Add(time.Duration(i) * time.Second)
+				assert.NoError(t, os.Chtimes(store.path(delivery.Mail.ID), mtime, mtime))
+			}
+
+			for _, id := range tt.delete {
+				assert.NoError(t, store.Delete(id))
+			}
+
+			// a new store on the same directory sees what survived
+			reopened, err := NewFileQueueStore(dir)
+			assert.NoError(t, err)
+
+			deliveries, err := reopened.Load()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, deliveries, "unexpected queued mail")
+
+			for _, delivery := range tt.expected {
+				stored, err := reopened.Get(delivery.Mail.ID)
+				assert.NoError(t, err)
+				assert.Equal(t, delivery, stored, "unexpected stored mail")
+			}
+
+			entries, err := os.ReadDir(filepath.Dir(dir))
+			assert.NoError(t, err)
+			assert.Len(t, entries, 1, "queue files written outside queue directory")
+		})
+	}
+}
+
+func TestService_ReplayQueuedMail(t *testing.T) {
+
+	dir := t.TempDir()
+	mail := &models.Mail{
+		ID: "1234",
+		From: models.Email{
+			Addr: "sender@domain.com",
+		},
+		To: []models.Email{
+			{
+				Addr: "recipient@domain.com",
+			},
+		},
+		Subject: "Test email 1",
+		Text:    "This is a test email 1",
+	}
+
+	// mail accepted by a previous run that never got delivered
+	store, err := NewFileQueueStore(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Save(&Delivery{Mail: mail}))
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	provider := &MockProvider{}
+	s, err := NewService(Config{Queue: QueueConfig{Backend: "file", Dir: dir}}, []IProvider{provider}, logger)
+	assert.NoError(t, err)
+
+	time.Sleep(1 * time.Second)
+	s.Quit()
+
+	assert.Equal(t, []*models.Mail{mail}, provider.CalledWith, "queued mail was not replayed")
+
+	pending, err := store.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, pending, "delivered mail was not removed from queue")
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+	"os"
+	"sync"
+)
+
+// IProviderStore keeps the provider records the chain is built from, in chain order
+type IProviderStore interface {
+	List() ([]*models.Provider, error)
+	Get(id int) (*models.Provider, error)
+	// Save creates the record when its ID is 0, giving it the next free ID and putting it last, or else
+	// replaces the record with its ID in place
+	Save(record *models.Provider) error
+	Delete(id int) error
+}
+
+type MemoryProviderStore struct {
+	mu      sync.RWMutex
+	records []models.Provider
+}
+
+func NewMemoryProviderStore(records []models.Provider) *MemoryProviderStore {
+	return &MemoryProviderStore{records: numberRecords(records)}
+}
+
+func (m *MemoryProviderStore) List() ([]*models.Provider, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return listRecords(m.records), nil
+}
+
+func (m *MemoryProviderStore) Get(id int) (*models.Provider, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return getRecord(m.records, id)
+}
+
+func (m *MemoryProviderStore) Save(record *models.Provider) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = saveRecord(m.records, record)
+	return nil
+}
+
+func (m *MemoryProviderStore) Delete(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records, err := deleteRecord(m.records, id)
+	if err != nil {
+		return err
+	}
+	m.records = records
+	return nil
+}
+
+// FileProviderStore keeps the provider records in a JSON file, read again on every call so changes made to
+// the file by hand are picked up
+type FileProviderStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewFileProviderStore(path string) *FileProviderStore {
+	return &FileProviderStore{Path: path}
+}
+
+func (f *FileProviderStore) List() ([]*models.Provider, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return listRecords(records), nil
+}
+
+func (f *FileProviderStore) Get(id int) (*models.Provider, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return getRecord(records, id)
+}
+
+func (f *FileProviderStore) Save(record *models.Provider) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	id := record.ID
+	if err := writeJSONFile(f.Path, saveRecord(records, record)); err != nil {
+		record.ID = id
+		return err
+	}
+	return nil
+}
+
+func (f *FileProviderStore) Delete(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return err
+	}
+	if records, err = deleteRecord(records, id); err != nil {
+		return err
+	}
+	return writeJSONFile(f.Path, records)
+}
+
+// read loads the records of the file, a missing file has none
+func (f *FileProviderStore) read() ([]models.Provider, error) {
+	records, err := ReadProviderRecords(f.Path)
+	if err != nil && os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return numberRecords(records), nil
+}
+
+// numberRecords gives the records without an ID the next free ones, in order
+func numberRecords(records []models.Provider) []models.Provider {
+	numbered := make([]models.Provider, len(records))
+	copy(numbered, records)
+
+	last := 0
+	for _, record := range numbered {
+		if record.ID > last {
+			last = record.ID
+		}
+	}
+	for i := range numbered {
+		if numbered[i].ID == 0 {
+			last++
+			numbered[i].ID = last
+		}
+	}
+	return numbered
+}
+
+func listRecords(records []models.Provider) []*models.Provider {
+	listed := make([]*models.Provider, 0, len(records))
+	for i := range records {
+		record := records[i]
+		listed = append(listed, &record)
+	}
+	return listed
+}
+
+func getRecord(records []models.Provider, id int) (*models.Provider, error) {
+	for _, record := range records {
+		if record.ID == id {
+			return &record, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func saveRecord(records []models.Provider, record *models.Provider) []models.Provider {
+	saved := make([]models.Provider, len(records), len(records)+1)
+	copy(saved, records)
+
+	if record.ID != 0 {
+		for i := range saved {
+			if saved[i].ID == record.ID {
+				saved[i] = *record
+				return saved
+			}
+		}
+	} else {
+		for _, current := range saved {
+			if current.ID > record.ID {
+				record.ID = current.ID
+			}
+		}
+		record.ID++
+	}
+	return append(saved, *record)
+}
+
+func deleteRecord(records []models.Provider, id int) ([]models.Provider, error) {
+	for i := range records {
+		if records[i].ID == id {
+			kept := make([]models.Provider, 0, len(records)-1)
+			kept = append(kept, records[:i]...)
+			return append(kept, records[i+1:]...), nil
+		}
+	}
+	return nil, ErrNotFound
+}
@@ -0,0 +1,400 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/dkim"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProviderDeps is what a provider gets from the service besides its own config
+type ProviderDeps struct {
+	Logger *log.Logger
+	// Signer signs the raw messages of providers that build them, it is nil when signing is disabled
+	Signer IMessageSigner
+}
+
+// ProviderFactory builds a provider from the JSON config of a models.Provider record
+type ProviderFactory func(config json.RawMessage, deps ProviderDeps) (IProvider, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider makes a provider type available to BuildProvider under name, providers from other packages
+// register themselves from an init function. Like sql.Register it panics when name is taken.
+func RegisterProvider(name string, factory ProviderFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("service: provider factory is nil")
+	}
+	if _, taken := factories[name]; taken {
+		panic("service: provider registered twice " + name)
+	}
+	factories[name] = factory
+}
+
+// ProviderTypes lists the names of the registered provider types, sorted
+func ProviderTypes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BuildProvider builds a provider from its record with the factory registered under the record type
+func BuildProvider(record *models.Provider, deps ProviderDeps) (IProvider, error) {
+	name := recordType(record)
+
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown provider type %s", name))
+	}
+
+	provider, err := factory(record.Config, deps)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to build provider %s", record.Name))
+	}
+	return provider, nil
+}
+
+// recordType is the provider type of the record, records without one are named after their type
+func recordType(record *models.Provider) string {
+	if record.Type != "" {
+		return record.Type
+	}
+	return record.Name
+}
+
+// RecordProvider is a provider built from a record. It goes by the name of the record whatever the provider
+// calls itself, so records of the same type, such as two accounts of one provider, stay apart.
+type RecordProvider struct {
+	Provider IProvider
+	RecordID int
+	Record   string
+}
+
+// Name reports the provider under the name of its record
+func (r *RecordProvider) Name() string {
+	return r.Record
+}
+
+func (r *RecordProvider) SendMail(ctx context.Context, mail *models.Mail) error {
+	return r.Provider.SendMail(ctx, mail)
+}
+
+// buildRecord builds the provider of the record and names it after the record
+func buildRecord(record *models.Provider, deps ProviderDeps) (*RecordProvider, error) {
+	if record.Name == "" {
+		return nil, errors.New("provider record without a name")
+	}
+
+	provider, err := BuildProvider(record, ProviderDeps{Logger: deps.Logger.C("provider", record.Name), Signer: deps.Signer})
+	if err != nil {
+		return nil, err
+	}
+	return &RecordProvider{Provider: provider, RecordID: record.ID, Record: record.Name}, nil
+}
+
+// BuildProviders builds the providers of the records in order, failing with every record that could not be
+// built. Record names must be unique, every provider goes by the name of its record.
+func BuildProviders(records []models.Provider, deps ProviderDeps) ([]IProvider, error) {
+
+	var providers []IProvider
+	var problems []string
+	seen := make(map[string]bool)
+	for i := range records {
+		if seen[records[i].Name] {
+			problems = append(problems, fmt.Sprintf("provider %s listed twice", records[i].Name))
+			continue
+		}
+		seen[records[i].Name] = true
+
+		provider, err := buildRecord(&records[i], deps)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		providers = append(providers, provider)
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New(fmt.Sprintf("misconfigured providers: %s", strings.Join(problems, "; ")))
+	}
+	if len(providers) == 0 {
+		return nil, errors.New("no provider configured")
+	}
+
+	return providers, nil
+}
+
+// ReadProviderRecords reads a JSON array of provider records from a file
+func ReadProviderRecords(path string) ([]models.Provider, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read provider records")
+	}
+
+	var records []models.Provider
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, errors.Wrap(err, "invalid provider records")
+	}
+	return records, nil
+}
+
+func init() {
+	for _, t := range providerTypes {
+		RegisterProvider(t.name, t.factory)
+	}
+}
+
+// setting is a config value a provider needs
+type setting struct {
+	name string
+	set  bool
+}
+
+// providerType is a built-in provider: the settings it cannot do without and how to build it, either from the
+// service config or from the JSON config of a provider record
+type providerType struct {
+	name     string
+	required func(cfg Config) []setting
+	// decode reads the JSON config of a provider record into its section of cfg, defaults included
+	decode func(config json.RawMessage, cfg *Config) error
+	build  func(cfg Config, signer IMessageSigner, logger *log.Logger) (IProvider, error)
+}
+
+// providerTypes are the built-in providers, in the default failover order
+var providerTypes = []providerType{
+	{
+		name: "ses",
+		required: func(cfg Config) []setting {
+			return []setting{{"region", cfg.SES.Region != ""}}
+		},
+		decode: func(config json.RawMessage, cfg *Config) error {
+			return json.Unmarshal(config, &cfg.SES)
+		},
+		build: func(cfg Config, signer IMessageSigner, logger *log.Logger) (IProvider, error) {
+			provider, err := NewSESProvider(cfg.SES, logger)
+			if err != nil {
+				return nil, err
+			}
+			provider.Signer = signer
+			return provider, nil
+		},
+	},
+	{
+		name: "sparkpost",
+		required: func(cfg Config) []setting {
+			return []setting{{"api_key", cfg.Sparkpost.ApiKey != ""}}
+		},
+		decode: func(config json.RawMessage, cfg *Config) error {
+			// the client config has no json tags of its own
+			var sparkpost struct {
+				ApiKey  string `json:"api_key"`
+				BaseUrl string `json:"base_url"`
+			}
+			if err := json.Unmarshal(config, &sparkpost); err != nil {
+				return err
+			}
+			cfg.Sparkpost.ApiKey = sparkpost.ApiKey
+			cfg.Sparkpost.BaseUrl = sparkpost.BaseUrl
+			return nil
+		},
+		build: func(cfg Config, _ IMessageSigner, logger *log.Logger) (IProvider, error) {
+			return NewSparkpostProvider(cfg.Sparkpost, logger)
+		},
+	},
+	{
+		name: "sendgrid",
+		required: func(cfg Config) []setting {
+			return []setting{{"api_key", cfg.Sendgrid.ApiKey != ""}}
+		},
+		decode: func(config json.RawMessage, cfg *Config) error {
+			return json.Unmarshal(config, &cfg.Sendgrid)
+		},
+		build: func(cfg Config, _ IMessageSigner, logger *log.Logger) (IProvider, error) {
+			return NewSendgridProvider(cfg.Sendgrid, logger), nil
+		},
+	},
+	{
+		name: "mailgun",
+		required: func(cfg Config) []setting {
+			return []setting{{"domain", cfg.Mailgun.Domain != ""}, {"api_key", cfg.Mailgun.ApiKey != ""}}
+		},
+		decode: func(config json.RawMessage, cfg *Config) error {
+			cfg.Mailgun = MailgunConfig{BaseURL: "https://api.mailgun.net/v3"}
+			return json.Unmarshal(config, &cfg.Mailgun)
+		},
+		build: func(cfg Config, _ IMessageSigner, logger *log.Logger) (IProvider, error) {
+			return NewMailgunProvider(cfg.Mailgun, logger), nil
+		},
+	},
+	{
+		name: "postmark",
+		required: func(cfg Config) []setting {
+			return []setting{{"server_token", cfg.Postmark.ServerToken != ""}}
+		},
+		decode: func(config json.RawMessage, cfg *Config) error {
+			cfg.Postmark = PostmarkConfig{MessageStream: "outbound", BaseURL: "https://api.postmarkapp.com"}
+			return json.Unmarshal(config, &cfg.Postmark)
+		},
+		build: func(cfg Config, _ IMessageSigner, logger *log.Logger) (IProvider, error) {
+			return NewPostmarkProvider(cfg.Postmark, logger), nil
+		},
+	},
+	{
+		name: "smtp",
+		required: func(cfg Config) []setting {
+			return []setting{{"host", cfg.SMTP.Host != ""}, {"port", cfg.SMTP.Port != ""}}
+		},
+		decode: func(config json.RawMessage, cfg *Config) error {
+			return json.Unmarshal(config, &cfg.SMTP)
+		},
+		build: func(cfg Config, signer IMessageSigner, logger *log.Logger) (IProvider, error) {
+			provider := NewSMTPProvider(cfg.SMTP, logger)
+			provider.Signer = signer
+			return provider, nil
+		},
+	},
+}
+
+// newSigner loads the DKIM keys, signing applies to the raw messages built for SES and SMTP for the domains a
+// key is configured for. Without keys mail is not signed.
+func newSigner(cfg Config) (IMessageSigner, error) {
+	if len(cfg.DKIM.Keys) == 0 {
+		return nil, nil
+	}
+	signer, err := dkim.NewSigner(cfg.DKIM)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load dkim keys")
+	}
+	return signer, nil
+}
+
+// factory builds the provider from the JSON config of a record, failing when required settings are missing
+func (t providerType) factory(config json.RawMessage, deps ProviderDeps) (IProvider, error) {
+
+	if len(config) == 0 {
+		config = json.RawMessage("{}")
+	}
+
+	var cfg Config
+	if err := t.decode(config, &cfg); err != nil {
+		return nil, errors.Wrap(err, "invalid config")
+	}
+
+	if missing, _ := t.missing(cfg); len(missing) > 0 {
+		return nil, errors.New(fmt.Sprintf("missing %s", strings.Join(missing, ", ")))
+	}
+
+	return t.build(cfg, deps.Signer, deps.Logger)
+}
+
+// missing lists the required settings left empty, a provider with none of them set is not configured at all
+func (t providerType) missing(cfg Config) (missing []string, configured bool) {
+	for _, s := range t.required(cfg) {
+		if s.set {
+			configured = true
+			continue
+		}
+		missing = append(missing, s.name)
+	}
+	return missing, configured
+}
+
+// NewProviders builds the provider chain from the config. The chain is cfg.Providers in order, or else every
+// built-in provider with some of its settings given. Providers missing required settings make it fail with
+// all the misconfigurations found. With cfg.ProvidersFile there is nothing to build, the service builds its
+// providers from the file.
+func NewProviders(cfg Config, logger *log.Logger) ([]IProvider, error) {
+
+	if cfg.ProvidersFile != "" {
+		return nil, nil
+	}
+
+	types := make(map[string]providerType)
+	for _, t := range providerTypes {
+		types[t.name] = t
+	}
+
+	var problems []string
+	var chain []providerType
+
+	if len(cfg.Providers) > 0 {
+		seen := make(map[string]bool)
+		for _, name := range cfg.Providers {
+			t, ok := types[name]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("unknown provider %s", name))
+				continue
+			case seen[name]:
+				problems = append(problems, fmt.Sprintf("provider %s listed twice", name))
+				continue
+			}
+			seen[name] = true
+
+			if missing, _ := t.missing(cfg); len(missing) > 0 {
+				problems = append(problems, fmt.Sprintf("%s missing %s", name, strings.Join(missing, ", ")))
+				continue
+			}
+			chain = append(chain, t)
+		}
+	} else {
+		for _, t := range providerTypes {
+			missing, configured := t.missing(cfg)
+			if !configured {
+				continue
+			}
+			if len(missing) > 0 {
+				problems = append(problems, fmt.Sprintf("%s missing %s", t.name, strings.Join(missing, ", ")))
+				continue
+			}
+			chain = append(chain, t)
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New(fmt.Sprintf("misconfigured providers: %s", strings.Join(problems, "; ")))
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("no provider configured")
+	}
+
+	signer, err := newSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []IProvider
+	for _, t := range chain {
+		provider, err := t.build(cfg, signer, logger.C("provider", t.name))
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("unable to build provider %s", t.name))
+		}
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
@@ -0,0 +1,328 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	sp "github.com/SparkPost/gosparkpost"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProviders(t *testing.T) {
+
+	configured := Config{
+		SES:       SESConfig{Region: "us-west-2"},
+		Sparkpost: sp.Config{ApiKey: "sp-key"},
+		Sendgrid:  SendgridConfig{ApiKey: "sg-key"},
+		Mailgun:   MailgunConfig{Domain: "mg.domain.com", ApiKey: "mg-key", BaseURL: "https://api.mailgun.net/v3"},
+		Postmark:  PostmarkConfig{ServerToken: "pm-token", MessageStream: "outbound", BaseURL: "https://api.postmarkapp.com"},
+		SMTP:      SMTPConfig{Host: "smtp.domain.com", Port: "587"},
+	}
+
+	tests := []struct {
+		name          string
+		cfg           func(cfg Config) Config
+		expected      []string
+		expectedError string
+	}{
+		{
+			name:     "every provider configured - should build them in the default order",
+			cfg:      func(cfg Config) Config { return cfg },
+			expected: []string{"ses", "sparkpost", "sendgrid", "mailgun", "postmark", "smtp"},
+		},
+		{
+			name: "providers left unconfigured - should skip them",
+			cfg: func(cfg Config) Config {
+				return Config{Sendgrid: cfg.Sendgrid, SMTP: cfg.SMTP, Postmark: PostmarkConfig{MessageStream: "outbound"}}
+			},
+			expected: []string{"sendgrid", "smtp"},
+		},
+		{
+			name: "chain given - should build it in order",
+			cfg: func(cfg Config) Config {
+				cfg.Providers = []string{"smtp", "sendgrid"}
+				return cfg
+			},
+			expected: []string{"smtp", "sendgrid"},
+		},
+		{
+			name: "chain given with unconfigured providers - should list every misconfiguration",
+			cfg: func(cfg Config) Config {
+				return Config{Providers: []string{"smtp", "mailgun", "ses", "mandrill", "smtp"}, SMTP: cfg.SMTP, Mailgun: MailgunConfig{Domain: "mg.domain.com"}}
+			},
+			expectedError: "misconfigured providers: mailgun missing api_key; ses missing region; unknown provider mandrill; provider smtp listed twice",
+		},
+		{
+			name: "provider partly configured - should fail",
+			cfg: func(cfg Config) Config {
+				return Config{Sendgrid: cfg.Sendgrid, SMTP: SMTPConfig{User: "user", Port: "587"}}
+			},
+			expectedError: "misconfigured providers: smtp missing host",
+		},
+		{
+			name:          "nothing configured - should fail",
+			cfg:           func(cfg Config) Config { return Config{} },
+			expectedError: "no provider configured",
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providers, err := NewProviders(tt.cfg(configured), logger)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+
+			var names []string
+			for _, provider := range providers {
+				names = append(names, providerName(provider))
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestProviderConstructors(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	_, err := NewSESProvider(SESConfig{}, logger)
+	assert.EqualError(t, err, "missing ses region")
+
+	_, err = NewSparkpostProvider(sp.Config{}, logger)
+	assert.EqualError(t, err, "missing sparkpost api key")
+
+	_, err = NewSparkpostProvider(sp.Config{ApiKey: "sp-key", BaseUrl: "http://api.sparkpost.com"}, logger)
+	assert.EqualError(t, err, "sparkpost client init failed: API base url must be https!")
+
+	assert.Nil(t, NewSMTPProvider(SMTPConfig{Host: "smtp.domain.com", Port: "25"}, logger).Auth, "auth set without a user")
+	assert.NotNil(t, NewSMTPProvider(SMTPConfig{Host: "smtp.domain.com", Port: "587", User: "user", Pass: "pass"}, logger).Auth)
+}
+
+// MockFactoryProvider is a third-party provider type, registered the way other packages would
+type MockFactoryProvider struct {
+	MockProvider
+	Config struct {
+		Name string `json:"name"`
+	}
+}
+
+func (m *MockFactoryProvider) Name() string {
+	return m.Config.Name
+}
+
+func init() {
+	RegisterProvider("mock", func(config json.RawMessage, _ ProviderDeps) (IProvider, error) {
+		provider := &MockFactoryProvider{}
+		if err := json.Unmarshal(config, &provider.Config); err != nil {
+			return nil, err
+		}
+		if provider.Config.Name == "" {
+			return nil, errors.New("missing name")
+		}
+		return provider, nil
+	})
+}
+
+// MockAnonymousProvider is a third-party provider type without a name of its own
+type MockAnonymousProvider struct {
+	MockProvider
+}
+
+func init() {
+	RegisterProvider("anonymous", func(json.RawMessage, ProviderDeps) (IProvider, error) {
+		return &MockAnonymousProvider{}, nil
+	})
+}
+
+func TestBuildProviders_NamedAfterRecords(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	cfg := Config{
+		Workers:  1,
+		Routing:  RoutingConfig{Rules: RoutingRules{{Name: "acme", Tags: []string{"acme"}, Providers: []string{"acme"}}}},
+		Timeouts: map[string]time.Duration{"acme": time.Second},
+	}
+	providers, err := BuildProviders([]models.Provider{
+		{ID: 1, Name: "acme", Type: "anonymous"},
+		{ID: 2, Name: "custom", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+	}, ProviderDeps{Logger: logger})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"acme", "custom"}, providerNames(providers))
+
+	// routing, timeouts and statuses refer to the provider by the name of its record
+	s, err := NewService(cfg, providers, logger)
+	assert.NoError(t, err)
+	defer s.Quit()
+
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "1234", Tags: []string{"acme"}}))
+	time.Sleep(50 * time.Millisecond)
+
+	status, err := s.Status("1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", status.Provider)
+	assert.Equal(t, 1, providers[0].(*RecordProvider).Provider.(*MockAnonymousProvider).CallCount)
+}
+
+func TestBuildProvider(t *testing.T) {
+	tests := []struct {
+		name          string
+		record        models.Provider
+		expectedName  string
+		expectedError string
+	}{
+		{
+			name:         "built-in provider - should build from its json config",
+			record:       models.Provider{Name: "smtp", Config: json.RawMessage(`{"host": "smtp.domain.com", "port": "587"}`)},
+			expectedName: "smtp",
+		},
+		{
+			name:         "registered provider - should build with its factory",
+			record:       models.Provider{Name: "mock", Config: json.RawMessage(`{"name": "custom"}`)},
+			expectedName: "custom",
+		},
+		{
+			name:          "missing settings - should fail",
+			record:        models.Provider{Name: "mailgun", Config: json.RawMessage(`{"domain": "mg.domain.com"}`)},
+			expectedError: "unable to build provider mailgun: missing api_key",
+		},
+		{
+			name:          "no config - should fail",
+			record:        models.Provider{Name: "sendgrid"},
+			expectedError: "unable to build provider sendgrid: missing api_key",
+		},
+		{
+			name:          "invalid config - should fail",
+			record:        models.Provider{Name: "ses", Config: json.RawMessage(`{"region": 1}`)},
+			expectedError: "unable to build provider ses: invalid config: json: cannot unmarshal number into Go struct field SESConfig.region of type string",
+		},
+		{
+			name:         "typed record - should build with the factory of its type",
+			record:       models.Provider{Name: "billing", Type: "mock", Config: json.RawMessage(`{"name": "custom"}`)},
+			expectedName: "custom",
+		},
+		{
+			name:          "unknown type - should fail",
+			record:        models.Provider{Name: "mandrill"},
+			expectedError: "unknown provider type mandrill",
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := BuildProvider(&tt.record, ProviderDeps{Logger: logger})
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedName, providerName(provider))
+		})
+	}
+}
+
+func TestBuildProvider_Defaults(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	provider, err := BuildProvider(&models.Provider{Name: "postmark", Config: json.RawMessage(`{"server_token": "pm-token"}`)}, ProviderDeps{Logger: logger})
+	assert.NoError(t, err)
+
+	postmark := provider.(*PostmarkProvider)
+	assert.Equal(t, "outbound", postmark.MessageStream)
+	assert.Equal(t, "https://api.postmarkapp.com", postmark.Client.(*PostmarkClient).BaseURL)
+}
+
+func TestRegisterProvider_Twice(t *testing.T) {
+	assert.Panics(t, func() {
+		RegisterProvider("smtp", func(json.RawMessage, ProviderDeps) (IProvider, error) { return nil, nil })
+	})
+	assert.Contains(t, ProviderTypes(), "mock")
+}
+
+func TestService_ChangeProviders(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	first := &MockNamedProvider{name: "first"}
+
+	s, err := NewService(Config{
+		Workers: 1,
+		Routing: RoutingConfig{Rules: RoutingRules{{Name: "marketing", Tags: []string{"marketing"}, Providers: []string{"first"}}}},
+	}, []IProvider{first}, logger)
+	assert.NoError(t, err)
+	defer s.Quit()
+
+	records := []models.Provider{
+		{Name: "first", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+		{Name: "custom", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+	}
+
+	// providers are named after their records and rebuilt on every load
+	assert.NoError(t, s.LoadProviders(records))
+	assert.Equal(t, []string{"first", "custom"}, providerNames(s.Providers()))
+
+	added := s.Providers()[1]
+	assert.NoError(t, s.LoadProviders(records))
+	assert.NotSame(t, added, s.Providers()[1], "provider not rebuilt")
+
+	// providers named by routing rules cannot be left out
+	assert.EqualError(t, s.LoadProviders(records[1:]), "invalid routing: invalid routing rule marketing: unknown provider first")
+	assert.Equal(t, []string{"first", "custom"}, providerNames(s.Providers()), "chain changed by a failed update")
+
+	// mail goes through the current chain
+	assert.NoError(t, s.LoadProviders([]models.Provider{records[1], records[0]}))
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "1234"}))
+	time.Sleep(50 * time.Millisecond)
+
+	status, err := s.Status("1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "custom", status.Provider)
+
+	assert.NoError(t, s.LoadProviders([]models.Provider{{Name: "first", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)}}))
+	assert.Equal(t, []string{"first"}, providerNames(s.Providers()))
+	assert.EqualError(t, s.LoadProviders([]models.Provider{{Name: "mandrill"}, {Name: "sendgrid"}}),
+		"misconfigured providers: unknown provider type mandrill; unable to build provider sendgrid: missing api_key")
+
+	// records of the same type need names of their own
+	assert.EqualError(t, s.LoadProviders([]models.Provider{
+		{Name: "first", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+		{Name: "first", Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+		{Type: "mock", Config: json.RawMessage(`{"name": "account"}`)},
+	}), "misconfigured providers: provider first listed twice; provider record without a name")
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type RetryConfig struct {
+	MaxAttempts int           `json:"max_attempts" default:"5"`
+	Backoff     time.Duration `json:"backoff" default:"30s"`
+	MaxBackoff  time.Duration `json:"max_backoff" default:"1h"`
+	Jitter      float64       `json:"jitter" default:"0.2"`
+}
+
+// withDefaults fills the gaps left by configs that did not go through envconfig
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = 30 * time.Second
+	}
+	if c.MaxBackoff < c.Backoff {
+		c.MaxBackoff = c.Backoff
+	}
+	if c.Jitter < 0 {
+		c.Jitter = 0
+	}
+	if c.Jitter > 1 {
+		c.Jitter = 1
+	}
+	return c
+}
+
+// backoff returns how long to wait before the next attempt of a mail that already failed `attempts` times.
+// The delay doubles on every attempt up to MaxBackoff and is spread by +/- Jitter so failed mail does not
+// come back in bursts.
+func (c RetryConfig) backoff(attempts int) time.Duration {
+	delay := float64(c.Backoff) * math.Pow(2, float64(attempts-1))
+	if delay > float64(c.MaxBackoff) {
+		delay = float64(c.MaxBackoff)
+	}
+
+	delay += delay * c.Jitter * (2*rand.Float64() - 1)
+
+	return time.Duration(delay)
+}
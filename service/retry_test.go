@@ -0,0 +1,149 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryConfig_Backoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      RetryConfig
+		attempts int
+		min      time.Duration
+		max      time.Duration
+	}{
+		{
+			name:     "first retry - should wait the base backoff",
+			cfg:      RetryConfig{Backoff: time.Second, MaxBackoff: time.Hour},
+			attempts: 1,
+			min:      time.Second,
+			max:      time.Second,
+		},
+		{
+			name:     "third retry - should double the backoff twice",
+			cfg:      RetryConfig{Backoff: time.Second, MaxBackoff: time.Hour},
+			attempts: 3,
+			min:      4 * time.Second,
+			max:      4 * time.Second,
+		},
+		{
+			name:     "many retries - should be capped by max backoff",
+			cfg:      RetryConfig{Backoff: time.Second, MaxBackoff: 10 * time.Second},
+			attempts: 20,
+			min:      10 * time.Second,
+			max:      10 * time.Second,
+		},
+		{
+			name:     "with jitter - should stay within the jitter range",
+			cfg:      RetryConfig{Backoff: time.Second, MaxBackoff: time.Hour, Jitter: 0.5},
+			attempts: 2,
+			min:      time.Second,
+			max:      3 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := tt.cfg.backoff(tt.attempts)
+				assert.GreaterOrEqual(t, delay, tt.min, "backoff too short")
+				assert.LessOrEqual(t, delay, tt.max, "backoff too long")
+			}
+		})
+	}
+}
+
+func TestService_RetryAndDeadLetter(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	mail := &models.Mail{
+		ID: "1234",
+		From: models.Email{
+			Addr: "sender@domain.com",
+		},
+		To: []models.Email{
+			{
+				Addr: "recipient@domain.com",
+			},
+		},
+		Subject: "Test email 1",
+		Text:    "This is a test email 1",
+	}
+
+	provider := &MockProvider{
+		CallsBeforeError: -1,
+		Error:            errors.New("error sending email"),
+	}
+
+	s, err := NewService(Config{
+		Retry: RetryConfig{MaxAttempts: 3, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond},
+	}, []IProvider{provider}, logger)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.QueueMail(mail))
+	time.Sleep(500 * time.Millisecond)
+
+	// every attempt failed, the mail must be dead lettered and gone from the queue
+	provider.mu.Lock()
+	assert.Equal(t, 3, provider.CallCount, "unexpected number of attempts")
+	provider.CallsBeforeError = 0
+	provider.mu.Unlock()
+
+	deadLetters, err := s.DeadLetters()
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 1, "mail was not dead lettered")
+
+	deadLetter, err := s.DeadLetter(mail.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, mail, deadLetter.Mail)
+	assert.Equal(t, 3, deadLetter.Attempts)
+	assert.Equal(t, "error sending email", deadLetter.LastError)
+
+	queued, err := s.Store.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, queued, "dead lettered mail still queued")
+
+	// the id of a dead lettered mail stays taken, only the mail itself can be requeued under it
+	assert.ErrorIs(t, s.QueueMail(&models.Mail{ID: mail.ID, App: "other", AppID: 2}), ErrMailExists)
+
+	// once the provider recovers a requeued mail is delivered, once however many times it is requeued
+	var wg sync.WaitGroup
+	var requeued int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Requeue(mail.ID); err == nil {
+				atomic.AddInt32(&requeued, 1)
+			} else {
+				assert.True(t, errors.Is(err, ErrNotFound) || errors.Is(err, ErrMailExists), "unexpected error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), requeued, "dead letter requeued more than once")
+	time.Sleep(100 * time.Millisecond)
+	s.Quit()
+
+	assert.Equal(t, 4, provider.CallCount, "requeued mail was not sent")
+
+	deadLetters, err = s.DeadLetters()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters, "requeued mail still dead lettered")
+
+	_, err = s.DeadLetter(mail.ID)
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+type RoutingConfig struct {
+	// Default is the provider chain of mail no rule matches, by provider name. Empty means every provider in
+	// the order they were given to the service.
+	Default []string `json:"default"`
+	// Rules are tried in order, the first rule matching a mail picks its provider chain
+	Rules RoutingRules `json:"rules"`
+}
+
+// RoutingRule picks the provider chain of the mail it matches. Every condition set must hold for the rule to
+// match, a rule without conditions matches any mail.
+type RoutingRule struct {
+	Name string `json:"name"`
+	// SenderDomains matches mail sent from any of the domains
+	SenderDomains []string `json:"sender_domains,omitempty"`
+	// RecipientDomains matches mail whose recipients, including copies, all belong to the domains
+	RecipientDomains []string `json:"recipient_domains,omitempty"`
+	// Tags matches mail carrying any of the tags
+	Tags []string `json:"tags,omitempty"`
+	// Apps matches mail sent by any of the apps
+	Apps []string `json:"apps,omitempty"`
+	// MinAttachmentSize and MaxAttachmentSize bound the decoded size of all attachments in bytes, 0 is unbounded
+	MinAttachmentSize int `json:"min_attachment_size,omitempty"`
+	MaxAttachmentSize int `json:"max_attachment_size,omitempty"`
+	// Providers is the chain the mail is sent through, by provider name, in failover order
+	Providers []string `json:"providers"`
+}
+
+// RoutingRules decodes from a JSON array, so rules can be given in a single environment variable
+type RoutingRules []RoutingRule
+
+func (r *RoutingRules) Decode(value string) error {
+	return json.Unmarshal([]byte(value), r)
+}
+
+func (r RoutingRule) matches(mail *models.Mail) bool {
+
+	if len(r.SenderDomains) > 0 && !containsFold(r.SenderDomains, domainOf(mail.From.Addr)) {
+		return false
+	}
+
+	if len(r.RecipientDomains) > 0 {
+		recipients := mail.Recipients()
+		if len(recipients) == 0 {
+			return false
+		}
+		for _, recipient := range recipients {
+			if !containsFold(r.RecipientDomains, domainOf(recipient)) {
+				return false
+			}
+		}
+	}
+
+	if len(r.Tags) > 0 {
+		tagged := false
+		for _, tag := range mail.Tags {
+			tagged = tagged || containsFold(r.Tags, tag)
+		}
+		if !tagged {
+			return false
+		}
+	}
+
+	if len(r.Apps) > 0 && !containsFold(r.Apps, mail.App) {
+		return false
+	}
+
+	if r.MinAttachmentSize > 0 || r.MaxAttachmentSize > 0 {
+		size := attachmentSize(mail)
+		if size < r.MinAttachmentSize {
+			return false
+		}
+		if r.MaxAttachmentSize > 0 && size > r.MaxAttachmentSize {
+			return false
+		}
+	}
+
+	return true
+}
+
+// route is a rule with its provider chain resolved
+type route struct {
+	name      string
+	rule      RoutingRule
+	providers []IProvider
+}
+
+// Router picks the provider chain of each mail with the first matching rule
+type Router struct {
+	routes       []route
+	defaultRoute route
+}
+
+// NewRouter resolves the provider names of the rules against the providers, naming an unknown provider is an error
+func NewRouter(cfg RoutingConfig, providers []IProvider) (*Router, error) {
+
+	byName := make(map[string]IProvider)
+	for _, provider := range providers {
+		byName[providerName(provider)] = provider
+	}
+
+	resolve := func(names []string) ([]IProvider, error) {
+		var chain []IProvider
+		for _, name := range names {
+			provider, ok := byName[name]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("unknown provider %s", name))
+			}
+			chain = append(chain, provider)
+		}
+		return chain, nil
+	}
+
+	router := &Router{defaultRoute: route{name: "default", providers: providers}}
+
+	if len(cfg.Default) > 0 {
+		chain, err := resolve(cfg.Default)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid default route")
+		}
+		router.defaultRoute.providers = chain
+	}
+
+	for i, rule := range cfg.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+		if len(rule.Providers) == 0 {
+			return nil, errors.New(fmt.Sprintf("routing rule %s has no providers", name))
+		}
+		chain, err := resolve(rule.Providers)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid routing rule %s", name))
+		}
+		router.routes = append(router.routes, route{name: name, rule: rule, providers: chain})
+	}
+
+	return router, nil
+}
+
+// Route returns the provider chain of the mail along with the name of the rule that picked it
+func (r *Router) Route(mail *models.Mail) (string, []IProvider) {
+	for _, route := range r.routes {
+		if route.rule.matches(mail) {
+			return route.name, route.providers
+		}
+	}
+	return r.defaultRoute.name, r.defaultRoute.providers
+}
+
+func domainOf(addr string) string {
+	return addr[strings.LastIndex(addr, "@")+1:]
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentSize is the decoded size of the base64 attachments of a mail, computed without decoding them
+func attachmentSize(mail *models.Mail) int {
+	size := 0
+	for _, attachment := range mail.Attachments {
+		data := strings.Join(strings.Fields(attachment.Data), "")
+		size += base64.StdEncoding.DecodedLen(len(data)) - strings.Count(data, "=")
+	}
+	return size
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_Route(t *testing.T) {
+
+	ses := &MockNamedProvider{name: "ses"}
+	sparkpost := &MockNamedProvider{name: "sparkpost"}
+	smtp := &MockNamedProvider{name: "smtp"}
+
+	rules := RoutingRules{
+		{Name: "marketing", Tags: []string{"marketing", "newsletter"}, Providers: []string{"sparkpost", "smtp"}},
+		{Name: "internal", RecipientDomains: []string{"corp.com"}, Providers: []string{"smtp"}},
+		{Name: "billing", SenderDomains: []string{"billing.com"}, Apps: []string{"invoices"}, Providers: []string{"ses"}},
+		{Name: "large", MinAttachmentSize: 1024, Providers: []string{"smtp"}},
+	}
+
+	attachment := func(size int) []models.Attachment {
+		return []models.Attachment{{Name: "file", Data: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", size)))}}
+	}
+
+	tests := []struct {
+		name              string
+		cfg               RoutingConfig
+		mail              *models.Mail
+		expectedRoute     string
+		expectedProviders []IProvider
+	}{
+		{
+			name:              "no rules - should use every provider in order",
+			mail:              &models.Mail{From: models.Email{Addr: "sender@domain.com"}},
+			expectedRoute:     "default",
+			expectedProviders: []IProvider{ses, sparkpost, smtp},
+		},
+		{
+			name:              "no rule matches - should use the default chain",
+			cfg:               RoutingConfig{Default: []string{"smtp", "ses"}, Rules: rules},
+			mail:              &models.Mail{From: models.Email{Addr: "sender@domain.com"}, To: []models.Email{{Addr: "recipient@domain.com"}}},
+			expectedRoute:     "default",
+			expectedProviders: []IProvider{smtp, ses},
+		},
+		{
+			name:              "tagged mail - should match the tag rule",
+			cfg:               RoutingConfig{Rules: rules},
+			mail:              &models.Mail{From: models.Email{Addr: "sender@domain.com"}, Tags: []string{"Newsletter"}},
+			expectedRoute:     "marketing",
+			expectedProviders: []IProvider{sparkpost, smtp},
+		},
+		{
+			name:              "every recipient in the domain - should match the recipient rule",
+			cfg:               RoutingConfig{Rules: rules},
+			mail:              &models.Mail{To: []models.Email{{Addr: "a@corp.com"}}, BCC: []models.Email{{Addr: "b@CORP.com"}}},
+			expectedRoute:     "internal",
+			expectedProviders: []IProvider{smtp},
+		},
+		{
+			name:              "one recipient outside the domain - should not match the recipient rule",
+			cfg:               RoutingConfig{Rules: rules},
+			mail:              &models.Mail{To: []models.Email{{Addr: "a@corp.com"}}, CC: []models.Email{{Addr: "b@domain.com"}}},
+			expectedRoute:     "default",
+			expectedProviders: []IProvider{ses, sparkpost, smtp},
+		},
+		{
+			name:              "sender domain and app - should match the rule with both",
+			cfg:               RoutingConfig{Rules: rules},
+			mail:              &models.Mail{From: models.Email{Addr: "noreply@billing.com"}, App: "invoices"},
+			expectedRoute:     "billing",
+			expectedProviders: []IProvider{ses},
+		},
+		{
+			name:              "sender domain of another app - should not match",
+			cfg:               RoutingConfig{Rules: rules},
+			mail:              &models.Mail{From: models.Email{Addr: "noreply@billing.com"}, App: "shop"},
+			expectedRoute:     "default",
+			expectedProviders: []IProvider{ses, sparkpost, smtp},
+		},
+		{
+			name:              "large attachments - should match the size rule",
+			cfg:               RoutingConfig{Rules: rules},
+			mail:              &models.Mail{Attachments: attachment(1024)},
+			expectedRoute:     "large",
+			expectedProviders: []IProvider{smtp},
+		},
+		{
+			name:              "small attachments - should not match the size rule",
+			cfg:               RoutingConfig{Rules: rules},
+			mail:              &models.Mail{Attachments: attachment(1023)},
+			expectedRoute:     "default",
+			expectedProviders: []IProvider{ses, sparkpost, smtp},
+		},
+		{
+			name:              "several rules match - should pick the first",
+			cfg:               RoutingConfig{Rules: rules},
+			mail:              &models.Mail{To: []models.Email{{Addr: "a@corp.com"}}, Tags: []string{"marketing"}},
+			expectedRoute:     "marketing",
+			expectedProviders: []IProvider{sparkpost, smtp},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, err := NewRouter(tt.cfg, []IProvider{ses, sparkpost, smtp})
+			assert.NoError(t, err)
+
+			route, providers := router.Route(tt.mail)
+			assert.Equal(t, tt.expectedRoute, route, "unexpected route")
+			assert.Equal(t, tt.expectedProviders, providers, "unexpected providers")
+		})
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	tests := []struct {
+		name          string
+		rules         string
+		defaultChain  []string
+		expectedError string
+	}{
+		{
+			name:  "valid rules - should build",
+			rules: `[{"name": "marketing", "tags": ["marketing"], "providers": ["sparkpost"]}]`,
+		},
+		{
+			name:          "unknown provider in a rule - should fail",
+			rules:         `[{"name": "marketing", "tags": ["marketing"], "providers": ["mandrill"]}]`,
+			expectedError: "invalid routing rule marketing: unknown provider mandrill",
+		},
+		{
+			name:          "rule without providers - should fail",
+			rules:         `[{"tags": ["marketing"]}]`,
+			expectedError: "routing rule rule 1 has no providers",
+		},
+		{
+			name:          "unknown provider in the default chain - should fail",
+			rules:         `[]`,
+			defaultChain:  []string{"sparkpost", "mandrill"},
+			expectedError: "invalid default route: unknown provider mandrill",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules RoutingRules
+			assert.NoError(t, rules.Decode(tt.rules))
+
+			_, err := NewRouter(RoutingConfig{Default: tt.defaultChain, Rules: rules}, []IProvider{&MockNamedProvider{name: "sparkpost"}})
+			if tt.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestService_Routing(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	ses := &MockNamedProvider{name: "ses"}
+	sparkpost := &MockNamedProvider{name: "sparkpost"}
+
+	s, err := NewService(Config{
+		Routing: RoutingConfig{Rules: RoutingRules{{Name: "marketing", Tags: []string{"marketing"}, Providers: []string{"sparkpost"}}}},
+	}, []IProvider{ses, sparkpost}, logger)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "reset", Subject: "Reset your password"}))
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "promo", Subject: "Sale", Tags: []string{"marketing"}}))
+	time.Sleep(100 * time.Millisecond)
+	s.Quit()
+
+	for id, expectedProvider := range map[string]string{"reset": "ses", "promo": "sparkpost"} {
+		status, err := s.Status(id)
+		assert.NoError(t, err)
+		assert.Equal(t, models.MailSent, status.State)
+		assert.Equal(t, expectedProvider, status.Provider, "mail %s sent through the wrong provider", id)
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+type SenderConfig struct {
+	// Allowed lists the domains and addresses mail may be sent from, such as domain.com or noreply@domain.com.
+	// Every sender is allowed when empty. Apps can narrow it down with senders of their own.
+	Allowed []string `json:"allowed"`
+	// RewriteTo is a verified address mail from other senders is sent from instead, the original sender
+	// becoming the Reply-To unless one is given. Without it mail from other senders is refused.
+	RewriteTo string `json:"rewrite_to"`
+}
+
+// SenderError is returned for mail from a sender the policy does not allow
+type SenderError struct {
+	Sender string
+	App    string
+}
+
+func (e *SenderError) Error() string {
+	if e.App != "" {
+		return fmt.Sprintf("sender %s is not allowed for app %s", e.Sender, e.App)
+	}
+	return fmt.Sprintf("sender %s is not allowed", e.Sender)
+}
+
+// validSenders checks the entries of a sender list are domains or addresses
+func validSenders(senders []string) error {
+	for _, sender := range senders {
+		at := strings.Index(sender, "@")
+		switch {
+		case sender == "", strings.ContainsAny(sender, " \t<>,"):
+			return errors.New(fmt.Sprintf("invalid sender %q", sender))
+		case at >= 0 && (at == 0 || at == len(sender)-1 || strings.Count(sender, "@") > 1):
+			return errors.New(fmt.Sprintf("invalid sender %q", sender))
+		}
+	}
+	return nil
+}
+
+// allowedSender tells whether the address matches one of the senders, by address or by domain. Every
+// address matches an empty list.
+func allowedSender(senders []string, addr string) bool {
+	if len(senders) == 0 {
+		return true
+	}
+	for _, sender := range senders {
+		if strings.Contains(sender, "@") {
+			if strings.EqualFold(sender, addr) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(sender, domainOf(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSender holds the mail to the sender policy, both the global one and the one of its app. Mail from
+// other senders is rewritten when a verified address is configured, refused with a SenderError otherwise.
+func (s *Service) checkSender(mail *models.Mail, app *models.App) error {
+
+	allowed := allowedSender(s.cfg.Senders.Allowed, mail.From.Addr)
+	if allowed && app != nil {
+		allowed = allowedSender(app.Senders, mail.From.Addr)
+	}
+	if allowed {
+		return nil
+	}
+
+	if s.cfg.Senders.RewriteTo == "" {
+		return &SenderError{Sender: mail.From.Addr, App: mail.App}
+	}
+
+	s.Logger.I("sender rewritten", "mailID", mail.ID, "app", mail.App, "from", mail.From.Addr, "to", s.cfg.Senders.RewriteTo)
+	if mail.ReplyTo.Addr == "" {
+		mail.ReplyTo = mail.From
+	}
+	mail.From.Addr = s.cfg.Senders.RewriteTo
+	return nil
+}
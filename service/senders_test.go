@@ -0,0 +1,130 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_CheckSender(t *testing.T) {
+	tests := []struct {
+		name            string
+		cfg             SenderConfig
+		app             *models.App
+		mail            models.Mail
+		expectedError   string
+		expectedFrom    models.Email
+		expectedReplyTo models.Email
+	}{
+		{
+			name:         "no policy - should allow any sender",
+			mail:         models.Mail{From: models.Email{Addr: "anyone@anywhere.com"}},
+			expectedFrom: models.Email{Addr: "anyone@anywhere.com"},
+		},
+		{
+			name:         "allowed domain - should allow the sender",
+			cfg:          SenderConfig{Allowed: []string{"domain.com"}},
+			mail:         models.Mail{From: models.Email{Addr: "Sender@Domain.com"}},
+			expectedFrom: models.Email{Addr: "Sender@Domain.com"},
+		},
+		{
+			name:          "other domain - should refuse the sender",
+			cfg:           SenderConfig{Allowed: []string{"domain.com"}},
+			mail:          models.Mail{From: models.Email{Addr: "sender@sub.domain.com"}},
+			expectedError: "sender sender@sub.domain.com is not allowed",
+		},
+		{
+			name:          "address outside the app senders - should refuse the sender",
+			cfg:           SenderConfig{Allowed: []string{"domain.com"}},
+			app:           &models.App{Name: "billing", Senders: []string{"billing@domain.com"}},
+			mail:          models.Mail{App: "billing", From: models.Email{Addr: "support@domain.com"}},
+			expectedError: "sender support@domain.com is not allowed for app billing",
+		},
+		{
+			name:         "app sender - should allow the sender",
+			cfg:          SenderConfig{Allowed: []string{"domain.com"}},
+			app:          &models.App{Name: "billing", Senders: []string{"billing@domain.com"}},
+			mail:         models.Mail{App: "billing", From: models.Email{Addr: "billing@domain.com"}},
+			expectedFrom: models.Email{Addr: "billing@domain.com"},
+		},
+		{
+			name:            "rewrite configured - should send from the verified address and reply to the sender",
+			cfg:             SenderConfig{Allowed: []string{"domain.com"}, RewriteTo: "noreply@domain.com"},
+			mail:            models.Mail{From: models.Email{Name: "Shop", Addr: "shop@other.com"}},
+			expectedFrom:    models.Email{Name: "Shop", Addr: "noreply@domain.com"},
+			expectedReplyTo: models.Email{Name: "Shop", Addr: "shop@other.com"},
+		},
+		{
+			name:            "rewrite with a reply-to - should keep the reply-to",
+			cfg:             SenderConfig{Allowed: []string{"domain.com"}, RewriteTo: "noreply@domain.com"},
+			mail:            models.Mail{From: models.Email{Addr: "shop@other.com"}, ReplyTo: models.Email{Addr: "support@other.com"}},
+			expectedFrom:    models.Email{Addr: "noreply@domain.com"},
+			expectedReplyTo: models.Email{Addr: "support@other.com"},
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{Logger: logger, cfg: Config{Senders: tt.cfg}}
+
+			mail := tt.mail
+			err := s.checkSender(&mail, tt.app)
+			if tt.expectedError != "" {
+				var sender *SenderError
+				assert.ErrorAs(t, err, &sender)
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedFrom, mail.From)
+			assert.Equal(t, tt.expectedReplyTo, mail.ReplyTo)
+		})
+	}
+}
+
+func TestValidSenders(t *testing.T) {
+	assert.NoError(t, validSenders([]string{"domain.com", "noreply@domain.com"}))
+	assert.EqualError(t, validSenders([]string{"@domain.com"}), `invalid sender "@domain.com"`)
+	assert.EqualError(t, validSenders([]string{"a@b@domain.com"}), `invalid sender "a@b@domain.com"`)
+	assert.EqualError(t, validSenders([]string{""}), `invalid sender ""`)
+}
+
+func TestService_SenderPolicy(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	_, err := NewService(Config{Senders: SenderConfig{Allowed: []string{"domain .com"}}}, []IProvider{&MockProvider{}}, logger)
+	assert.EqualError(t, err, `invalid allowed senders: invalid sender "domain .com"`)
+
+	s, err := NewService(Config{
+		Workers: 1,
+		Senders: SenderConfig{Allowed: []string{"domain.com"}},
+		Apps:    AppsConfig{File: filepath.Join(t.TempDir(), "apps.json")},
+	}, []IProvider{&MockProvider{}}, logger)
+	assert.NoError(t, err)
+	defer s.Quit()
+
+	assert.EqualError(t, s.SaveApp(&models.App{Name: "billing", Senders: []string{"billing@"}}), `app billing given an invalid sender "billing@"`)
+	assert.NoError(t, s.SaveApp(&models.App{Name: "billing", DailyLimit: 1, Senders: []string{"billing@domain.com"}}))
+
+	// refused mail is not queued nor counted against the daily limit
+	var sender *SenderError
+	assert.ErrorAs(t, s.QueueMail(&models.Mail{ID: "spoofed", App: "billing", AppID: 1, From: models.Email{Addr: "ceo@domain.com"}}), &sender)
+	_, err = s.Status("spoofed")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "allowed", App: "billing", AppID: 1, From: models.Email{Addr: "billing@domain.com"}}))
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
 	log "github.com/gugabfigueiredo/tiny-go-log"
@@ -8,6 +9,7 @@ import (
 	"github.com/sendgrid/rest"
 	"github.com/sendgrid/sendgrid-go"
 	sgHelper "github.com/sendgrid/sendgrid-go/helpers/mail"
+	"strings"
 )
 
 type SendgridConfig struct {
@@ -15,7 +17,7 @@ type SendgridConfig struct {
 }
 
 type ISendgridClient interface {
-	Send(msg *sgHelper.SGMailV3) (*rest.Response, error)
+	SendWithContext(ctx context.Context, msg *sgHelper.SGMailV3) (*rest.Response, error)
 }
 
 type SendgridProvider struct {
@@ -32,25 +34,29 @@ func NewSendgridProvider(cfg SendgridConfig, logger *log.Logger) *SendgridProvid
 	}
 }
 
-func (s *SendgridProvider) SendMail(mail *models.Mail) error {
+func (s *SendgridProvider) Name() string {
+	return "sendgrid"
+}
+
+func (s *SendgridProvider) SendMail(ctx context.Context, mail *models.Mail) error {
 
 	logger := s.Logger.C("from", mail.From.Addr, "to", mail.To, "subject", mail.Subject, "id", mail.ID)
 
 	// Create an instance of SGMailV3
 	sgMail := s.buildSGMailV3(mail)
 
-	resp, err := s.Client.Send(sgMail)
+	resp, err := s.Client.SendWithContext(ctx, sgMail)
 	if err != nil {
-		logger.E("failed to send message", "err", err.Error(), "status", resp.StatusCode)
-		return errors.New(fmt.Sprintf("failed to send message: %s", err.Error()))
+		logger.E("failed to send message", "err", err.Error())
+		return httpSendError(s.Name(), 0, errors.Wrap(err, "failed to send message"))
 	}
 
 	switch resp.StatusCode {
 	case 200, 201, 202:
 		logger.I("sgMail request successful", "status", resp.StatusCode)
 	default:
-		logger.E("sgMail request failed", "status", resp.StatusCode)
-		return errors.New(fmt.Sprintf("sgMail request failed: %d", resp.StatusCode))
+		logger.E("sgMail request failed", "status", resp.StatusCode, "body", resp.Body)
+		return httpSendError(s.Name(), resp.StatusCode, errors.New(fmt.Sprintf("sgMail request failed: %s", strings.TrimSpace(resp.Body))))
 	}
 
 	return nil
@@ -83,15 +89,33 @@ func (s *SendgridProvider) buildSGMailV3(mail *models.Mail) *sgHelper.SGMailV3 {
 		personalization.AddTos(sgHelper.NewEmail(recipient.Name, recipient.Addr))
 	}
 
+	for _, recipient := range mail.CC {
+		personalization.AddCCs(sgHelper.NewEmail(recipient.Name, recipient.Addr))
+	}
+
+	for _, recipient := range mail.BCC {
+		personalization.AddBCCs(sgHelper.NewEmail(recipient.Name, recipient.Addr))
+	}
+
 	sgMail.AddPersonalizations(personalization)
 
-	// Set the attachments
+	// Set the reply address
+	if mail.ReplyTo.Addr != "" {
+		sgMail.SetReplyTo(sgHelper.NewEmail(mail.ReplyTo.Name, mail.ReplyTo.Addr))
+	}
+
+	// Set the attachments, those with a content id are shown inline by the html body
 	for _, attachment := range mail.Attachments {
 		sgAtt := sgHelper.NewAttachment()
 		sgAtt.SetContent(attachment.Data)
 		sgAtt.SetType(attachment.Type)
 		sgAtt.SetFilename(attachment.Name)
-		sgAtt.SetDisposition("attachment")
+		if attachment.ContentID != "" && mail.HTML != "" {
+			sgAtt.SetContentID(attachment.ContentID)
+			sgAtt.SetDisposition("inline")
+		} else {
+			sgAtt.SetDisposition("attachment")
+		}
 		sgMail.AddAttachment(sgAtt)
 	}
 
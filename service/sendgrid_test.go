@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"github.com/sendgrid/rest"
 	"testing"
 
@@ -19,7 +20,7 @@ type MockSendGridClient struct {
 	CalledWith *sgMail.SGMailV3
 }
 
-func (m *MockSendGridClient) Send(msg *sgMail.SGMailV3) (*rest.Response, error) {
+func (m *MockSendGridClient) SendWithContext(_ context.Context, msg *sgMail.SGMailV3) (*rest.Response, error) {
 	m.CalledWith = msg
 	return m.Response, m.Error
 }
@@ -50,7 +51,7 @@ func TestSendgridProvider_SendMail(t *testing.T) {
 				Subject: "Test Subject",
 				Text:    "Test Text",
 			},
-			mockResponse: &rest.Response{},
+			mockResponse: &rest.Response{StatusCode: 202},
 			mockError:    nil,
 			expectedSendGridData: &sgMail.SGMailV3{
 				From: sgMail.NewEmail("Sender", "sender@domain.com"),
@@ -96,7 +97,7 @@ func TestSendgridProvider_SendMail(t *testing.T) {
 				Subject: "Test Subject",
 				HTML:    "<h1>Hello World!</h1>",
 			},
-			mockResponse: &rest.Response{},
+			mockResponse: &rest.Response{StatusCode: 202},
 			mockError:    nil,
 			expectedSendGridData: &sgMail.SGMailV3{
 				From: sgMail.NewEmail("Sender", "sender@domain.com"),
@@ -149,7 +150,7 @@ func TestSendgridProvider_SendMail(t *testing.T) {
 					},
 				},
 			},
-			mockResponse: &rest.Response{},
+			mockResponse: &rest.Response{StatusCode: 202},
 			mockError:    nil,
 			expectedSendGridData: &sgMail.SGMailV3{
 				From: sgMail.NewEmail("Sender", "sender@domain.com"),
@@ -185,6 +186,145 @@ func TestSendgridProvider_SendMail(t *testing.T) {
 			},
 			expectedError: nil,
 		},
+		{
+			name: "send email with inline attachment",
+			mail: &models.Mail{
+				ID: "1234",
+				From: models.Email{
+					Addr: "sender@domain.com",
+					Name: "Sender",
+				},
+				To: []models.Email{
+					{
+						Addr: "recipient@domain.com",
+						Name: "Recipient",
+					},
+				},
+				Subject: "Test Subject",
+				HTML:    "<img src=\"cid:logo\">",
+				Attachments: []models.Attachment{
+					{
+						Name:      "logo.png",
+						Type:      "image/png",
+						Data:      "test",
+						ContentID: "logo",
+					},
+					{
+						Name: "test.txt",
+						Type: "text/plain",
+						Data: "test",
+					},
+				},
+			},
+			mockResponse: &rest.Response{StatusCode: 202},
+			mockError:    nil,
+			expectedSendGridData: &sgMail.SGMailV3{
+				From: sgMail.NewEmail("Sender", "sender@domain.com"),
+				Personalizations: []*sgMail.Personalization{
+					{
+						To: []*sgMail.Email{
+							sgMail.NewEmail("Recipient", "recipient@domain.com"),
+						},
+						CC:                  make([]*sgMail.Email, 0),
+						BCC:                 make([]*sgMail.Email, 0),
+						Headers:             make(map[string]string),
+						Substitutions:       make(map[string]string),
+						CustomArgs:          make(map[string]string),
+						DynamicTemplateData: make(map[string]interface{}),
+						Categories:          make([]string, 0),
+					},
+				},
+				Subject: "Test Subject",
+				Content: []*sgMail.Content{
+					{
+						Type:  "text/html",
+						Value: "<img src=\"cid:logo\">",
+					},
+				},
+				Attachments: []*sgMail.Attachment{
+					{
+						Filename:    "logo.png",
+						Type:        "image/png",
+						Content:     "test",
+						Disposition: "inline",
+						ContentID:   "logo",
+					},
+					{
+						Filename:    "test.txt",
+						Type:        "text/plain",
+						Content:     "test",
+						Disposition: "attachment",
+					},
+				},
+			},
+			expectedError: nil,
+		},
+		{
+			name: "send email with cc, bcc and reply-to",
+			mail: &models.Mail{
+				ID: "1234",
+				From: models.Email{
+					Addr: "sender@domain.com",
+					Name: "Sender",
+				},
+				To: []models.Email{
+					{
+						Addr: "recipient@domain.com",
+						Name: "Recipient",
+					},
+				},
+				CC: []models.Email{
+					{
+						Addr: "cc@domain.com",
+						Name: "Copy",
+					},
+				},
+				BCC: []models.Email{
+					{
+						Addr: "bcc@domain.com",
+					},
+				},
+				ReplyTo: models.Email{
+					Addr: "reply@domain.com",
+					Name: "Reply",
+				},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			mockResponse: &rest.Response{StatusCode: 202},
+			mockError:    nil,
+			expectedSendGridData: &sgMail.SGMailV3{
+				From:    sgMail.NewEmail("Sender", "sender@domain.com"),
+				ReplyTo: sgMail.NewEmail("Reply", "reply@domain.com"),
+				Personalizations: []*sgMail.Personalization{
+					{
+						To: []*sgMail.Email{
+							sgMail.NewEmail("Recipient", "recipient@domain.com"),
+						},
+						CC: []*sgMail.Email{
+							sgMail.NewEmail("Copy", "cc@domain.com"),
+						},
+						BCC: []*sgMail.Email{
+							sgMail.NewEmail("", "bcc@domain.com"),
+						},
+						Headers:             make(map[string]string),
+						Substitutions:       make(map[string]string),
+						CustomArgs:          make(map[string]string),
+						DynamicTemplateData: make(map[string]interface{}),
+						Categories:          make([]string, 0),
+					},
+				},
+				Subject: "Test Subject",
+				Content: []*sgMail.Content{
+					{
+						Type:  "text/plain",
+						Value: "Test Text",
+					},
+				},
+				Attachments: make([]*sgMail.Attachment, 0),
+			},
+			expectedError: nil,
+		},
 	}
 
 	logger := log.New(&log.Config{
@@ -207,10 +347,11 @@ func TestSendgridProvider_SendMail(t *testing.T) {
 				Client: mockClient,
 			}
 
-			err := provider.SendMail(tt.mail)
+			err := provider.SendMail(context.Background(), tt.mail)
 
 			// Assertions
 			assert.Equal(t, tt.expectedSendGridData.From, mockClient.CalledWith.From, "Unexpected Seder")
+			assert.Equal(t, tt.expectedSendGridData.ReplyTo, mockClient.CalledWith.ReplyTo, "Unexpected Reply-To")
 			assert.Equal(t, tt.expectedSendGridData.Personalizations, mockClient.CalledWith.Personalizations, "Unexpected Recipients")
 			assert.Equal(t, tt.expectedSendGridData.Subject, mockClient.CalledWith.Subject, "Unexpected Subject")
 			assert.Equal(t, tt.expectedSendGridData.Content, mockClient.CalledWith.Content, "Unexpected Content")
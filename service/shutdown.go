@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"github.com/pkg/errors"
+)
+
+// ErrShuttingDown is returned for mail queued after shutdown started
+var ErrShuttingDown = errors.New("mail service is shutting down")
+
+// ShutdownReport tells what shutdown left behind
+type ShutdownReport struct {
+	// Pending lists the IDs of the mail left in the queue store, waiting for a retry or interrupted
+	Pending []string
+	// Durable is false when the queue store does not outlive the process, pending mail is then lost
+	Durable bool
+}
+
+// Shutdown stops accepting mail and sends what is already queued until ctx is done, then interrupts the sends
+// in progress. Retries that are not due yet are not waited for, like any mail that could not be sent in time
+// they stay in the queue store to be replayed on the next start. It returns an error when the deadline cut
+// the drain short, the report is complete either way.
+func (s *Service) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+
+	s.acceptMu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopping)
+	}
+	s.acceptMu.Unlock()
+
+	s.mu.Lock()
+	for delivery, timer := range s.timers {
+		timer.Stop()
+		delete(s.timers, delivery)
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "mail queue not drained before the deadline")
+	}
+
+	s.cancel()
+	<-drained
+
+	report := &ShutdownReport{}
+	_, inMemory := s.Store.(*MemoryQueueStore)
+	report.Durable = !inMemory
+
+	pending, loadErr := s.Store.Load()
+	if loadErr != nil {
+		s.Logger.E("unable to list mail left in queue", "err", loadErr)
+		if err == nil {
+			err = errors.Wrap(loadErr, "unable to list mail left in queue")
+		}
+	}
+	for _, delivery := range pending {
+		report.Pending = append(report.Pending, delivery.Mail.ID)
+	}
+
+	switch {
+	case len(report.Pending) == 0:
+		s.Logger.I("mail queue drained")
+	case report.Durable:
+		s.Logger.I("mail left in queue for the next start", "count", len(report.Pending), "mailIDs", report.Pending)
+	default:
+		s.Logger.E("mail left in a memory queue is lost", "count", len(report.Pending), "mailIDs", report.Pending)
+	}
+
+	return report, err
+}
+
+// Quit shuts down without draining, interrupting the sends in progress
+func (s *Service) Quit() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _ = s.Shutdown(ctx)
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Shutdown(t *testing.T) {
+	tests := []struct {
+		name            string
+		provider        IProvider
+		queue           QueueConfig
+		timeout         time.Duration
+		expectedPending int
+		expectedDurable bool
+		expectedError   bool
+	}{
+		{
+			name:     "queue drained in time - should leave nothing behind",
+			provider: &MockConcurrentProvider{Delay: 10 * time.Millisecond, DeliveredByID: make(map[string]int)},
+			timeout:  5 * time.Second,
+		},
+		{
+			name:            "hung provider - should give up at the deadline and report the mail left",
+			provider:        &MockBlockingProvider{name: "hung"},
+			queue:           QueueConfig{Backend: "file"},
+			timeout:         50 * time.Millisecond,
+			expectedPending: 5,
+			expectedDurable: true,
+			expectedError:   true,
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.queue.Backend == "file" {
+				tt.queue.Dir = t.TempDir()
+			}
+
+			s, err := NewService(Config{Workers: 1, Queue: tt.queue}, []IProvider{tt.provider}, logger)
+			assert.NoError(t, err)
+
+			for i := 0; i < 5; i++ {
+				assert.NoError(t, s.QueueMail(&models.Mail{ID: fmt.Sprintf("mail-%d", i)}))
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			report, err := s.Shutdown(ctx)
+
+			assert.Equal(t, tt.expectedError, err != nil, "unexpected error: %v", err)
+			assert.Len(t, report.Pending, tt.expectedPending, "unexpected mail left behind")
+			assert.Equal(t, tt.expectedDurable, report.Durable)
+
+			assert.ErrorIs(t, s.QueueMail(&models.Mail{ID: "late"}), ErrShuttingDown, "mail accepted after shutdown")
+		})
+	}
+}
+
+func TestService_ShutdownWhileQueueing(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	provider := &MockConcurrentProvider{Delay: 5 * time.Millisecond, DeliveredByID: make(map[string]int)}
+
+	s, err := NewService(Config{Workers: 2, Queue: QueueConfig{Size: 1}}, []IProvider{provider}, logger)
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	var accepted []string
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				id := fmt.Sprintf("mail-%d-%d", i, j)
+				err := s.QueueMail(&models.Mail{ID: id})
+				if errors.Is(err, ErrQueueFull) {
+					continue
+				}
+				if err != nil {
+					assert.ErrorIs(t, err, ErrShuttingDown)
+					return
+				}
+				mu.Lock()
+				accepted = append(accepted, id)
+				mu.Unlock()
+			}
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	report, _ := s.Shutdown(ctx)
+	wg.Wait()
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	// every accepted mail is either delivered or reported as left behind
+	for _, id := range accepted {
+		pending := false
+		for _, pendingID := range report.Pending {
+			pending = pending || pendingID == id
+		}
+		assert.True(t, pending != (provider.DeliveredByID[id] == 1), "mail %s lost or sent twice", id)
+	}
+}
@@ -1,10 +1,17 @@
 package service
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/message"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
 	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"strconv"
 )
 
 type SMTPConfig struct {
@@ -15,36 +22,143 @@ type SMTPConfig struct {
 }
 
 type SMTPProvider struct {
-	Addr   string
-	Auth   smtp.Auth
-	Logger *log.Logger
+	Addr    string
+	Auth    smtp.Auth
+	Builder message.Builder
+	Signer  IMessageSigner
+	Logger  *log.Logger
 }
 
+// NewSMTPProvider authenticates with PLAIN auth when a user is given, otherwise mail is relayed unauthenticated
 func NewSMTPProvider(cfg SMTPConfig, logger *log.Logger) *SMTPProvider {
-	return &SMTPProvider{
-		Addr:   fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
-		Auth:   smtp.PlainAuth("", cfg.User, cfg.Pass, cfg.Host),
-		Logger: logger,
+	provider := &SMTPProvider{
+		Addr:    fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+		Builder: *message.NewBuilder(),
+		Logger:  logger,
 	}
+	if cfg.User != "" {
+		provider.Auth = smtp.PlainAuth("", cfg.User, cfg.Pass, cfg.Host)
+	}
+	return provider
+}
+
+func (s *SMTPProvider) Name() string {
+	return "smtp"
 }
 
-func (s *SMTPProvider) SendMail(mail *models.Mail) error {
+func (s *SMTPProvider) SendMail(ctx context.Context, mail *models.Mail) error {
 
 	logger := s.Logger.C("from", mail.From.Addr, "to", mail.To, "subject", mail.Subject, "id", mail.ID)
 
-	var tos []string
-	for _, to := range mail.To {
-		tos = append(tos, to.Addr)
+	msg, err := buildRawMessage(&s.Builder, s.Signer, mail)
+	if err != nil {
+		logger.E("unable to build message", "err", err)
+		return buildError(s.Name(), err)
 	}
 
-	msg := buildSMTPMessage(mail, tos)
-
-	err := smtp.SendMail(s.Addr, s.Auth, mail.From.Addr, tos, msg)
+	err = s.send(ctx, mail.From.Addr, mail.Recipients(), msg)
 	if err != nil {
 		logger.E("unable to send email", "err", err)
-		return err
+		return s.sendError(err)
 	}
 
 	logger.I("email sent")
 	return nil
 }
+
+// send does what smtp.SendMail does over a connection bound to ctx, a hung server is cut off once ctx is done
+func (s *SMTPProvider) send(ctx context.Context, from string, to []string, msg []byte) (err error) {
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	// closing the connection unblocks whatever exchange is in progress
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = errors.Wrap(ctx.Err(), "smtp send interrupted")
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if s.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return NewSendError(ErrorAuthFailed, s.Name(), "", errors.New("smtp: server doesn't support AUTH"))
+		}
+		if err = c.Auth(s.Auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// sendError classifies an SMTP failure by its reply code, 4xx replies are transient and 5xx permanent except
+// for authentication failures. Failures without a reply, such as network errors, are transient.
+func (s *SMTPProvider) sendError(err error) *SendError {
+
+	var sendErr *SendError
+	if errors.As(err, &sendErr) {
+		return sendErr
+	}
+
+	var reply *textproto.Error
+	if !errors.As(err, &reply) {
+		return NewSendError(ErrorTransient, s.Name(), "", err)
+	}
+
+	code := strconv.Itoa(reply.Code)
+	switch {
+	case reply.Code == 530, reply.Code == 534, reply.Code == 535, reply.Code == 538:
+		return NewSendError(ErrorAuthFailed, s.Name(), code, err)
+	case reply.Code >= 500:
+		return NewSendError(ErrorPermanent, s.Name(), code, err)
+	default:
+		return NewSendError(ErrorTransient, s.Name(), code, err)
+	}
+}
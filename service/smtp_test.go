@@ -0,0 +1,193 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockSMTPServer accepts a single message and records its envelope and data
+type MockSMTPServer struct {
+	Listener net.Listener
+	From     string
+	Rcpts    []string
+	Data     string
+	done     chan struct{}
+}
+
+func NewMockSMTPServer(t *testing.T) *MockSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server := &MockSMTPServer{Listener: listener, done: make(chan struct{})}
+	go server.serve()
+
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (m *MockSMTPServer) serve() {
+	defer close(m.done)
+
+	conn, err := m.Listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(command, "AUTH"):
+			reply("235 authenticated")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			m.From = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			reply("250 ok")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			m.Rcpts = append(m.Rcpts, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			reply("250 ok")
+		case command == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			m.Data = data.String()
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (m *MockSMTPServer) Wait() {
+	<-m.done
+}
+
+func TestSMTPProvider_SendMail(t *testing.T) {
+	tests := []struct {
+		name            string
+		mail            *models.Mail
+		expectedRcpts   []string
+		expectedHeaders []string
+		excludedHeaders []string
+	}{
+		{
+			name: "send email plaintext",
+			mail: &models.Mail{
+				ID: "1234",
+				From: models.Email{
+					Addr: "sender@domain.com",
+					Name: "Sender",
+				},
+				To: []models.Email{
+					{
+						Addr: "recipient@domain.com",
+						Name: "Recipient",
+					},
+				},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			expectedRcpts:   []string{"recipient@domain.com"},
+			expectedHeaders: []string{"To: \"Recipient\" <recipient@domain.com>\r\n"},
+			excludedHeaders: []string{"Cc:", "Bcc:", "Reply-To:"},
+		},
+		{
+			name: "send email with cc, bcc and reply-to - should keep bcc out of the headers",
+			mail: &models.Mail{
+				ID: "1234",
+				From: models.Email{
+					Addr: "sender@domain.com",
+					Name: "Sender",
+				},
+				To: []models.Email{
+					{
+						Addr: "recipient@domain.com",
+						Name: "Recipient",
+					},
+				},
+				CC: []models.Email{
+					{
+						Addr: "cc@domain.com",
+					},
+				},
+				BCC: []models.Email{
+					{
+						Addr: "bcc@domain.com",
+					},
+				},
+				ReplyTo: models.Email{
+					Addr: "reply@domain.com",
+				},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			expectedRcpts:   []string{"recipient@domain.com", "cc@domain.com", "bcc@domain.com"},
+			expectedHeaders: []string{"To: \"Recipient\" <recipient@domain.com>\r\n", "Cc: <cc@domain.com>\r\n", "Reply-To: <reply@domain.com>\r\n"},
+			excludedHeaders: []string{"Bcc:", "bcc@domain.com"},
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewMockSMTPServer(t)
+
+			provider := &SMTPProvider{
+				Addr:   server.Listener.Addr().String(),
+				Auth:   smtp.PlainAuth("", "user", "pass", "127.0.0.1"),
+				Logger: logger,
+			}
+
+			err := provider.SendMail(context.Background(), tt.mail)
+			server.Wait()
+
+			// Assertions
+			assert.NoError(t, err, "Unexpected error")
+			assert.Equal(t, "sender@domain.com", server.From, "Unexpected envelope sender")
+			assert.Equal(t, tt.expectedRcpts, server.Rcpts, "Unexpected envelope recipients")
+			for _, header := range tt.expectedHeaders {
+				assert.Contains(t, server.Data, header, "Missing header")
+			}
+			for _, header := range tt.excludedHeaders {
+				assert.NotContains(t, server.Data, header, "Unexpected header")
+			}
+		})
+	}
+}
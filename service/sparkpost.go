@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	sp "github.com/SparkPost/gosparkpost"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
 	log "github.com/gugabfigueiredo/tiny-go-log"
@@ -8,7 +9,7 @@ import (
 )
 
 type ISPClient interface {
-	Send(*sp.Transmission) (id string, res *sp.Response, err error)
+	SendContext(context.Context, *sp.Transmission) (id string, res *sp.Response, err error)
 }
 
 type SparkpostProvider struct {
@@ -16,47 +17,83 @@ type SparkpostProvider struct {
 	Client ISPClient
 }
 
-func NewSparkpostProvider(cfg sp.Config, logger *log.Logger) *SparkpostProvider {
+func NewSparkpostProvider(cfg sp.Config, logger *log.Logger) (*SparkpostProvider, error) {
+
+	if cfg.ApiKey == "" {
+		return nil, errors.New("missing sparkpost api key")
+	}
 
 	var client sp.Client
-	err := client.Init(&cfg)
-	if err != nil {
-		logger.F("SparkPost client init failed: %s\n", err)
+	if err := client.Init(&cfg); err != nil {
+		return nil, errors.Wrap(err, "sparkpost client init failed")
 	}
 
 	return &SparkpostProvider{
 		Logger: logger,
 		Client: &client,
-	}
+	}, nil
+}
+
+func (s *SparkpostProvider) Name() string {
+	return "sparkpost"
 }
 
-func (s *SparkpostProvider) SendMail(mail *models.Mail) error {
+func (s *SparkpostProvider) SendMail(ctx context.Context, mail *models.Mail) error {
 
 	logger := s.Logger.C("from", mail.From.Addr, "to", mail.To, "subject", mail.Subject, "id", mail.ID)
 
 	// Create a Transmission
 	tx := s.buildTransmission(mail)
 
-	id, resp, err := s.Client.Send(tx)
+	id, resp, err := s.Client.SendContext(ctx, tx)
+
+	// the response is missing when the request never got an answer
+	status := 0
+	if resp != nil && resp.HTTP != nil {
+		status = resp.HTTP.StatusCode
+	}
+
 	if err != nil {
-		logger.E("unable to send email", "err", err, "statusCode", resp.HTTP.StatusCode)
-		return errors.New("unable to send email")
+		logger.E("unable to send email", "err", err, "statusCode", status)
+		return httpSendError(s.Name(), status, errors.Wrap(err, "unable to send email"))
 	}
 
-	logger.I("sparkpost transmission sent", "id", id, "statusCode", resp.HTTP.StatusCode)
+	logger.I("sparkpost transmission sent", "id", id, "statusCode", status)
 
 	return nil
 }
 
 func (s *SparkpostProvider) buildTransmission(mail *models.Mail) *sp.Transmission {
 
-	var recipients []string
-	for _, recipient := range mail.To {
-		recipients = append(recipients, recipient.Addr)
+	// every recipient shows the To list as its To header, copies only differ by being listed in the Cc header
+	headerTo := joinAddrs(mail.To)
+
+	var recipients []sp.Recipient
+	for _, list := range [][]models.Email{mail.To, mail.CC, mail.BCC} {
+		for _, recipient := range list {
+			recipients = append(recipients, sp.Recipient{
+				Address: sp.Address{Email: recipient.Addr, Name: recipient.Name, HeaderTo: headerTo},
+			})
+		}
+	}
+
+	var headers map[string]string
+	if len(mail.CC) > 0 {
+		headers = map[string]string{"cc": joinAddrs(mail.CC)}
 	}
 
+	// sparkpost refers to an inline image by its filename, so it is given the content id
 	var attachments []sp.Attachment
+	var inlineImages []sp.InlineImage
 	for _, attachment := range mail.Attachments {
+		if attachment.ContentID != "" && mail.HTML != "" {
+			inlineImages = append(inlineImages, sp.InlineImage{
+				Filename: attachment.ContentID,
+				MIMEType: attachment.Type,
+				B64Data:  attachment.Data,
+			})
+			continue
+		}
 		attachments = append(attachments, sp.Attachment{
 			Filename: attachment.Name,
 			MIMEType: attachment.Type,
@@ -68,11 +105,14 @@ func (s *SparkpostProvider) buildTransmission(mail *models.Mail) *sp.Transmissio
 	tx := &sp.Transmission{
 		Recipients: recipients,
 		Content: sp.Content{
-			From:        mail.From.Addr,
-			Subject:     mail.Subject,
-			Text:        mail.Text,
-			HTML:        mail.HTML,
-			Attachments: attachments,
+			From:         mail.From.Addr,
+			ReplyTo:      mail.ReplyTo.Addr,
+			Headers:      headers,
+			Subject:      mail.Subject,
+			Text:         mail.Text,
+			HTML:         mail.HTML,
+			Attachments:  attachments,
+			InlineImages: inlineImages,
 		},
 	}
 
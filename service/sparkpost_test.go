@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"net/http"
 	"testing"
 
 	"github.com/gugabfigueiredo/dream-mail-go/models"
@@ -17,7 +19,7 @@ type MockSparkPostClient struct {
 	CalledWith *sparkpost.Transmission
 }
 
-func (m *MockSparkPostClient) Send(transmission *sparkpost.Transmission) (string, *sparkpost.Response, error) {
+func (m *MockSparkPostClient) SendContext(_ context.Context, transmission *sparkpost.Transmission) (string, *sparkpost.Response, error) {
 	m.CalledWith = transmission
 	return "", m.Response, m.Error
 }
@@ -48,7 +50,7 @@ func TestSparkPostProvider_SendMail(t *testing.T) {
 				Subject: "Test Subject",
 				Text:    "Test Text",
 			},
-			mockResponse: &sparkpost.Response{},
+			mockResponse: &sparkpost.Response{HTTP: &http.Response{StatusCode: 200}},
 			mockError:    nil,
 			expectedSparkPostData: &sparkpost.Transmission{
 				Content: sparkpost.Content{
@@ -58,7 +60,9 @@ func TestSparkPostProvider_SendMail(t *testing.T) {
 					Subject:     "Test Subject",
 					Attachments: nil,
 				},
-				Recipients: []string{"recipient@domain.com"},
+				Recipients: []sparkpost.Recipient{
+					{Address: sparkpost.Address{Email: "recipient@domain.com", Name: "Recipient", HeaderTo: "recipient@domain.com"}},
+				},
 			},
 			expectedError: nil,
 		},
@@ -79,7 +83,7 @@ func TestSparkPostProvider_SendMail(t *testing.T) {
 				Subject: "Test Subject",
 				HTML:    "<h1>Hello World!</h1>",
 			},
-			mockResponse: &sparkpost.Response{},
+			mockResponse: &sparkpost.Response{HTTP: &http.Response{StatusCode: 200}},
 			mockError:    nil,
 			expectedSparkPostData: &sparkpost.Transmission{
 				Content: sparkpost.Content{
@@ -89,7 +93,9 @@ func TestSparkPostProvider_SendMail(t *testing.T) {
 					Subject:     "Test Subject",
 					Attachments: nil,
 				},
-				Recipients: []string{"recipient@domain.com"},
+				Recipients: []sparkpost.Recipient{
+					{Address: sparkpost.Address{Email: "recipient@domain.com", Name: "Recipient", HeaderTo: "recipient@domain.com"}},
+				},
 			},
 			expectedError: nil,
 		},
@@ -117,7 +123,7 @@ func TestSparkPostProvider_SendMail(t *testing.T) {
 					},
 				},
 			},
-			mockResponse: &sparkpost.Response{},
+			mockResponse: &sparkpost.Response{HTTP: &http.Response{StatusCode: 200}},
 			mockError:    nil,
 			expectedSparkPostData: &sparkpost.Transmission{
 				Content: sparkpost.Content{
@@ -133,7 +139,116 @@ func TestSparkPostProvider_SendMail(t *testing.T) {
 						},
 					},
 				},
-				Recipients: []string{"recipient@domain.com"},
+				Recipients: []sparkpost.Recipient{
+					{Address: sparkpost.Address{Email: "recipient@domain.com", Name: "Recipient", HeaderTo: "recipient@domain.com"}},
+				},
+			},
+			expectedError: nil,
+		},
+		{
+			name: "send email with inline attachment",
+			mail: &models.Mail{
+				ID: "1234",
+				From: models.Email{
+					Addr: "sender@domain.com",
+					Name: "Sender",
+				},
+				To: []models.Email{
+					{
+						Addr: "recipient@domain.com",
+						Name: "Recipient",
+					},
+				},
+				Subject: "Test Subject",
+				HTML:    "<img src=\"cid:logo\">",
+				Attachments: []models.Attachment{
+					{
+						Name:      "logo.png",
+						Type:      "image/png",
+						Data:      "test",
+						ContentID: "logo",
+					},
+					{
+						Name: "test.txt",
+						Type: "text/plain",
+						Data: "test",
+					},
+				},
+			},
+			mockResponse: &sparkpost.Response{HTTP: &http.Response{StatusCode: 200}},
+			mockError:    nil,
+			expectedSparkPostData: &sparkpost.Transmission{
+				Content: sparkpost.Content{
+					Text:    "",
+					HTML:    "<img src=\"cid:logo\">",
+					From:    "sender@domain.com",
+					Subject: "Test Subject",
+					Attachments: []sparkpost.Attachment{
+						{
+							Filename: "test.txt",
+							MIMEType: "text/plain",
+							B64Data:  "test",
+						},
+					},
+					InlineImages: []sparkpost.InlineImage{
+						{
+							Filename: "logo",
+							MIMEType: "image/png",
+							B64Data:  "test",
+						},
+					},
+				},
+				Recipients: []sparkpost.Recipient{
+					{Address: sparkpost.Address{Email: "recipient@domain.com", Name: "Recipient", HeaderTo: "recipient@domain.com"}},
+				},
+			},
+			expectedError: nil,
+		},
+		{
+			name: "send email with cc, bcc and reply-to",
+			mail: &models.Mail{
+				ID: "1234",
+				From: models.Email{
+					Addr: "sender@domain.com",
+					Name: "Sender",
+				},
+				To: []models.Email{
+					{
+						Addr: "recipient@domain.com",
+						Name: "Recipient",
+					},
+				},
+				CC: []models.Email{
+					{
+						Addr: "cc@domain.com",
+					},
+				},
+				BCC: []models.Email{
+					{
+						Addr: "bcc@domain.com",
+					},
+				},
+				ReplyTo: models.Email{
+					Addr: "reply@domain.com",
+				},
+				Subject: "Test Subject",
+				Text:    "Test Text",
+			},
+			mockResponse: &sparkpost.Response{HTTP: &http.Response{StatusCode: 200}},
+			mockError:    nil,
+			expectedSparkPostData: &sparkpost.Transmission{
+				Content: sparkpost.Content{
+					Text:    "Test Text",
+					From:    "sender@domain.com",
+					ReplyTo: "reply@domain.com",
+					Headers: map[string]string{"cc": "cc@domain.com"},
+					Subject: "Test Subject",
+				},
+				Recipients: []sparkpost.Recipient{
+					{Address: sparkpost.Address{Email: "recipient@domain.com", Name: "Recipient", HeaderTo: "recipient@domain.com"}},
+					{Address: sparkpost.Address{Email: "cc@domain.com", HeaderTo: "recipient@domain.com"}},
+					{Address: sparkpost.Address{Email: "bcc@domain.com", HeaderTo: "recipient@domain.com"}},
+				},
 			},
 			expectedError: nil,
 		},
@@ -159,7 +274,7 @@ func TestSparkPostProvider_SendMail(t *testing.T) {
 				Client: mockClient,
 			}
 
-			err := provider.SendMail(tt.mail)
+			err := provider.SendMail(context.Background(), tt.mail)
 
 			// Assertions
 			expectedContent, _ := tt.expectedSparkPostData.Content.(sparkpost.Content)
@@ -167,8 +282,11 @@ func TestSparkPostProvider_SendMail(t *testing.T) {
 			assert.Equal(t, expectedContent.Text, actualContent.Text, "Unexpected Text content")
 			assert.Equal(t, expectedContent.HTML, actualContent.HTML, "Unexpected HTML content")
 			assert.Equal(t, expectedContent.From, actualContent.From, "Unexpected Sender")
+			assert.Equal(t, expectedContent.ReplyTo, actualContent.ReplyTo, "Unexpected Reply-To")
+			assert.Equal(t, expectedContent.Headers, actualContent.Headers, "Unexpected Headers")
 			assert.Equal(t, expectedContent.Subject, actualContent.Subject, "Unexpected Subject")
 			assert.Equal(t, expectedContent.Attachments, actualContent.Attachments, "Unexpected Attachments")
+			assert.Equal(t, expectedContent.InlineImages, actualContent.InlineImages, "Unexpected Inline Images")
 			assert.Equal(t, tt.expectedSparkPostData.Recipients, mockClient.CalledWith.Recipients, "Unexpected Recipients")
 			assert.Equal(t, tt.expectedError, err, "Unexpected error")
 		})
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	"github.com/pkg/errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// IStatusStore keeps the delivery status of every mail, keyed by mail ID
+type IStatusStore interface {
+	Save(status *models.MailStatus) error
+	Get(id string) (*models.MailStatus, error)
+	Delete(id string) error
+}
+
+type StatusConfig struct {
+	Backend string `json:"backend" default:"memory"`
+	Dir     string `json:"dir" default:"/var/lib/dream-mail-go/status"`
+	// Retention is how long the status of a mail sent, failed or bounced is kept after its last update, 0
+	// keeps statuses forever
+	Retention time.Duration `json:"retention" default:"720h"`
+}
+
+// statusSweepInterval is how often stores look for expired statuses, on save
+const statusSweepInterval = time.Minute
+
+// NewStatusStore builds the status backend selected in the config
+func NewStatusStore(cfg StatusConfig) (IStatusStore, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		store := NewMemoryStatusStore()
+		store.Retention = cfg.Retention
+		return store, nil
+	case "file":
+		store, err := NewFileStatusStore(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		store.Retention = cfg.Retention
+		return store, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown status backend: %s", cfg.Backend))
+	}
+}
+
+// expired tells whether the status is of a mail done with and left untouched since before oldest
+func expired(status *models.MailStatus, oldest time.Time) bool {
+	switch status.State {
+	case models.MailSent, models.MailFailed, models.MailBounced:
+		return status.UpdatedAt.Before(oldest)
+	default:
+		return false
+	}
+}
+
+type MemoryStatusStore struct {
+	// Retention is how long finished statuses are kept, 0 keeps them forever
+	Retention time.Duration
+
+	mu       sync.RWMutex
+	statuses map[string]models.MailStatus
+	swept    time.Time
+}
+
+func NewMemoryStatusStore() *MemoryStatusStore {
+	return &MemoryStatusStore{
+		statuses: make(map[string]models.MailStatus),
+	}
+}
+
+func (m *MemoryStatusStore) Save(status *models.MailStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := *status
+	saved.Attempts = append([]models.Attempt(nil), status.Attempts...)
+	m.statuses[status.ID] = saved
+
+	m.sweep(time.Now())
+	return nil
+}
+
+// sweep drops the expired statuses, at most once every statusSweepInterval
+func (m *MemoryStatusStore) sweep(now time.Time) {
+	if m.Retention <= 0 || now.Sub(m.swept) < statusSweepInterval {
+		return
+	}
+	oldest := now.Add(-m.Retention)
+	for id, status := range m.statuses {
+		if expired(&status, oldest) {
+			delete(m.statuses, id)
+		}
+	}
+	m.swept = now
+}
+
+func (m *MemoryStatusStore) Get(id string) (*models.MailStatus, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status, ok := m.statuses[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	status.Attempts = append([]models.Attempt(nil), status.Attempts...)
+	return &status, nil
+}
+
+func (m *MemoryStatusStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.statuses, id)
+	return nil
+}
+
+// FileStatusStore keeps one file per mail status in a directory
+type FileStatusStore struct {
+	Dir string
+	// Retention is how long finished statuses are kept, 0 keeps them forever
+	Retention time.Duration
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+func NewFileStatusStore(dir string) (*FileStatusStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "unable to create status directory")
+	}
+	return &FileStatusStore{Dir: dir}, nil
+}
+
+func (f *FileStatusStore) Save(status *models.MailStatus) error {
+	if err := f.files().write(status.ID, status); err != nil {
+		return err
+	}
+	return f.sweep(time.Now())
+}
+
+// sweep removes the files of expired statuses, at most once every statusSweepInterval. Only files written
+// before the retention are read.
+func (f *FileStatusStore) sweep(now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Retention <= 0 || now.Sub(f.swept) < statusSweepInterval {
+		return nil
+	}
+	f.swept = now
+
+	oldest := now.Add(-f.Retention)
+	ids, err := f.files().modifiedBefore(oldest)
+	if err != nil {
+		return errors.Wrap(err, "unable to sweep statuses")
+	}
+	for _, id := range ids {
+		status, err := f.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to sweep statuses")
+		}
+		if !expired(status, oldest) {
+			continue
+		}
+		if err := f.files().remove(id); err != nil {
+			return errors.Wrap(err, "unable to sweep statuses")
+		}
+	}
+	return nil
+}
+
+func (f *FileStatusStore) Get(id string) (*models.MailStatus, error) {
+	var status models.MailStatus
+	if err := f.files().read(id, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (f *FileStatusStore) Delete(id string) error {
+	return f.files().remove(id)
+}
+
+func (f *FileStatusStore) files() jsonDir {
+	return jsonDir{Dir: f.Dir, Ext: ".status"}
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockNamedProvider struct {
+	MockProvider
+	name string
+}
+
+func (m *MockNamedProvider) Name() string {
+	return m.name
+}
+
+func TestService_Status(t *testing.T) {
+	tests := []struct {
+		name             string
+		providers        []IProvider
+		retry            RetryConfig
+		expectedState    models.MailState
+		expectedProvider string
+		expectedAttempts []models.Attempt
+		expectedError    string
+	}{
+		{
+			name: "sent by first provider - should report provider and single attempt",
+			providers: []IProvider{
+				&MockNamedProvider{name: "first"},
+				&MockNamedProvider{name: "second"},
+			},
+			expectedState:    models.MailSent,
+			expectedProvider: "first",
+			expectedAttempts: []models.Attempt{
+				{Provider: "first"},
+			},
+		},
+		{
+			name: "sent after fail-over - should report failed attempt and last error",
+			providers: []IProvider{
+				&MockNamedProvider{name: "first", MockProvider: MockProvider{CallsBeforeError: -1, Error: errors.New("error sending email")}},
+				&MockNamedProvider{name: "second"},
+			},
+			expectedState:    models.MailSent,
+			expectedProvider: "second",
+			expectedAttempts: []models.Attempt{
+				{Provider: "first", Error: "error sending email", Kind: "transient"},
+				{Provider: "second"},
+			},
+			expectedError: "error sending email",
+		},
+		{
+			name: "every attempt failed - should report failed",
+			providers: []IProvider{
+				&MockNamedProvider{name: "first", MockProvider: MockProvider{CallsBeforeError: -1, Error: errors.New("error sending email")}},
+			},
+			retry:         RetryConfig{MaxAttempts: 2, Backoff: time.Millisecond},
+			expectedState: models.MailFailed,
+			expectedAttempts: []models.Attempt{
+				{Provider: "first", Error: "error sending email", Kind: "transient"},
+				{Provider: "first", Error: "error sending email", Kind: "transient"},
+			},
+			expectedError: "error sending email",
+		},
+		{
+			name: "unnamed provider - should report provider type",
+			providers: []IProvider{
+				&MockProvider{},
+			},
+			expectedState:    models.MailSent,
+			expectedProvider: "*service.MockProvider",
+			expectedAttempts: []models.Attempt{
+				{Provider: "*service.MockProvider"},
+			},
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewService(Config{Retry: tt.retry}, tt.providers, logger)
+			assert.NoError(t, err)
+
+			assert.NoError(t, s.QueueMail(&models.Mail{ID: "1234", Subject: "Test email 1"}))
+
+			time.Sleep(200 * time.Millisecond)
+			s.Quit()
+
+			status, err := s.Status("1234")
+			assert.NoError(t, err)
+			assert.Equal(t, "1234", status.ID)
+			assert.Equal(t, tt.expectedState, status.State, "unexpected state")
+			assert.Equal(t, tt.expectedProvider, status.Provider, "unexpected provider")
+			assert.Equal(t, tt.expectedError, status.LastError, "unexpected last error")
+
+			// attempt times are not deterministic
+			for i := range status.Attempts {
+				assert.False(t, status.Attempts[i].At.IsZero(), "attempt time not set")
+				status.Attempts[i].At = time.Time{}
+			}
+			assert.Equal(t, tt.expectedAttempts, status.Attempts, "unexpected attempts")
+
+			_, err = s.Status("unknown")
+			assert.Equal(t, ErrNotFound, err)
+		})
+	}
+}
+
+func TestFileStatusStore(t *testing.T) {
+
+	store, err := NewFileStatusStore(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = store.Get("1234")
+	assert.Equal(t, ErrNotFound, err)
+
+	status := &models.MailStatus{
+		ID:       "1234",
+		State:    models.MailSent,
+		Provider: "ses",
+		Attempts: []models.Attempt{
+			{Provider: "ses", At: time.Date(2023, 7, 24, 20, 10, 21, 0, time.UTC)},
+		},
+		CreatedAt: time.Date(2023, 7, 24, 20, 10, 20, 0, time.UTC),
+		UpdatedAt: time.Date(2023, 7, 24, 20, 10, 21, 0, time.UTC),
+	}
+	assert.NoError(t, store.Save(status))
+
+	stored, err := store.Get("1234")
+	assert.NoError(t, err)
+	assert.Equal(t, status, stored)
+}
+
+func TestStatusStore_Retention(t *testing.T) {
+
+	dir := t.TempDir()
+	file, err := NewFileStatusStore(dir)
+	assert.NoError(t, err)
+	file.Retention = time.Hour
+
+	memory := NewMemoryStatusStore()
+	memory.Retention = time.Hour
+
+	tests := []struct {
+		name  string
+		store IStatusStore
+		// age backdates the stored status as if it was written then
+		age   func(id string, at time.Time)
+		sweep func(now time.Time)
+	}{
+		{
+			name:  "memory store - should drop finished statuses past retention",
+			store: memory,
+			age:   func(string, time.Time) {},
+			sweep: func(now time.Time) { memory.sweep(now) },
+		},
+		{
+			name:  "file store - should remove finished statuses past retention",
+			store: file,
+			age: func(id string, at time.Time) {
+				assert.NoError(t, os.Chtimes(file.files().path(id), at, at))
+			},
+			sweep: func(now time.Time) { assert.NoError(t, file.sweep(now)) },
+		},
+	}
+
+	now := time.Now()
+	statuses := []*models.MailStatus{
+		{ID: "old-sent", State: models.MailSent, UpdatedAt: now.Add(-2 * time.Hour)},
+		{ID: "old-bounced", State: models.MailBounced, UpdatedAt: now.Add(-2 * time.Hour)},
+		{ID: "old-queued", State: models.MailQueued, UpdatedAt: now.Add(-2 * time.Hour)},
+		{ID: "recent-sent", State: models.MailSent, UpdatedAt: now.Add(-time.Minute)},
+	}
+	expected := map[string]bool{"old-sent": false, "old-bounced": false, "old-queued": true, "recent-sent": true}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, status := range statuses {
+				assert.NoError(t, tt.store.Save(status))
+				tt.age(status.ID, status.UpdatedAt)
+			}
+
+			// sweeps are spaced out, the first one ran on the first save
+			tt.sweep(now.Add(2 * statusSweepInterval))
+
+			for id, kept := range expected {
+				_, err := tt.store.Get(id)
+				if kept {
+					assert.NoError(t, err, "status %s dropped", id)
+					continue
+				}
+				assert.ErrorIs(t, err, ErrNotFound, "status %s kept", id)
+			}
+		})
+	}
+}
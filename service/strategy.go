@@ -0,0 +1,95 @@
+package service
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+const (
+	// StrategyFailover sends every mail through the first provider of its chain, the others are only failed
+	// over to
+	StrategyFailover = "failover"
+	// StrategyWeighted spreads mail across the providers of its chain by weight, failing over to the others in
+	// chain order
+	StrategyWeighted = "weighted"
+)
+
+// balancer spreads mail with a smooth weighted round-robin: over any run of mail each provider is picked in
+// proportion to its weight, and picks of the same provider are interleaved rather than bunched together
+type balancer struct {
+	// weights by provider name, nil weighs every provider the same
+	weights map[string]int
+
+	mu sync.Mutex
+	// current keeps the running weights of each route, chains differ between routes
+	current map[string]map[string]int
+}
+
+func newBalancer(weights map[string]int, providers []IProvider) (*balancer, error) {
+
+	known := make(map[string]bool)
+	for _, provider := range providers {
+		known[providerName(provider)] = true
+	}
+
+	for name, weight := range weights {
+		if !known[name] {
+			return nil, errors.New(fmt.Sprintf("weight given to unknown provider %s", name))
+		}
+		if weight < 0 {
+			return nil, errors.New(fmt.Sprintf("negative weight given to provider %s", name))
+		}
+	}
+
+	if len(weights) == 0 {
+		weights = nil
+	}
+
+	return &balancer{weights: weights, current: make(map[string]map[string]int)}, nil
+}
+
+// weight of a provider, providers left out of the weights only get mail failed over to them
+func (b *balancer) weight(name string) int {
+	if b.weights == nil {
+		return 1
+	}
+	return b.weights[name]
+}
+
+// order moves the provider picked for the next mail of the route to the front of its chain, the rest keep
+// their order for failover
+func (b *balancer) order(route string, providers []IProvider) []IProvider {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, ok := b.current[route]
+	if !ok {
+		current = make(map[string]int)
+		b.current[route] = current
+	}
+
+	picked, total := -1, 0
+	for i, provider := range providers {
+		name := providerName(provider)
+		weight := b.weight(name)
+		if weight == 0 {
+			continue
+		}
+		current[name] += weight
+		total += weight
+		if picked < 0 || current[name] > current[providerName(providers[picked])] {
+			picked = i
+		}
+	}
+
+	if picked < 0 {
+		return providers
+	}
+	current[providerName(providers[picked])] -= total
+
+	ordered := make([]IProvider, 0, len(providers))
+	ordered = append(ordered, providers[picked])
+	ordered = append(ordered, providers[:picked]...)
+	return append(ordered, providers[picked+1:]...)
+}
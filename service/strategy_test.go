@@ -0,0 +1,167 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBalancer_Order(t *testing.T) {
+
+	ses := &MockNamedProvider{name: "ses"}
+	sendgrid := &MockNamedProvider{name: "sendgrid"}
+	smtp := &MockNamedProvider{name: "smtp"}
+
+	tests := []struct {
+		name          string
+		weights       map[string]int
+		mails         int
+		expectedFirst []string
+	}{
+		{
+			name:          "no weights - should go round-robin",
+			mails:         6,
+			expectedFirst: []string{"ses", "sendgrid", "smtp", "ses", "sendgrid", "smtp"},
+		},
+		{
+			name:          "70/30 weights - should spread mail by weight, interleaved",
+			weights:       map[string]int{"ses": 7, "sendgrid": 3},
+			mails:         10,
+			expectedFirst: []string{"ses", "sendgrid", "ses", "ses", "ses", "sendgrid", "ses", "ses", "sendgrid", "ses"},
+		},
+		{
+			name:          "every weight zero - should keep the failover order",
+			weights:       map[string]int{"ses": 0},
+			mails:         2,
+			expectedFirst: []string{"ses", "ses"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newBalancer(tt.weights, []IProvider{ses, sendgrid, smtp})
+			assert.NoError(t, err)
+
+			var first []string
+			for i := 0; i < tt.mails; i++ {
+				chain := b.order("default", []IProvider{ses, sendgrid, smtp})
+				assert.Len(t, chain, 3, "providers lost for failover")
+				first = append(first, providerName(chain[0]))
+			}
+			assert.Equal(t, tt.expectedFirst, first)
+		})
+	}
+}
+
+func TestBalancer_FailoverOrder(t *testing.T) {
+
+	ses := &MockNamedProvider{name: "ses"}
+	sendgrid := &MockNamedProvider{name: "sendgrid"}
+	smtp := &MockNamedProvider{name: "smtp"}
+
+	b, err := newBalancer(map[string]int{"sendgrid": 1}, []IProvider{ses, sendgrid, smtp})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []IProvider{sendgrid, ses, smtp}, b.order("default", []IProvider{ses, sendgrid, smtp}))
+}
+
+func TestNewService_Strategy(t *testing.T) {
+	tests := []struct {
+		name          string
+		strategy      string
+		weights       map[string]int
+		expectedError string
+	}{
+		{
+			name:     "failover - should start",
+			strategy: StrategyFailover,
+		},
+		{
+			name:     "weighted - should start",
+			strategy: StrategyWeighted,
+			weights:  map[string]int{"ses": 70},
+		},
+		{
+			name:          "unknown strategy - should fail",
+			strategy:      "random",
+			expectedError: "unknown provider strategy random",
+		},
+		{
+			name:          "weight of an unknown provider - should fail",
+			strategy:      StrategyWeighted,
+			weights:       map[string]int{"mandrill": 70},
+			expectedError: "invalid provider weights: weight given to unknown provider mandrill",
+		},
+		{
+			name:          "negative weight - should fail",
+			strategy:      StrategyWeighted,
+			weights:       map[string]int{"ses": -1},
+			expectedError: "invalid provider weights: negative weight given to provider ses",
+		},
+	}
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewService(Config{Strategy: tt.strategy, Weights: tt.weights}, []IProvider{&MockNamedProvider{name: "ses"}}, logger)
+			if tt.expectedError == "" {
+				assert.NoError(t, err)
+				s.Quit()
+				return
+			}
+			assert.EqualError(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestService_WeightedStrategy(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	ses := &MockNamedProvider{name: "ses", MockProvider: MockProvider{CallsBeforeError: -1, Error: errors.New("connection refused")}}
+	sendgrid := &MockNamedProvider{name: "sendgrid"}
+
+	s, err := NewService(Config{
+		Workers:  1,
+		Strategy: StrategyWeighted,
+		Weights:  map[string]int{"ses": 1, "sendgrid": 1},
+		Breaker:  BreakerConfig{Threshold: 100},
+	}, []IProvider{ses, sendgrid}, logger)
+	assert.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, s.QueueMail(&models.Mail{ID: fmt.Sprintf("mail-%d", i)}))
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.Quit()
+
+	// every other mail tries ses first and fails over to sendgrid
+	ses.mu.Lock()
+	assert.Equal(t, 2, ses.CallCount, "unexpected ses calls")
+	ses.mu.Unlock()
+
+	sendgrid.mu.Lock()
+	assert.Equal(t, 4, sendgrid.CallCount, "unexpected sendgrid calls")
+	sendgrid.mu.Unlock()
+
+	for i := 0; i < 4; i++ {
+		status, err := s.Status(fmt.Sprintf("mail-%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, models.MailSent, status.State)
+		assert.Equal(t, "sendgrid", status.Provider)
+	}
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type UsageConfig struct {
+	// Retention is how long the usage of apps is kept, by hour and by day
+	Retention time.Duration `json:"retention" default:"720h"`
+	// Dir keeps the usage of every app across restarts, without it usage and daily limits start over from zero
+	// on every start
+	Dir string `json:"dir"`
+}
+
+// QuotaError is returned for mail over the daily limit of its app, the app can send again from Until
+type QuotaError struct {
+	App   string
+	Limit int
+	Until time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("app %s reached its daily limit of %d mail", e.App, e.Limit)
+}
+
+// usageMeter counts the mail of every app in hourly and daily buckets. Counts are kept in memory, and written
+// to a directory when one is given so they outlive a restart.
+type usageMeter struct {
+	now       func() time.Time
+	retention time.Duration
+	logger    *log.Logger
+
+	// files keeps the usage of every app under its ID, nil keeps it in memory only
+	files *jsonDir
+
+	mu   sync.Mutex
+	apps map[int]*appUsage
+}
+
+type appUsage struct {
+	hourly map[time.Time]*models.UsageBucket
+	daily  map[time.Time]*models.UsageBucket
+}
+
+// savedUsage is what is kept of the usage of an app across restarts
+type savedUsage struct {
+	Hourly []models.UsageBucket `json:"hourly"`
+	Daily  []models.UsageBucket `json:"daily"`
+}
+
+func newUsageMeter(cfg UsageConfig, logger *log.Logger) (*usageMeter, error) {
+	retention := cfg.Retention
+	if retention <= 0 {
+		retention = 30 * 24 * time.Hour
+	}
+	u := &usageMeter{now: time.Now, retention: retention, logger: logger, apps: make(map[int]*appUsage)}
+
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return nil, errors.Wrap(err, "unable to create usage directory")
+		}
+		u.files = &jsonDir{Dir: cfg.Dir, Ext: ".usage"}
+	}
+	return u, nil
+}
+
+// accept counts a mail accepted from the app, unless the app reached its daily limit. It then returns false
+// along with the start of the next day.
+func (u *usageMeter) accept(app int, limit int) (time.Time, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := u.now()
+	usage := u.usage(app, now)
+
+	today := usage.bucket(usage.daily, startOfDay(now))
+	if limit > 0 && today.Accepted >= limit {
+		return startOfDay(now).AddDate(0, 0, 1), false
+	}
+
+	today.Accepted++
+	usage.bucket(usage.hourly, startOfHour(now)).Accepted++
+	u.save(app, usage)
+	return time.Time{}, true
+}
+
+// unaccept takes back a mail counted as accepted that could not be queued after all
+func (u *usageMeter) unaccept(app int) {
+	u.count(app, func(bucket *models.UsageBucket) {
+		if bucket.Accepted > 0 {
+			bucket.Accepted--
+		}
+	})
+}
+
+// count applies the change to the current hour and day of the app
+func (u *usageMeter) count(app int, change func(bucket *models.UsageBucket)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := u.now()
+	usage := u.usage(app, now)
+	change(usage.bucket(usage.hourly, startOfHour(now)))
+	change(usage.bucket(usage.daily, startOfDay(now)))
+	u.save(app, usage)
+}
+
+// usage returns the usage of the app, dropping the buckets past retention
+func (u *usageMeter) usage(app int, now time.Time) *appUsage {
+	usage, ok := u.apps[app]
+	if !ok {
+		usage = u.load(app)
+		u.apps[app] = usage
+	}
+
+	oldest := now.Add(-u.retention)
+	for _, buckets := range []map[time.Time]*models.UsageBucket{usage.hourly, usage.daily} {
+		for start := range buckets {
+			if start.Before(oldest) {
+				delete(buckets, start)
+			}
+		}
+	}
+	return usage
+}
+
+// load reads the usage saved for the app by a previous run, an app without any starts from zero
+func (u *usageMeter) load(app int) *appUsage {
+	usage := &appUsage{
+		hourly: make(map[time.Time]*models.UsageBucket),
+		daily:  make(map[time.Time]*models.UsageBucket),
+	}
+	if u.files == nil {
+		return usage
+	}
+
+	var saved savedUsage
+	if err := u.files.read(strconv.Itoa(app), &saved); err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			u.logger.E("unable to load app usage, counting from zero", "appID", app, "err", err)
+		}
+		return usage
+	}
+
+	for _, bucket := range saved.Hourly {
+		restored := bucket
+		usage.hourly[bucket.Start] = &restored
+	}
+	for _, bucket := range saved.Daily {
+		restored := bucket
+		usage.daily[bucket.Start] = &restored
+	}
+	return usage
+}
+
+// save writes the usage of the app to its file, it does nothing when usage is kept in memory
+func (u *usageMeter) save(app int, usage *appUsage) {
+	if u.files == nil {
+		return
+	}
+	saved := savedUsage{Hourly: sortedBuckets(usage.hourly), Daily: sortedBuckets(usage.daily)}
+	if err := u.files.write(strconv.Itoa(app), saved); err != nil {
+		u.logger.E("unable to save app usage", "appID", app, "err", err)
+	}
+}
+
+func (a *appUsage) bucket(buckets map[time.Time]*models.UsageBucket, start time.Time) *models.UsageBucket {
+	bucket, ok := buckets[start]
+	if !ok {
+		bucket = &models.UsageBucket{Start: start}
+		buckets[start] = bucket
+	}
+	return bucket
+}
+
+// report lists the buckets of the app, oldest first
+func (u *usageMeter) report(app *models.App) *models.UsageReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	usage := u.usage(app.ID, u.now())
+	return &models.UsageReport{App: app.Name, Hourly: sortedBuckets(usage.hourly), Daily: sortedBuckets(usage.daily)}
+}
+
+func sortedBuckets(buckets map[time.Time]*models.UsageBucket) []models.UsageBucket {
+	sorted := make([]models.UsageBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		sorted = append(sorted, *bucket)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+	return sorted
+}
+
+func startOfHour(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour)
+}
+
+// Usage reports the mail accepted, sent, failed and bounced for the app by hour and by day
+func (s *Service) Usage(id int) (*models.UsageReport, error) {
+	app, err := s.Apps.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.usage.report(app), nil
+}
+
+// UsageReports reports the usage of every app, in app ID order
+func (s *Service) UsageReports() ([]*models.UsageReport, error) {
+	apps, err := s.Apps.List()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*models.UsageReport, 0, len(apps))
+	for _, app := range apps {
+		reports = append(reports, s.usage.report(app))
+	}
+	return reports, nil
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gugabfigueiredo/dream-mail-go/models"
+	log "github.com/gugabfigueiredo/tiny-go-log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageMeter(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	billing := &models.App{ID: 1, Name: "billing"}
+	now := time.Date(2024, time.January, 31, 22, 30, 0, 0, time.UTC)
+	u, err := newUsageMeter(UsageConfig{Retention: 48 * time.Hour}, logger)
+	assert.NoError(t, err)
+	u.now = func() time.Time { return now }
+
+	_, ok := u.accept(billing.ID, 2)
+	assert.True(t, ok)
+	u.count(billing.ID, func(bucket *models.UsageBucket) { bucket.Sent++ })
+
+	now = now.Add(40 * time.Minute)
+	_, ok = u.accept(billing.ID, 2)
+	assert.True(t, ok)
+
+	// the limit holds for the day whatever the hour
+	now = now.Add(5 * time.Minute)
+	until, ok := u.accept(billing.ID, 2)
+	assert.False(t, ok, "daily limit not enforced")
+	assert.Equal(t, time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC), until)
+
+	u.unaccept(billing.ID)
+	_, ok = u.accept(billing.ID, 2)
+	assert.True(t, ok, "unaccepted mail still counted")
+
+	report := u.report(billing)
+	assert.Equal(t, []models.UsageBucket{
+		{Start: time.Date(2024, time.January, 31, 22, 0, 0, 0, time.UTC), Accepted: 1, Sent: 1},
+		{Start: time.Date(2024, time.January, 31, 23, 0, 0, 0, time.UTC), Accepted: 1},
+	}, report.Hourly)
+	assert.Equal(t, []models.UsageBucket{
+		{Start: time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC), Accepted: 2, Sent: 1},
+	}, report.Daily)
+
+	// a new day starts over, old buckets go once past retention
+	now = now.Add(24 * time.Hour)
+	_, ok = u.accept(billing.ID, 2)
+	assert.True(t, ok)
+
+	report = u.report(billing)
+	assert.Len(t, report.Hourly, 3)
+	assert.Len(t, report.Daily, 2)
+
+	now = now.Add(47 * time.Hour)
+	report = u.report(billing)
+	assert.Len(t, report.Hourly, 1)
+	assert.Empty(t, report.Daily)
+}
+
+func TestUsageMeter_Persisted(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	billing := &models.App{ID: 1, Name: "billing"}
+	cfg := UsageConfig{Retention: 48 * time.Hour, Dir: t.TempDir()}
+	now := time.Date(2024, time.January, 31, 22, 30, 0, 0, time.UTC)
+
+	restart := func() *usageMeter {
+		u, err := newUsageMeter(cfg, logger)
+		assert.NoError(t, err)
+		u.now = func() time.Time { return now }
+		return u
+	}
+
+	u := restart()
+	for i := 0; i < 2; i++ {
+		_, ok := u.accept(billing.ID, 2)
+		assert.True(t, ok)
+	}
+	u.count(billing.ID, func(bucket *models.UsageBucket) { bucket.Sent++ })
+
+	// the daily limit holds across a restart
+	u = restart()
+	_, ok := u.accept(billing.ID, 2)
+	assert.False(t, ok, "daily limit started over on restart")
+	assert.Equal(t, []models.UsageBucket{
+		{Start: time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC), Accepted: 2, Sent: 1},
+	}, u.report(billing).Daily)
+
+	_, ok = u.accept(2, 2)
+	assert.True(t, ok, "usage of another app counted")
+
+	now = now.Add(2 * time.Hour)
+	u = restart()
+	_, ok = u.accept(billing.ID, 2)
+	assert.True(t, ok, "usage of a past day kept against the limit")
+}
+
+func TestService_Usage(t *testing.T) {
+
+	logger := log.New(&log.Config{
+		Context:               "dmail-go",
+		ConsoleLoggingEnabled: false,
+		EncodeLogsAsJson:      true,
+	})
+
+	// the first mail goes through, every mail after it is refused for good
+	provider := &MockProvider{CallsBeforeError: 1, Error: NewSendError(ErrorPermanent, "mock", "550", errors.New("no such user"))}
+
+	s, err := NewService(Config{Workers: 1, Apps: AppsConfig{File: filepath.Join(t.TempDir(), "apps.json")}}, []IProvider{provider}, logger)
+	assert.NoError(t, err)
+	defer s.Quit()
+
+	assert.NoError(t, s.SaveApp(&models.App{Name: "billing", DailyLimit: 2}))
+
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "sent", App: "billing", AppID: 1}))
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "bounced", App: "billing", AppID: 1}))
+	time.Sleep(50 * time.Millisecond)
+
+	var quota *QuotaError
+	assert.ErrorAs(t, s.QueueMail(&models.Mail{ID: "over", App: "billing", AppID: 1}), &quota)
+	assert.Equal(t, 2, quota.Limit)
+	assert.True(t, quota.Until.After(time.Now()), "quota reset not in the future")
+
+	// requeued mail does not count against the limit
+	assert.NoError(t, s.Requeue("bounced"))
+	time.Sleep(50 * time.Millisecond)
+
+	report, err := s.Usage(1)
+	assert.NoError(t, err)
+	if assert.Len(t, report.Daily, 1) {
+		day := report.Daily[0]
+		assert.Equal(t, 2, day.Accepted)
+		assert.Equal(t, 1, day.Sent)
+		assert.Equal(t, 2, day.Bounced)
+		assert.Equal(t, 0, day.Failed)
+	}
+
+	_, err = s.Usage(99)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// an app recreated under the same name starts with a usage of its own
+	assert.NoError(t, s.DeleteApp(1))
+	recreated := &models.App{Name: "billing", DailyLimit: 2}
+	assert.NoError(t, s.SaveApp(recreated))
+
+	report, err = s.Usage(recreated.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Daily, "usage of a deleted app inherited")
+	assert.NoError(t, s.QueueMail(&models.Mail{ID: "recreated", App: "billing", AppID: recreated.ID}))
+}
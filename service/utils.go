@@ -1,43 +1,44 @@
 package service
 
 import (
-	"fmt"
+	"github.com/gugabfigueiredo/dream-mail-go/message"
 	"github.com/gugabfigueiredo/dream-mail-go/models"
-	"path/filepath"
+	"net/mail"
 	"strings"
 )
 
-func buildSMTPMessage(mail *models.Mail, tos []string) []byte {
-	//build message from mail
-	msg := fmt.Sprintf("From: %s\r\n", mail.From.Addr)
-	msg += fmt.Sprintf("To: %s\r\n", strings.Join(tos, ","))
-	msg += fmt.Sprintf("Subject: %s\r\n", mail.Subject)
-
-	msg += "MIME-Version: 1.0\r\n"
-	msg += fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"dmailboundary\"\r\n")
-
-	if mail.Text != "" {
-		msg += "\r\n--dmailboundary\r\n"
-		msg += "Content-Type: text/plain; charset=\"utf-8\"\r\n"
-		msg += fmt.Sprintf("\r\n%s\r\n", mail.Text)
+func joinAddrs(emails []models.Email) string {
+	var addrs []string
+	for _, email := range emails {
+		addrs = append(addrs, email.Addr)
 	}
+	return strings.Join(addrs, ",")
+}
 
-	if mail.HTML != "" {
-		msg += "\r\n--dmailboundary\r\n"
-		msg += "Content-Type: text/html; charset=\"utf-8\"\r\n"
-		msg += fmt.Sprintf("\r\n%s\r\n", mail.HTML)
+// formatAddress renders an address with its display name, for providers that take address strings
+func formatAddress(email models.Email) string {
+	return (&mail.Address{Name: email.Name, Address: email.Addr}).String()
+}
+
+func formatAddresses(emails []models.Email) []string {
+	var addrs []string
+	for _, email := range emails {
+		addrs = append(addrs, formatAddress(email))
 	}
+	return addrs
+}
 
-	for _, attachment := range mail.Attachments {
-		_, fileName := filepath.Split(attachment.Name)
+// buildRawMessage composes the raw message for mail, signed when a signer is set
+func buildRawMessage(builder *message.Builder, signer IMessageSigner, mail *models.Mail) ([]byte, error) {
 
-		msg += "\r\n--dmailboundary\r\n"
-		msg += fmt.Sprintf("Content-Type: %s; charset=\"utf-8\"\r\n", attachment.Type)
-		msg += fmt.Sprintf("Content-Disposition: attachment;filename=\"%s\"\r\n", fileName)
-		msg += fmt.Sprintf("\r\n%s\r\n", attachment.Data)
+	msg, err := builder.Build(mail)
+	if err != nil {
+		return nil, err
 	}
 
-	msg += "\r\n--dmailboundary\r\n"
+	if signer == nil {
+		return msg, nil
+	}
 
-	return []byte(msg)
+	return signer.Sign(msg)
 }